@@ -14,7 +14,7 @@ func main() {
 	out, err := os.Create(os.Args[2] + ".go")
 	out.WriteString(`
 // Generated, DO NOT EDIT. Name is intentional.
-package main
+package lox
 `)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,839 @@
+package lox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Engine is a way of running programs. All of them behave the same.
+type Engine int
+
+const (
+	// TreeWalker runs programs by walking their syntax tree.
+	TreeWalker Engine = iota
+	// Bytecode compiles programs for a stack machine and runs them there.
+	Bytecode
+)
+
+func (e Engine) String() string {
+	switch e {
+	case TreeWalker:
+		return "TreeWalker"
+	case Bytecode:
+		return "Bytecode"
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
+}
+
+// Option configures Compile or NewVM.
+type Option func(*config)
+
+type config struct {
+	stdout   io.Writer
+	stderr   io.Writer
+	maxDepth int
+	engine   Engine
+	optimize bool
+
+	maxSteps  int64
+	maxMemory int64
+	maxOutput int64
+
+	caps  Capabilities
+	hooks Hooks
+	clock Clock
+}
+
+func configure(opts []Option) config {
+	c := config{
+		stdout:   os.Stdout,
+		maxDepth: DefaultMaxDepth,
+		optimize: true,
+	}
+	for _, o := range opts {
+		o(&c)
+	}
+	return c
+}
+
+// Stdout sets where print writes, os.Stdout by default.
+func Stdout(w io.Writer) Option {
+	return func(c *config) { c.stdout = w }
+}
+
+// Stderr sets where runtime errors are reported as they stop a program. Run
+// returns them either way; by default they're only returned.
+func Stderr(w io.Writer) Option {
+	return func(c *config) { c.stderr = w }
+}
+
+// MaxDepth sets the maximum depth of nested calls. Going deeper exceeds the
+// DepthLimit.
+func MaxDepth(n int) Option {
+	return func(c *config) { c.maxDepth = n }
+}
+
+// MaxSteps sets how many steps a run may take: instructions on the Bytecode
+// engine, statements on the TreeWalker. Zero, the default, means no limit.
+func MaxSteps(n int64) Option {
+	return func(c *config) { c.maxSteps = n }
+}
+
+// MaxMemory sets roughly how many bytes a run may allocate for strings,
+// functions and variables. It counts allocations, not what's in use. Zero,
+// the default, means no limit.
+func MaxMemory(bytes int64) Option {
+	return func(c *config) { c.maxMemory = bytes }
+}
+
+// MaxOutput sets how many bytes a run may print. Zero, the default, means no
+// limit.
+func MaxOutput(bytes int64) Option {
+	return func(c *config) { c.maxOutput = bytes }
+}
+
+// Allow grants scripts caps. By default they get none.
+func Allow(caps Capabilities) Option {
+	return func(c *config) { c.caps = caps }
+}
+
+// Backend sets the engine of a VM, TreeWalker by default.
+func Backend(e Engine) Option {
+	return func(c *config) { c.engine = e }
+}
+
+// Optimizations sets whether Compile folds constants and removes dead code,
+// which it does by default.
+func Optimizations(on bool) Option {
+	return func(c *config) { c.optimize = on }
+}
+
+// Diagnostic is an error found in a script before running it.
+type Diagnostic struct {
+	Line    int
+	Message string
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("line %d: %s", d.Line, d.Message)
+}
+
+// Program is a compiled script. It can be run by any number of VMs, in
+// parallel too.
+type Program struct {
+	stmts []stmt
+	// loaded is set for programs loaded from bytecode, which have no stmts.
+	loaded bool
+	// src and optimize compile the program again when restoring snapshots.
+	src      []byte
+	optimize bool
+
+	once    sync.Once
+	scripts []*proto
+	err     *Error
+}
+
+// Compile scans, parses and resolves a script.
+func Compile(src []byte, opts ...Option) (p *Program, diags []Diagnostic) {
+	defer func() {
+		if r := recover(); r != nil {
+			p, diags = nil, append(diags, Diagnostic{0, fmt.Sprintf("internal error: %v", r)})
+		}
+	}()
+	c := configure(opts)
+	scanner := newScanner(src)
+	tokens := scanner.ScanTokens()
+	for _, e := range scanner.Errors {
+		diags = append(diags, Diagnostic{e.Token.Line, e.Message})
+	}
+	parser := newParser(tokens)
+	stmts, err := parser.Parse()
+	for _, e := range parser.Errors {
+		diags = append(diags, Diagnostic{e.Token.Line, e.Message})
+	}
+	if err != nil {
+		diags = append(diags, Diagnostic{err.Token.Line, err.Message})
+	}
+	if len(diags) > 0 {
+		return nil, diags
+	}
+	if c.optimize {
+		stmts = optimize(stmts)
+	}
+	if err := resolve(stmts); err != nil {
+		return nil, []Diagnostic{{err.Token.Line, err.Message}}
+	}
+	return &Program{stmts: stmts, src: src, optimize: c.optimize}, nil
+}
+
+// LoadBytecode loads a program saved by Program.Bytecode.
+func LoadBytecode(bs []byte) (*Program, error) {
+	scripts, err := decodeScripts(bs)
+	if err != nil {
+		return nil, err
+	}
+	p := &Program{loaded: true, scripts: scripts}
+	p.once.Do(func() {})
+	return p, nil
+}
+
+// compiled returns the bytecode of p, compiling it on first use.
+func (p *Program) compiled() ([]*proto, *Error) {
+	p.once.Do(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				p.scripts, p.err = nil, &Error{Token{}, fmt.Sprintf("internal error: %v", r)}
+			}
+		}()
+		p.scripts, p.err = newCompiler().Compile(p.stmts)
+	})
+	return p.scripts, p.err
+}
+
+// Bytecode serializes p in the .loxc format.
+func (p *Program) Bytecode() ([]byte, error) {
+	scripts, err := p.compiled()
+	if err != nil {
+		return nil, err
+	}
+	return encodeScripts(scripts), nil
+}
+
+// Disassemble writes a listing of the bytecode of p.
+func (p *Program) Disassemble(w io.Writer) error {
+	scripts, err := p.compiled()
+	if err != nil {
+		return err
+	}
+	for i, s := range scripts {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		disassemble(w, s)
+	}
+	return nil
+}
+
+// Emit translates p into lang, go or wat. source names the script in the
+// output.
+func (p *Program) Emit(lang, source string) ([]byte, error) {
+	if p.loaded {
+		return nil, errors.New("can't translate a program loaded from bytecode")
+	}
+	var out []byte
+	var err *Error
+	switch lang {
+	case "go":
+		out, err = emitGo(p.stmts, source)
+	case "wat":
+		out, err = emitWat(p.stmts, source)
+	default:
+		return nil, fmt.Errorf("can't emit %s", lang)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Decl is a function declared at the top level of a program.
+type Decl struct {
+	Name   string
+	Params []string
+}
+
+// Functions lists the top-level functions of p in order.
+func (p *Program) Functions() []Decl {
+	var decls []Decl
+	for _, s := range p.stmts {
+		if f, k := s.(*functionStmt); k {
+			d := Decl{Name: string(f.Name.Lexeme)}
+			for _, param := range f.Params {
+				d.Params = append(d.Params, string(param.Lexeme))
+			}
+			decls = append(decls, d)
+		}
+	}
+	return decls
+}
+
+// Tests lists the names of the tests of p in order.
+func (p *Program) Tests() []string {
+	var names []string
+	for _, s := range p.stmts {
+		if t, k := s.(*testStmt); k {
+			names = append(names, string(t.Name.Literal.([]byte)))
+		}
+	}
+	return names
+}
+
+// VM runs programs. Globals defined by a program are seen by the programs run
+// after it. A VM must not be used by several goroutines at once.
+type VM struct {
+	*vmState
+}
+
+// vmState is what a VM has. Its event loop and tasks refer to it through a
+// VM of their own, so the one of the host can be finalized while tasks are
+// blocked, ending them.
+type vmState struct {
+	conf    config
+	tree    *interpreter
+	machine *machine
+	// granted are the natives of the capabilities of the VM, and those of
+	// its event loop and tasks.
+	granted map[string]callable
+	loop    *eventLoop
+	tasks   *scheduler
+	// defs are the globals defined by the host, for engines made later.
+	defs map[string]Value
+	// ran is the engine of the last run, the configured one before any.
+	ran Engine
+	// running counts the runs and calls in progress, more than one when
+	// natives call back into the VM.
+	running int
+	// programs are those run, which have the functions of snapshots.
+	programs []*Program
+}
+
+// NewVM returns a VM with nothing but the natives defined, those its
+// capabilities grant, the timers and promises of its event loop, and
+// channels.
+func NewVM(opts ...Option) *VM {
+	c := configure(opts)
+	in := &VM{&vmState{conf: c, ran: c.engine}}
+	in.loop = newEventLoop(in, c.clock)
+	in.tasks = newScheduler(in)
+	in.granted = c.caps.natives(time.Now(), in.tasks)
+	for name, fn := range in.loop.natives() {
+		in.granted[name] = fn
+	}
+	for name, fn := range in.tasks.natives() {
+		in.granted[name] = fn
+	}
+	vm := &VM{in.vmState}
+	runtime.SetFinalizer(vm, (*VM).discard)
+	return vm
+}
+
+// discard ends the tasks left once the host drops the VM. It doesn't wait
+// for them, as those in host functions end when the functions return.
+func (vm *VM) discard() {
+	go vm.tasks.reset()
+}
+
+func (vm *VM) interpreter() *interpreter {
+	if vm.tree == nil {
+		vm.tree = newInterpreter(newEnvironment(nil))
+		vm.tree.MaxDepth = vm.conf.maxDepth
+		vm.tree.Stdout = vm.conf.stdout
+		vm.tree.hooks = vm.conf.hooks
+		vm.tree.quota = newQuota(vm.conf)
+		vm.tree.tasks = vm.tasks
+		for name, fn := range vm.granted {
+			vm.tree.globals.Define(name, ObjectValue(fn))
+		}
+		for name, v := range vm.defs {
+			vm.tree.globals.Define(name, v)
+		}
+	}
+	return vm.tree
+}
+
+func (vm *VM) bytecode() *machine {
+	if vm.machine == nil {
+		vm.machine = newMachine(newEnvironment(nil))
+		vm.machine.MaxDepth = vm.conf.maxDepth
+		vm.machine.Stdout = vm.conf.stdout
+		vm.machine.hooks = vm.conf.hooks
+		vm.machine.quota = newQuota(vm.conf)
+		vm.machine.tasks = vm.tasks
+		for name, fn := range vm.granted {
+			vm.machine.globals.Define(name, ObjectValue(fn))
+		}
+		for name, v := range vm.defs {
+			vm.machine.globals.Define(name, v)
+		}
+	}
+	return vm.machine
+}
+
+// engine returns the engine of the last run.
+func (vm *VM) engine() engine {
+	if vm.ran == Bytecode {
+		return vm.bytecode()
+	}
+	return vm.interpreter()
+}
+
+// Define makes x a global of scripts called name, converting it with ValueOf.
+func (vm *VM) Define(name string, x interface{}) error {
+	v, err := ValueOf(x)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	if vm.defs == nil {
+		vm.defs = make(map[string]Value)
+	}
+	vm.defs[name] = v
+	if vm.tree != nil {
+		vm.tree.globals.Define(name, v)
+	}
+	if vm.machine != nil {
+		vm.machine.globals.Define(name, v)
+	}
+	return nil
+}
+
+// Interrupted is the error of a run stopped because its context is done. Err
+// is the error of the context, so errors.Is(err, context.Canceled) and
+// errors.Is(err, context.DeadlineExceeded) tell why.
+type Interrupted struct {
+	Line int
+	Err  error
+}
+
+func (e *Interrupted) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.reason())
+}
+
+func (e *Interrupted) reason() string {
+	switch e.Err {
+	case context.Canceled:
+		return "cancelled"
+	case context.DeadlineExceeded:
+		return "deadline exceeded"
+	case nil:
+		return "interrupted"
+	}
+	return e.Err.Error()
+}
+
+func (e *Interrupted) Unwrap() error {
+	return e.Err
+}
+
+// Limit is a quota a run can exceed.
+type Limit int
+
+const (
+	StepLimit Limit = iota
+	MemoryLimit
+	DepthLimit
+	OutputLimit
+)
+
+func (l Limit) String() string {
+	switch l {
+	case StepLimit:
+		return "steps"
+	case MemoryLimit:
+		return "memory"
+	case DepthLimit:
+		return "depth"
+	case OutputLimit:
+		return "output"
+	}
+	return fmt.Sprintf("Limit(%d)", int(l))
+}
+
+func (l Limit) message() string {
+	switch l {
+	case StepLimit:
+		return "step limit exceeded"
+	case DepthLimit:
+		return "stack overflow"
+	}
+	return fmt.Sprintf("%s limit exceeded", l)
+}
+
+// QuotaExceeded is the error of a run stopped because it went over a limit.
+type QuotaExceeded struct {
+	Line  int
+	Limit Limit
+}
+
+func (e *QuotaExceeded) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Limit.message())
+}
+
+// Run runs the top-level statements of p in order. A runtime error stops the
+// statement it happens in and Run goes on with the next one, like the command
+// line runner does. Run returns the first error. Programs loaded from bytecode
+// always run on the Bytecode engine, with its own globals.
+//
+// Run stops with an *Interrupted error when ctx is done, and with a
+// *QuotaExceeded error when it goes over a limit. Either ends the whole run,
+// but for a stack overflow. Natives are passed ctx, so they can stop too.
+// Each run gets the quotas anew.
+//
+// Tasks spawned by p run when it waits for them, and once its statements are
+// done until each of them is done or blocked. Errors of tasks are reported
+// like those of statements. Tasks still blocked, or in host functions, are
+// left for RunLoop, or end once the VM is dropped.
+func (vm *VM) Run(ctx context.Context, p *Program) error {
+	if err := ctx.Err(); err != nil {
+		return &Interrupted{Err: err}
+	}
+	if vm.running > 0 {
+		return errors.New("lox: Run called while the VM is running")
+	}
+	vm.running++
+	defer func() { vm.running-- }()
+	vm.remember(p)
+	vm.tasks.begin(ctx)
+	defer vm.tasks.finish()
+	var first error
+	// fail records err, after those of tasks, and tells if the run must
+	// stop, dropping what it scheduled then.
+	fail := func(err *Error) bool {
+		e := vm.fail(ctx, err)
+		if first == nil {
+			if first = vm.tasks.err; first == nil {
+				first = e
+			}
+		}
+		if err != nil && fatal(err) {
+			vm.loop.reset()
+			vm.tasks.reset()
+			return true
+		}
+		return false
+	}
+	over := false
+	if p.loaded || vm.conf.engine == Bytecode {
+		scripts, err := p.compiled()
+		if err != nil {
+			return vm.fail(ctx, err)
+		}
+		m := vm.bytecode()
+		m.SetContext(ctx)
+		m.quota = newQuota(vm.conf)
+		vm.ran = Bytecode
+		for _, s := range scripts {
+			if over = fail(m.Run(s)); over {
+				break
+			}
+		}
+	} else {
+		i := vm.interpreter()
+		i.SetContext(ctx)
+		i.quota = newQuota(vm.conf)
+		vm.ran = TreeWalker
+		for _, s := range p.stmts {
+			if over = fail(i.guarded(s)); over {
+				break
+			}
+		}
+	}
+	if !over {
+		fail(vm.tasks.drain())
+	}
+	return first
+}
+
+// remember records that p was run.
+func (vm *VM) remember(p *Program) {
+	for _, q := range vm.programs {
+		if q == p {
+			return
+		}
+	}
+	vm.programs = append(vm.programs, p)
+}
+
+// RunTest runs the top-level statements of p that aren't tests and then the
+// test called name. Tests should get a VM each.
+func (vm *VM) RunTest(ctx context.Context, p *Program, name string) error {
+	if err := ctx.Err(); err != nil {
+		return &Interrupted{Err: err}
+	}
+	var test *testStmt
+	var setup []stmt
+	for _, s := range p.stmts {
+		if t, k := s.(*testStmt); !k {
+			setup = append(setup, s)
+		} else if test == nil && string(t.Name.Literal.([]byte)) == name {
+			test = t
+		}
+	}
+	if test == nil {
+		return fmt.Errorf("no test %q", name)
+	}
+	if vm.running > 0 {
+		return errors.New("lox: RunTest called while the VM is running")
+	}
+	vm.running++
+	defer func() { vm.running-- }()
+	body := &blockStmt{Stmts: test.Body, Names: test.Names}
+	var scripts []*proto
+	if vm.conf.engine == Bytecode {
+		var err *Error
+		if scripts, err = p.compiled(); err == nil {
+			scripts, err = compileTest(scripts, body)
+		}
+		if err != nil {
+			return vm.fail(ctx, err)
+		}
+	}
+	vm.remember(p)
+	vm.tasks.begin(ctx)
+	defer vm.tasks.finish()
+	var err *Error
+	if scripts != nil {
+		m := vm.bytecode()
+		m.SetContext(ctx)
+		m.quota = newQuota(vm.conf)
+		vm.ran = Bytecode
+		for _, s := range scripts {
+			if err = m.Run(s); err != nil {
+				break
+			}
+		}
+	} else {
+		i := vm.interpreter()
+		i.SetContext(ctx)
+		i.quota = newQuota(vm.conf)
+		vm.ran = TreeWalker
+		if err = i.interpret(setup); err == nil {
+			err = i.guarded(body)
+			if err != nil && err.Token.Type == returnMe {
+				// return inside a test just ends it
+				err = nil
+			}
+		}
+	}
+	if err == nil {
+		err = vm.tasks.drain()
+	}
+	if err != nil {
+		// The test failed, its tasks won't be waited for.
+		vm.tasks.reset()
+	}
+	e := vm.fail(ctx, err)
+	if vm.tasks.err != nil {
+		return vm.tasks.err
+	}
+	return e
+}
+
+// compileTest appends the script running the test body to setup.
+func compileTest(setup []*proto, body *blockStmt) (scripts []*proto, err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			scripts, err = nil, &Error{Token{}, fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+	script, err := newCompiler().script(body)
+	if err != nil {
+		return nil, err
+	}
+	return append(setup[:len(setup):len(setup)], script), nil
+}
+
+// Global is a global variable of a VM, seen from the host.
+type Global struct {
+	vm   *VM
+	env  *environment
+	name string
+	// bytecode is set for the globals of the Bytecode engine.
+	bytecode bool
+}
+
+// Global returns the global called name of the engine the VM last ran a
+// program on. It needn't be defined yet.
+func (vm *VM) Global(name string) *Global {
+	if vm.ran == Bytecode {
+		return &Global{vm, vm.bytecode().globals, name, true}
+	}
+	return &Global{vm, vm.interpreter().globals, name, false}
+}
+
+// Value returns the value of g, Nil if it's undefined.
+func (g *Global) Value() Value {
+	if b := g.env.values[g.name]; b != nil {
+		return b.val
+	}
+	return Nil
+}
+
+// Call calls the function in g with args converted by ValueOf, and returns
+// its result. It's stopped by ctx and limited by quotas like Run, and
+// errors of the script are *RuntimeError. A native can call back into the
+// VM running it, and the call is then part of that run. Tasks go on while a
+// host function taking a context runs, so it must call back with that
+// context, or get an error while they run.
+func (g *Global) Call(ctx context.Context, args ...interface{}) (Value, error) {
+	// A host function that let other tasks go on takes the turn back.
+	if t, k := ctx.Value(turnKey{}).(*task); k && t.out {
+		if err := g.vm.tasks.retake(t); err != nil {
+			return Nil, errors.New("lox: " + err.Message)
+		}
+		defer g.vm.tasks.release()
+	} else if !k && g.vm.tasks.stray() {
+		return Nil, errors.New("lox: call back into the VM without the context of the host function")
+	}
+	b := g.env.values[g.name]
+	if b == nil {
+		return Nil, fmt.Errorf("undefined variable '%s'", g.name)
+	}
+	in := make([]Value, len(args))
+	for k, a := range args {
+		v, err := ValueOf(a)
+		if err != nil {
+			return Nil, fmt.Errorf("argument %d: %w", k+1, err)
+		}
+		in[k] = v
+	}
+	return g.vm.call(ctx, g.bytecode, g.name, b.val, in)
+}
+
+func (vm *VM) call(ctx context.Context, bytecode bool, name string, fn Value, args []Value) (Value, error) {
+	if err := ctx.Err(); err != nil {
+		return Nil, &Interrupted{Err: err}
+	}
+	var v Value
+	var trace []Frame
+	var err *Error
+	outer := vm.running == 0
+	if outer {
+		vm.tasks.begin(ctx)
+		defer vm.tasks.finish()
+	}
+	if bytecode {
+		m := vm.bytecode()
+		if t, k := vm.tasks.current.engine.(*machine); k {
+			// Natives of tasks call back on the machine of the task.
+			m = t
+		}
+		prev := m.ctx
+		m.SetContext(ctx)
+		if vm.running == 0 {
+			m.quota = newQuota(vm.conf)
+		}
+		vm.running++
+		v, trace, err = m.call(fn, args)
+		vm.running--
+		m.SetContext(prev)
+	} else {
+		i := vm.interpreter()
+		if t, k := vm.tasks.current.engine.(*interpreter); k {
+			i = t
+		}
+		prev := i.ctx
+		i.SetContext(ctx)
+		if vm.running == 0 {
+			i.quota = newQuota(vm.conf)
+		}
+		vm.running++
+		v, trace, err = i.call(fn, args)
+		vm.running--
+		i.SetContext(prev)
+	}
+	if outer {
+		if err == nil {
+			err = vm.tasks.drain()
+		}
+		if err != nil && fatal(err) {
+			vm.tasks.reset()
+		}
+	}
+	if err == nil {
+		return v, nil
+	}
+	if err.Token.Line == 0 && err.Token.Type == 0 {
+		// The call itself is wrong, no script ran.
+		return Nil, fmt.Errorf("%s: %s", name, err.Message)
+	}
+	e := vm.report(ctx, err)
+	if _, k := e.(*Error); k {
+		e = &RuntimeError{err.Token.Line, err.Message, trace}
+	}
+	if vm.conf.hooks.OnError != nil {
+		vm.conf.hooks.OnError(e)
+	}
+	return Nil, e
+}
+
+// RuntimeError is an error of a script function called by the host.
+type RuntimeError struct {
+	Line    int
+	Message string
+	// Trace lists the functions that were running, innermost first.
+	Trace []Frame
+}
+
+func (e *RuntimeError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+// Frame is a function running when an error happened, and the line it was
+// at.
+type Frame struct {
+	Function string
+	Line     int
+	// Elided is the number of frames the function took the place of by
+	// tail calls, which the trace leaves out.
+	Elided int
+}
+
+// fatal tells if err ends a run rather than just the statement it happens in.
+// Depth isn't spent like the other quotas, so a stack overflow only ends its
+// statement.
+func fatal(err *Error) bool {
+	switch err.Token.Type {
+	case interrupted:
+		return true
+	case exhausted:
+		return err.Token.Literal != DepthLimit
+	}
+	return false
+}
+
+// uncatchable tells if err is an interruption or a quota error, which only
+// the host handles: promises don't turn them into rejections, and waiting on
+// a task failing with one fails with it too.
+func uncatchable(err *Error) bool {
+	return err.Token.Type == interrupted || err.Token.Type == exhausted
+}
+
+// fail reports err and returns it as an error.
+func (vm *VM) fail(ctx context.Context, err *Error) error {
+	e := vm.report(ctx, err)
+	if e != nil && vm.conf.hooks.OnError != nil {
+		vm.conf.hooks.OnError(e)
+	}
+	return e
+}
+
+// report writes err to stderr if the VM has one, and returns it as an error.
+func (vm *VM) report(ctx context.Context, err *Error) error {
+	if err == nil {
+		return nil
+	}
+	var e error = err
+	msg := err.Message
+	switch err.Token.Type {
+	case interrupted:
+		cause := ctx.Err()
+		if cause == nil {
+			// Something else stopped the run, like the clock failing.
+			cause, _ = err.Token.Literal.(error)
+		}
+		i := &Interrupted{err.Token.Line, cause}
+		e, msg = i, i.reason()
+	case exhausted:
+		e = &QuotaExceeded{err.Token.Line, err.Token.Literal.(Limit)}
+	}
+	if vm.conf.stderr != nil {
+		fmt.Fprintf(vm.conf.stderr, "at line %d: %s\n", err.Token.Line, msg)
+	}
+	return e
+}
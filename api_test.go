@@ -0,0 +1,198 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunTest(t *testing.T) {
+	p, diags := Compile([]byte(`
+var n = 1;
+fun add(k) { n = n + k; return n; }
+test "passes" {
+  var m = 2;
+  fun more() { return add(m); }
+  assertEqual(more(), 3);
+  return;
+  assert(false);
+}
+test "fails" {
+  add(1);
+  assertEqual(n, 3);
+}
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		vm := NewVM(Backend(e))
+		if err := vm.RunTest(context.Background(), p, "passes"); err != nil {
+			t.Errorf("%v: passes: %v", e, err)
+		}
+		if vm.ran != e {
+			t.Errorf("%v: test ran on %v", e, vm.ran)
+		}
+		err := NewVM(Backend(e)).RunTest(context.Background(), p, "fails")
+		if err == nil || !strings.Contains(err.Error(), "line 13: values are not equal") {
+			t.Errorf("%v: fails: %v", e, err)
+		}
+		if err := NewVM(Backend(e)).RunTest(context.Background(), p, "none"); err == nil {
+			t.Errorf("%v: ran a missing test", e)
+		}
+	}
+}
+
+func TestTraceTailCalls(t *testing.T) {
+	p, diags := Compile([]byte(`
+fun c(n) { return n / nil; }
+fun b(n) { return c(n); }
+fun a(n) { return b(n); }
+fun top(n) {
+  var v = a(n);
+  return v;
+}
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	want := []Frame{{"c", 2, 2}, {"top", 6, 0}}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		vm := NewVM(Backend(e))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		_, err := vm.Global("top").Call(context.Background(), 1)
+		var re *RuntimeError
+		if !errors.As(err, &re) {
+			t.Fatalf("%v: got %v", e, err)
+		}
+		if !reflect.DeepEqual(re.Trace, want) {
+			t.Errorf("%v: trace %v, want %v", e, re.Trace, want)
+		}
+	}
+}
+
+func TestGlobalCall(t *testing.T) {
+	p, diags := Compile([]byte(`
+fun describe(n, s, o) { return s + ": " + o.Name; }
+fun add(a, b) { return a + b; }
+fun inner(x) {
+  return x + 1;
+}
+fun outer(x) {
+  var r = inner(x);
+  return r;
+}
+var three = 3;
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	ctx := context.Background()
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		vm := NewVM(Backend(e))
+		if err := vm.Run(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+		v, err := vm.Global("describe").Call(ctx, 1, []byte("bytes"), &struct{ Name string }{"go"})
+		if err != nil || v.Interface() != "bytes: go" {
+			t.Errorf("%v: describe returned %v, %v", e, v.Interface(), err)
+		}
+		v, err = vm.Global("add").Call(ctx, uint8(2), 0.5)
+		if err != nil || v.Interface() != 2.5 {
+			t.Errorf("%v: add returned %v, %v", e, v.Interface(), err)
+		}
+
+		for _, c := range []struct {
+			name string
+			args []interface{}
+			want string
+		}{
+			{"add", []interface{}{1}, "add: expected 2 arguments but got 1"},
+			{"add", []interface{}{1, 2, 3}, "add: expected 2 arguments but got 3"},
+			{"add", []interface{}{1, make(chan int)}, "argument 2: can't use chan int in Lox"},
+			{"three", nil, "three: can only call functions and classes"},
+			{"nope", nil, "undefined variable 'nope'"},
+		} {
+			_, err := vm.Global(c.name).Call(ctx, c.args...)
+			var re *RuntimeError
+			if err == nil || err.Error() != c.want || errors.As(err, &re) {
+				t.Errorf("%v: %s%v: got %#v, want %q", e, c.name, c.args, err, c.want)
+			}
+		}
+
+		_, err = vm.Global("outer").Call(ctx, "s")
+		var re *RuntimeError
+		if !errors.As(err, &re) {
+			t.Fatalf("%v: got %v", e, err)
+		}
+		want := &RuntimeError{5, "both operands must be either strings or numbers", []Frame{{"inner", 5, 0}, {"outer", 8, 0}}}
+		if !reflect.DeepEqual(re, want) {
+			t.Errorf("%v: got %+v, want %+v", e, re, want)
+		}
+	}
+}
+
+// TestCancel checks that cancelling the context stops a run promptly, be it
+// spinning, waiting for a timer or with a task waiting on a channel.
+func TestCancel(t *testing.T) {
+	for _, c := range []struct {
+		name, src string
+		line      int
+		// loop is set when it's RunLoop that waits.
+		loop bool
+	}{
+		{"loop", `
+var n = 0;
+while (true) n = n + 1;
+`, 3, false},
+		{"timer", `
+fun later() { print "too late"; }
+setTimeout(later, 60000);
+`, 0, true},
+		{"receive", `
+var c = channel();
+fun send() { c.send(1); }
+fun recv() { print c.recv(); }
+spawn recv();
+setTimeout(send, 60000);
+`, 0, true},
+	} {
+		p, diags := Compile([]byte(c.src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		for _, e := range []Engine{TreeWalker, Bytecode} {
+			var out bytes.Buffer
+			vm := NewVM(Backend(e), Stdout(&out))
+			ctx, cancel := context.WithCancel(context.Background())
+			cancelled := make(chan time.Time, 1)
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				cancelled <- time.Now()
+				cancel()
+			}()
+			err := vm.Run(ctx, p)
+			if c.loop && err == nil {
+				err = vm.RunLoop(ctx)
+			}
+			stopped := time.Since(<-cancelled)
+			var i *Interrupted
+			if !errors.As(err, &i) || !errors.Is(err, context.Canceled) {
+				t.Errorf("%s on %v: got %v, want an interruption", c.name, e, err)
+				continue
+			}
+			if stopped > 200*time.Millisecond {
+				t.Errorf("%s on %v: stopped %v after the cancellation", c.name, e, stopped)
+			}
+			if i.Line != c.line || out.Len() > 0 {
+				t.Errorf("%s on %v: stopped at line %d, want %d, printed %q", c.name, e, i.Line, c.line, out.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,626 @@
+package lox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// The bridge lets scripts use Go values. ValueOf wraps them:
+//
+//   - booleans, numbers and strings become their Lox counterparts, and so
+//     do []byte, which are strings;
+//   - functions become callables converting their arguments and results, a
+//     last error result fails the call with its message and a first
+//     context.Context parameter gets the context of the run;
+//   - structs and pointers to them become objects whose exported fields
+//     and methods are properties; the `lox:"name"` tag renames a field and
+//     `lox:"-"` hides it;
+//   - slices, arrays and maps become objects with a len property and get
+//     and set methods, and maps also have has, delete and keys;
+//   - nil pointers, slices, maps and funcs become nil.
+//
+// Decode converts the other way.
+
+var (
+	valueType   = reflect.TypeOf(Value{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	contextType = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+// ValueOf converts a Go value for scripts. Functions taking a context.Context
+// first run while tasks go on, as they may block.
+func ValueOf(x interface{}) (Value, error) {
+	if v, k := x.(Value); k {
+		return v, nil
+	}
+	rv := reflect.ValueOf(x)
+	if rv.Kind() == reflect.Func && !rv.IsNil() && rv.Type().NumIn() > 0 && rv.Type().In(0) == contextType {
+		if err := checkResults(rv.Type()); err != nil {
+			return Nil, err
+		}
+		return ObjectValue(hostFunc{rv, true}), nil
+	}
+	return fromReflect(rv)
+}
+
+func fromReflect(rv reflect.Value) (Value, error) {
+	if !rv.IsValid() {
+		return Nil, nil
+	}
+	if rv.Type() == valueType {
+		return rv.Interface().(Value), nil
+	}
+	if rv.CanInterface() {
+		switch o := rv.Interface().(type) {
+		case callable, instance:
+			return ObjectValue(o), nil
+		}
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return BoolValue(rv.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NumberValue(float64(rv.Int())), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NumberValue(float64(rv.Uint())), nil
+	case reflect.Float32, reflect.Float64:
+		return NumberValue(rv.Float()), nil
+	case reflect.String:
+		return StringValue([]byte(rv.String())), nil
+	case reflect.Interface:
+		return fromReflect(rv.Elem())
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return Nil, nil
+		}
+		if rv.Elem().Kind() == reflect.Struct {
+			return ObjectValue(hostStruct{rv}), nil
+		}
+		return fromReflect(rv.Elem())
+	case reflect.Struct:
+		return ObjectValue(hostStruct{addressable(rv).Addr()}), nil
+	case reflect.Func:
+		if rv.IsNil() {
+			return Nil, nil
+		}
+		if err := checkResults(rv.Type()); err != nil {
+			return Nil, err
+		}
+		return ObjectValue(hostFunc{rv, false}), nil
+	case reflect.Slice:
+		if rv.IsNil() {
+			return Nil, nil
+		}
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			return StringValue(append([]byte{}, rv.Bytes()...)), nil
+		}
+		return ObjectValue(hostSlice{rv}), nil
+	case reflect.Array:
+		return ObjectValue(hostSlice{addressable(rv)}), nil
+	case reflect.Map:
+		if rv.IsNil() {
+			return Nil, nil
+		}
+		return ObjectValue(hostMap{rv}), nil
+	}
+	return Nil, fmt.Errorf("can't use %s in Lox", rv.Type())
+}
+
+// addressable returns an addressable copy of rv if it isn't one already, so
+// fields and elements of values passed by copy can be set.
+func addressable(rv reflect.Value) reflect.Value {
+	if rv.CanAddr() {
+		return rv
+	}
+	p := reflect.New(rv.Type())
+	p.Elem().Set(rv)
+	return p.Elem()
+}
+
+// checkResults tells if a function's results can be returned to scripts: at
+// most a value and an error.
+func checkResults(t reflect.Type) error {
+	n := t.NumOut()
+	if n > 0 && t.Out(n-1) == errorType {
+		n--
+	}
+	if n > 1 {
+		return fmt.Errorf("can't use %s in Lox: too many results", t)
+	}
+	return nil
+}
+
+// Interface returns v as a Go value: nil, a bool, a float64, a string, the Go
+// value wrapped by the bridge, or the callable of a function.
+func (v Value) Interface() interface{} {
+	switch v.kind {
+	case KindNil:
+		return nil
+	case KindBool:
+		return v.Bool()
+	case KindNumber:
+		return v.num
+	case KindString:
+		return string(v.Bytes())
+	}
+	switch o := v.ref.(type) {
+	case hostStruct:
+		return o.p.Interface()
+	case hostSlice:
+		return o.v.Interface()
+	case hostMap:
+		return o.v.Interface()
+	case hostFunc:
+		return o.fn.Interface()
+	}
+	return v.ref
+}
+
+// Decode stores v in the value ptr points to, converting it to its type.
+func (v Value) Decode(ptr interface{}) error {
+	rv := reflect.ValueOf(ptr)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("can't decode into a non-pointer")
+	}
+	out, err := convert(v, rv.Type().Elem())
+	if err != nil {
+		return err
+	}
+	rv.Elem().Set(out)
+	return nil
+}
+
+// typename names the type of v in conversion errors.
+func typename(v Value) string {
+	switch v.kind {
+	case KindNil:
+		return "nil"
+	case KindBool:
+		return "boolean"
+	case KindNumber:
+		return "number"
+	case KindString:
+		return "string"
+	}
+	switch o := v.ref.(type) {
+	case hostStruct:
+		return o.p.Type().String()
+	case hostSlice:
+		return o.v.Type().String()
+	case hostMap:
+		return o.v.Type().String()
+	case hostFunc:
+		return o.fn.Type().String()
+	case callable:
+		return "function"
+	}
+	return "object"
+}
+
+// convert converts v to a Go value of type t.
+func convert(v Value, t reflect.Type) (reflect.Value, error) {
+	fail := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("can't convert %s to %s", typename(v), t)
+	}
+	if t == valueType {
+		return reflect.ValueOf(v), nil
+	}
+	if v.kind == KindNil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map, reflect.Func:
+			return reflect.Zero(t), nil
+		}
+		return fail()
+	}
+	if t.Kind() == reflect.Interface {
+		x := v.Interface()
+		if !reflect.TypeOf(x).Implements(t) {
+			return fail()
+		}
+		out := reflect.New(t).Elem()
+		out.Set(reflect.ValueOf(x))
+		return out, nil
+	}
+	switch v.kind {
+	case KindBool:
+		if t.Kind() == reflect.Bool {
+			return reflect.ValueOf(v.Bool()).Convert(t), nil
+		}
+	case KindNumber:
+		return convertNumber(v.num, t)
+	case KindString:
+		switch {
+		case t.Kind() == reflect.String:
+			return reflect.ValueOf(string(v.Bytes())).Convert(t), nil
+		case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+			return reflect.ValueOf(append([]byte{}, v.Bytes()...)).Convert(t), nil
+		}
+	case KindObject:
+		var rv reflect.Value
+		switch o := v.ref.(type) {
+		case hostStruct:
+			rv = o.p
+			if t.Kind() == reflect.Struct {
+				rv = rv.Elem()
+			}
+		case hostSlice:
+			rv = o.v
+		case hostMap:
+			rv = o.v
+		case hostFunc:
+			rv = o.fn
+		default:
+			return fail()
+		}
+		if rv.Type().AssignableTo(t) {
+			return rv, nil
+		}
+	}
+	return fail()
+}
+
+func convertNumber(f float64, t reflect.Type) (reflect.Value, error) {
+	out := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		out.SetFloat(f)
+		return out, nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if f != math.Trunc(f) {
+			return out, fmt.Errorf("can't convert %v to %s", f, t)
+		}
+		if f < math.MinInt64 || f >= math.MaxInt64 || out.OverflowInt(int64(f)) {
+			return out, fmt.Errorf("%v overflows %s", f, t)
+		}
+		out.SetInt(int64(f))
+		return out, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if f != math.Trunc(f) {
+			return out, fmt.Errorf("can't convert %v to %s", f, t)
+		}
+		if f < 0 || f >= math.MaxUint64 || out.OverflowUint(uint64(f)) {
+			return out, fmt.Errorf("%v overflows %s", f, t)
+		}
+		out.SetUint(uint64(f))
+		return out, nil
+	}
+	return out, fmt.Errorf("can't convert number to %s", t)
+}
+
+// hostFunc is a Go function called from scripts. A first context.Context
+// parameter isn't an argument: it gets the context of the run.
+type hostFunc struct {
+	fn reflect.Value
+	// off is set for functions the host gave with a context, which run
+	// off the turn. Methods and fields of Go values stay on it.
+	off bool
+}
+
+// params returns the number of parameters of h taken from scripts, and how
+// many come before them.
+func (h hostFunc) params() (n, skip int) {
+	t := h.fn.Type()
+	if t.NumIn() > 0 && t.In(0) == contextType {
+		skip = 1
+	}
+	return t.NumIn() - skip, skip
+}
+
+func (h hostFunc) Call(ctx context.Context, i *interpreter, args []Value) (ret Value, err *Error) {
+	t := h.fn.Type()
+	n, skip := h.params()
+	if t.IsVariadic() && len(args) < n-1 {
+		return Nil, &Error{Token{}, fmt.Sprintf("expected at least %d arguments but got %d", n-1, len(args))}
+	}
+	in := make([]reflect.Value, skip, skip+len(args))
+	if skip > 0 {
+		in[0] = reflect.ValueOf(&ctx).Elem()
+	}
+	for k, a := range args {
+		var pt reflect.Type
+		if t.IsVariadic() && k >= n-1 {
+			pt = t.In(skip + n - 1).Elem()
+		} else {
+			pt = t.In(skip + k)
+		}
+		v, cerr := convert(a, pt)
+		if cerr != nil {
+			return Nil, &Error{Token{}, fmt.Sprintf("argument %d: %s", k+1, cerr)}
+		}
+		in = append(in, v)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			ret, err = Nil, &Error{Token{}, fmt.Sprintf("panic: %v", r)}
+		}
+	}()
+	out := h.fn.Call(in)
+	if len(out) > 0 && t.Out(len(out)-1) == errorType {
+		if e := out[len(out)-1]; !e.IsNil() {
+			gerr := e.Interface().(error)
+			if ctx.Err() != nil && errors.Is(gerr, ctx.Err()) {
+				// The function gave up because the run is cancelled.
+				return Nil, &Error{Token{Type: interrupted}, gerr.Error()}
+			}
+			var q *QuotaExceeded
+			if errors.As(gerr, &q) {
+				// A call back into the VM went over a quota of the run.
+				return Nil, exceeded(q.Limit, 0)
+			}
+			return Nil, &Error{Token{}, gerr.Error()}
+		}
+		out = out[:len(out)-1]
+	}
+	if len(out) == 0 {
+		return Nil, nil
+	}
+	v, cerr := fromReflect(out[0])
+	if cerr != nil {
+		return Nil, &Error{Token{}, cerr.Error()}
+	}
+	return v, nil
+}
+
+func (h hostFunc) Arity() int {
+	if h.fn.Type().IsVariadic() {
+		return -1
+	}
+	n, _ := h.params()
+	return n
+}
+
+func (h hostFunc) String() string {
+	return "<native fn>"
+}
+
+// hostStruct is a pointer to a Go struct used from scripts.
+type hostStruct struct {
+	p reflect.Value
+}
+
+// field finds the exported field called name in scripts.
+func (h hostStruct) field(name string) (reflect.Value, bool) {
+	s := h.p.Elem()
+	t := s.Type()
+	for k := 0; k < t.NumField(); k++ {
+		f := t.Field(k)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := f.Tag.Get("lox")
+		if tag == name || tag == "" && f.Name == name {
+			return s.Field(k), true
+		}
+	}
+	// Fields promoted from embedded structs.
+	f, k := t.FieldByName(name)
+	if !k || f.PkgPath != "" || f.Tag.Get("lox") != "" || len(f.Index) < 2 {
+		return reflect.Value{}, false
+	}
+	v := s
+	for _, i := range f.Index {
+		if v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+	return v, true
+}
+
+func (h hostStruct) Get(name string) (Value, *Error) {
+	if f, k := h.field(name); k {
+		v, err := fromReflect(f)
+		if err != nil {
+			return Nil, &Error{Token{}, err.Error()}
+		}
+		return v, nil
+	}
+	if m := h.p.MethodByName(name); m.IsValid() {
+		if err := checkResults(m.Type()); err != nil {
+			return Nil, &Error{Token{}, err.Error()}
+		}
+		return ObjectValue(hostFunc{m, false}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("%s has no property '%s'", h.p.Elem().Type(), name)}
+}
+
+func (h hostStruct) Set(name string, v Value) *Error {
+	f, k := h.field(name)
+	if !k {
+		return &Error{Token{}, fmt.Sprintf("%s has no field '%s'", h.p.Elem().Type(), name)}
+	}
+	out, err := convert(v, f.Type())
+	if err != nil {
+		return &Error{Token{}, fmt.Sprintf("can't set %s: %s", name, err)}
+	}
+	f.Set(out)
+	return nil
+}
+
+func (h hostStruct) String() string {
+	if s, k := h.p.Interface().(fmt.Stringer); k {
+		return s.String()
+	}
+	// Not fmt.Sprint, which would show hidden fields.
+	return "<" + h.p.Elem().Type().String() + ">"
+}
+
+// hostSlice is a Go slice or addressable array used from scripts.
+type hostSlice struct {
+	v reflect.Value
+}
+
+func (h hostSlice) index(v Value) (int, *Error) {
+	var i int
+	if err := v.Decode(&i); err != nil {
+		return 0, &Error{Token{}, "index: " + err.Error()}
+	}
+	if i < 0 || i >= h.v.Len() {
+		return 0, &Error{Token{}, fmt.Sprintf("index %d out of range [0:%d]", i, h.v.Len())}
+	}
+	return i, nil
+}
+
+func (h hostSlice) Get(name string) (Value, *Error) {
+	switch name {
+	case "len":
+		return NumberValue(float64(h.v.Len())), nil
+	case "get":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			i, err := h.index(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			v, verr := fromReflect(h.v.Index(i))
+			if verr != nil {
+				return Nil, &Error{Token{}, verr.Error()}
+			}
+			return v, nil
+		}}), nil
+	case "set":
+		return ObjectValue(&builtin{2, func(args []Value) (Value, *Error) {
+			i, err := h.index(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			out, cerr := convert(args[1], h.v.Type().Elem())
+			if cerr != nil {
+				return Nil, &Error{Token{}, cerr.Error()}
+			}
+			h.v.Index(i).Set(out)
+			return args[1], nil
+		}}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("%s has no property '%s'", h.v.Type(), name)}
+}
+
+func (h hostSlice) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of %s", name, h.v.Type())}
+}
+
+func (h hostSlice) String() string {
+	return fmt.Sprint(h.v.Interface())
+}
+
+// hostMap is a Go map used from scripts.
+type hostMap struct {
+	v reflect.Value
+}
+
+func (h hostMap) key(v Value) (reflect.Value, *Error) {
+	k, err := convert(v, h.v.Type().Key())
+	if err != nil {
+		return k, &Error{Token{}, "key: " + err.Error()}
+	}
+	return k, nil
+}
+
+func (h hostMap) Get(name string) (Value, *Error) {
+	switch name {
+	case "len":
+		return NumberValue(float64(h.v.Len())), nil
+	case "get":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			k, err := h.key(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			v, verr := fromReflect(h.v.MapIndex(k))
+			if verr != nil {
+				return Nil, &Error{Token{}, verr.Error()}
+			}
+			return v, nil
+		}}), nil
+	case "has":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			k, err := h.key(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			return BoolValue(h.v.MapIndex(k).IsValid()), nil
+		}}), nil
+	case "set":
+		return ObjectValue(&builtin{2, func(args []Value) (Value, *Error) {
+			k, err := h.key(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			out, cerr := convert(args[1], h.v.Type().Elem())
+			if cerr != nil {
+				return Nil, &Error{Token{}, cerr.Error()}
+			}
+			h.v.SetMapIndex(k, out)
+			return args[1], nil
+		}}), nil
+	case "delete":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			k, err := h.key(args[0])
+			if err != nil {
+				return Nil, err
+			}
+			h.v.SetMapIndex(k, reflect.Value{})
+			return Nil, nil
+		}}), nil
+	case "keys":
+		return ObjectValue(&builtin{0, func(args []Value) (Value, *Error) {
+			keys := h.v.MapKeys()
+			sort.Slice(keys, func(i, j int) bool { return lesskey(keys[i], keys[j]) })
+			s := reflect.MakeSlice(reflect.SliceOf(h.v.Type().Key()), len(keys), len(keys))
+			for i, k := range keys {
+				s.Index(i).Set(k)
+			}
+			return ObjectValue(hostSlice{s}), nil
+		}}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("%s has no property '%s'", h.v.Type(), name)}
+}
+
+// lesskey orders map keys of basic types, so keys come in a stable order.
+func lesskey(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.String:
+		return a.String() < b.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return a.Int() < b.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return a.Uint() < b.Uint()
+	case reflect.Float32, reflect.Float64:
+		return a.Float() < b.Float()
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b)) < 0
+}
+
+func (h hostMap) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of %s", name, h.v.Type())}
+}
+
+func (h hostMap) String() string {
+	return fmt.Sprint(h.v.Interface())
+}
+
+// builtin is a method of a bridged slice or map.
+type builtin struct {
+	arity int
+	fn    func(args []Value) (Value, *Error)
+}
+
+func (b *builtin) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	return b.fn(args)
+}
+
+func (b *builtin) Arity() int {
+	return b.arity
+}
+
+func (b *builtin) String() string {
+	return "<native fn>"
+}
@@ -0,0 +1,190 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type bridgeInner struct {
+	X, Y int
+}
+
+type bridgeBase struct {
+	ID string
+}
+
+type bridgeOuter struct {
+	bridgeBase
+	Name   string `lox:"name"`
+	Secret string `lox:"-"`
+	Inner  bridgeInner
+	Ptr    *bridgeInner
+	Tags   []string
+	Counts map[int]string
+}
+
+func (o *bridgeOuter) Rename(name string) string {
+	old := o.Name
+	o.Name = name
+	return old
+}
+
+func TestBridgeRoundTrip(t *testing.T) {
+	outer := &bridgeOuter{bridgeBase{"id"}, "n", "s", bridgeInner{1, 2}, &bridgeInner{3, 4}, []string{"a"}, map[int]string{1: "one"}}
+	for _, x := range []interface{}{
+		true, int8(-3), uint16(7), 0.25, float32(1.5), "str", []byte("bytes"),
+		[]int{1, 2}, [2]string{"a", "b"}, map[int]string{1: "a", 2: "b"},
+		map[float64]bool{0.5: true}, bridgeInner{5, 6}, &bridgeInner{7, 8}, outer, *outer,
+	} {
+		v, err := ValueOf(x)
+		if err != nil {
+			t.Errorf("ValueOf(%#v): %v", x, err)
+			continue
+		}
+		out := reflect.New(reflect.TypeOf(x))
+		if err := v.Decode(out.Interface()); err != nil {
+			t.Errorf("Decode(%#v): %v", x, err)
+			continue
+		}
+		if !reflect.DeepEqual(out.Elem().Interface(), x) {
+			t.Errorf("%#v came back as %#v", x, out.Elem().Interface())
+		}
+	}
+	// Pointers stay the same value, so changes are seen on both sides.
+	v, _ := ValueOf(outer)
+	var back *bridgeOuter
+	if err := v.Decode(&back); err != nil || back != outer {
+		t.Errorf("pointer came back as %p, %v, want %p", back, err, outer)
+	}
+}
+
+func TestBridgeConversionErrors(t *testing.T) {
+	str, _ := ValueOf("s")
+	obj, _ := ValueOf(&bridgeInner{})
+	for _, c := range []struct {
+		v    Value
+		into interface{}
+		want string
+	}{
+		{NumberValue(1.5), new(int), "can't convert 1.5 to int"},
+		{NumberValue(300), new(uint8), "300 overflows uint8"},
+		{NumberValue(-1), new(uint), "-1 overflows uint"},
+		{NumberValue(1e19), new(int64), "1e+19 overflows int64"},
+		{str, new(int), "can't convert string to int"},
+		{Nil, new(string), "can't convert nil to string"},
+		{BoolValue(true), new(string), "can't convert boolean to string"},
+		{NumberValue(1), new(bool), "can't convert number to bool"},
+		{obj, new(bridgeOuter), "can't convert *lox.bridgeInner to lox.bridgeOuter"},
+		{obj, new(fmt.Stringer), "can't convert *lox.bridgeInner to fmt.Stringer"},
+		{str, new(map[string]int), "can't convert string to map[string]int"},
+		{NumberValue(1), 0, "can't decode into a non-pointer"},
+	} {
+		err := c.v.Decode(c.into)
+		if err == nil || err.Error() != c.want {
+			t.Errorf("decoding %v into %T: got %v, want %q", c.v.Interface(), c.into, err, c.want)
+		}
+	}
+	for _, c := range []struct {
+		x    interface{}
+		want string
+	}{
+		{make(chan int), "can't use chan int in Lox"},
+		{func() (int, int, error) { return 0, 0, nil }, "can't use func() (int, int, error) in Lox: too many results"},
+		{func(context.Context) (int, int) { return 0, 0 }, "can't use func(context.Context) (int, int) in Lox: too many results"},
+	} {
+		if _, err := ValueOf(c.x); err == nil || err.Error() != c.want {
+			t.Errorf("ValueOf(%T): got %v, want %q", c.x, err, c.want)
+		}
+	}
+}
+
+func TestBridgeScripts(t *testing.T) {
+	const src = `
+print o.name + o.ID;
+print o.Inner.X + o.Ptr.Y;
+o.Inner.X = 10;
+o.Ptr.Y = 40;
+o.Tags.set(0, "b");
+print o.Rename("m");
+print o.Counts.get(1);
+o.Counts.set(2, "two");
+var keys = o.Counts.keys();
+print keys.len;
+print keys.get(1);
+print o.Counts.has(3);
+o.Counts.delete(1);
+print sum() + sum(1, 2, 3);
+print join("-", "a", "b");
+print div(6, 3);
+`
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		o := &bridgeOuter{bridgeBase{"1"}, "n", "s", bridgeInner{1, 2}, &bridgeInner{3, 4}, []string{"a"}, map[int]string{1: "one"}}
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), Stdout(&out))
+		defs := map[string]interface{}{
+			"o": o,
+			"sum": func(ns ...int) int {
+				s := 0
+				for _, n := range ns {
+					s += n
+				}
+				return s
+			},
+			"join": func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+			"div": func(a, b float64) (float64, error) {
+				if b == 0 {
+					return 0, errors.New("division by zero")
+				}
+				return a / b, nil
+			},
+			"boom": func() { panic("boom") },
+		}
+		for name, x := range defs {
+			if err := vm.Define(name, x); err != nil {
+				t.Fatal(err)
+			}
+		}
+		p, diags := Compile([]byte(src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatalf("%v: %v", e, err)
+		}
+		if want := "n1\n5\nn\none\n2\n2\nfalse\n6\na-b\n2\n"; out.String() != want {
+			t.Errorf("%v: printed %q, want %q", e, out.String(), want)
+		}
+		want := &bridgeOuter{bridgeBase{"1"}, "m", "s", bridgeInner{10, 2}, &bridgeInner{3, 40}, []string{"b"}, map[int]string{2: "two"}}
+		if !reflect.DeepEqual(o, want) {
+			t.Errorf("%v: left %+v, want %+v", e, o, want)
+		}
+
+		for _, c := range []struct{ src, want string }{
+			{"div(1, 0);", "division by zero"},
+			{"boom();", "panic: boom"},
+			{"join();", "expected at least 1 arguments but got 0"},
+			{`sum(1, "2");`, "argument 2: can't convert string to int"},
+			{"div(1);", "expected 2 arguments but got 1"},
+			{`o.Counts.get("1");`, "key: can't convert string to int"},
+			{"o.Tags.get(1);", "index 1 out of range [0:1]"},
+			{`o.Inner.X = "x";`, "can't set X: can't convert string to int"},
+			{"o.Secret;", "lox.bridgeOuter has no property 'Secret'"},
+			{"o.Nope = 1;", "lox.bridgeOuter has no field 'Nope'"},
+		} {
+			p, diags := Compile([]byte(c.src))
+			if diags != nil {
+				t.Fatal(diags)
+			}
+			err := vm.Run(context.Background(), p)
+			var le *Error
+			if !errors.As(err, &le) || le.Message != c.want {
+				t.Errorf("%v: %s: got %v, want %q", e, c.src, err, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package lox
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Capabilities are what scripts may reach outside the VM. Natives needing a
+// capability that isn't granted aren't defined. The zero value grants
+// nothing.
+type Capabilities struct {
+	clock clockMode
+	// frozen is the time of a frozen clock, zero for the time the VM is made.
+	frozen float64
+	// read and write are the directories files may be read from and written
+	// to, with symlinks resolved.
+	read  []string
+	write []string
+}
+
+type clockMode int
+
+const (
+	clockNone clockMode = iota
+	clockReal
+	clockFrozen
+)
+
+// ParseCapabilities grants the capabilities described by specs, each of
+// them domain[:grant[=arg]]:
+//
+//	time, time:real      clock() tells the time
+//	time:frozen[=secs]   clock() always tells when the VM was made, or secs
+//	time:none            no clock()
+//	fs:read=dir          readFile(path) reads files under dir
+//	fs:write=dir         writeFile(path, s) writes files under dir
+//	fs:none              no file access
+//	net:none, proc:none  no network or processes, the only option for now
+//
+// Later specs take precedence, so "fs:none" revokes the fs grants before it.
+func ParseCapabilities(specs ...string) (Capabilities, error) {
+	var c Capabilities
+	for _, spec := range specs {
+		domain, grant := spec, ""
+		if i := strings.IndexByte(spec, ':'); i >= 0 {
+			domain, grant = spec[:i], spec[i+1:]
+		}
+		arg := ""
+		if i := strings.IndexByte(grant, '='); i >= 0 {
+			grant, arg = grant[:i], grant[i+1:]
+		}
+		var err error
+		switch domain + ":" + grant {
+		case "time:", "time:real":
+			c.clock, c.frozen = clockReal, 0
+		case "time:frozen":
+			c.clock, c.frozen = clockFrozen, 0
+			if arg != "" {
+				c.frozen, err = strconv.ParseFloat(arg, 64)
+			}
+			arg = ""
+		case "time:none":
+			c.clock = clockNone
+		case "fs:read":
+			c.read, err = grantdir(c.read, arg)
+			arg = ""
+		case "fs:write":
+			c.write, err = grantdir(c.write, arg)
+			arg = ""
+		case "fs:none":
+			c.read, c.write = nil, nil
+		case "net:none", "proc:none":
+		default:
+			return Capabilities{}, fmt.Errorf("unknown capability %q", spec)
+		}
+		if err == nil && arg != "" {
+			err = fmt.Errorf("unexpected %q", arg)
+		}
+		if err != nil {
+			return Capabilities{}, fmt.Errorf("capability %q: %w", spec, err)
+		}
+	}
+	return c, nil
+}
+
+func grantdir(dirs []string, dir string) ([]string, error) {
+	if dir == "" {
+		return nil, fmt.Errorf("no directory")
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(real); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("%s isn't a directory", dir)
+	}
+	return append(dirs, real), nil
+}
+
+// realpath makes path absolute and resolves its symlinks. A file that doesn't
+// exist yet gets the real path of its directory.
+func realpath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	real, err := filepath.EvalSymlinks(abs)
+	if os.IsNotExist(err) {
+		dir, derr := filepath.EvalSymlinks(filepath.Dir(abs))
+		if derr != nil {
+			return "", err
+		}
+		return filepath.Join(dir, filepath.Base(abs)), nil
+	}
+	return real, err
+}
+
+// confine returns the real path of path if it's under one of dirs.
+func confine(path string, dirs []string) (string, *Error) {
+	real, err := realpath(path)
+	if err != nil {
+		return "", &Error{Token{}, err.Error()}
+	}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(dir, real)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return real, nil
+		}
+	}
+	return "", denied(path)
+}
+
+func denied(path string) *Error {
+	return &Error{Token{}, fmt.Sprintf("permission denied: %s", path)}
+}
+
+// openConfined opens path under one of dirs, for reading or writing. Its last
+// element can't be a symlink, which could lead out of dirs even when it
+// dangles. Once open, the file is checked to be the one confine found, so
+// nothing swapped in meanwhile is written to: new files are created with
+// O_EXCL, and old ones truncated only then.
+func openConfined(path string, dirs []string, write bool) (*os.File, *Error) {
+	real, err := confine(path, dirs)
+	if err != nil {
+		return nil, err
+	}
+	flag := os.O_RDONLY
+	fi, lerr := os.Lstat(real)
+	switch {
+	case lerr == nil && fi.Mode()&os.ModeSymlink != 0:
+		return nil, denied(path)
+	case write && os.IsNotExist(lerr):
+		flag = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	case write:
+		flag = os.O_WRONLY
+	}
+	f, oerr := os.OpenFile(real, flag, 0666)
+	if oerr != nil {
+		return nil, &Error{Token{}, oerr.Error()}
+	}
+	again, err := confine(real, dirs)
+	ofi, serr := f.Stat()
+	lfi, lerr := os.Lstat(real)
+	if err != nil || again != real || serr != nil || lerr != nil || !os.SameFile(ofi, lfi) {
+		f.Close()
+		return nil, denied(path)
+	}
+	if flag == os.O_WRONLY {
+		if terr := f.Truncate(0); terr != nil {
+			f.Close()
+			return nil, &Error{Token{}, terr.Error()}
+		}
+	}
+	return f, nil
+}
+
+// natives returns the natives c grants, for a VM made at now whose tasks s
+// has.
+func (c Capabilities) natives(now time.Time, s *scheduler) map[string]callable {
+	m := make(map[string]callable)
+	switch c.clock {
+	case clockReal:
+		m["clock"] = &nf_clock{}
+	case clockFrozen:
+		t := c.frozen
+		if t == 0 {
+			t = float64(now.UnixNano()) / 1e9
+		}
+		m["clock"] = &nf_frozenClock{t}
+	}
+	if c.read != nil {
+		m["readFile"] = &nf_readFile{c.read, s}
+	}
+	if c.write != nil {
+		m["writeFile"] = &nf_writeFile{c.write}
+	}
+	return m
+}
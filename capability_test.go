@@ -0,0 +1,107 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestConfinedSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	sb, out := filepath.Join(dir, "sb"), filepath.Join(dir, "out")
+	for _, d := range []string{sb, out} {
+		if err := os.Mkdir(d, 0777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(out, "secret"), []byte("secret"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(sb, "real"), []byte("real"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	for link, to := range map[string]string{
+		"dangling": "../out/pwned",
+		"secret":   "../out/secret",
+		"good":     "real",
+	} {
+		if err := os.Symlink(to, filepath.Join(sb, link)); err != nil {
+			t.Skip(err)
+		}
+	}
+	caps, err := ParseCapabilities("fs:read="+sb, "fs:write="+sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := func(name string) string { return strconv.Quote(filepath.Join(sb, name)) }
+	src := `
+writeFile(` + path("dangling") + `, "x");
+writeFile(` + path("secret") + `, "x");
+print readFile(` + path("secret") + `);
+writeFile(` + path("good") + `, "good");
+print readFile(` + path("real") + `);
+writeFile(` + path("new") + `, "longer");
+writeFile(` + path("new") + `, "new");
+print readFile(` + path("new") + `);
+`
+	want := []string{
+		"at line 2: permission denied: " + filepath.Join(sb, "dangling"),
+		"at line 3: permission denied: " + filepath.Join(sb, "secret"),
+		"at line 4: permission denied: " + filepath.Join(sb, "secret"),
+		"good",
+		"new",
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		p, diags := Compile([]byte(src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		var buf bytes.Buffer
+		NewVM(Backend(e), Allow(caps), Stdout(&buf), Stderr(&buf)).Run(context.Background(), p)
+		if got := strings.TrimSpace(buf.String()); got != strings.Join(want, "\n") {
+			t.Errorf("%v: got\n%s\nwant\n%s", e, got, strings.Join(want, "\n"))
+		}
+		if _, err := os.Lstat(filepath.Join(out, "pwned")); !os.IsNotExist(err) {
+			t.Errorf("%v: wrote through a dangling symlink", e)
+		}
+		os.Remove(filepath.Join(sb, "new"))
+	}
+}
+
+func TestReadFileQuota(t *testing.T) {
+	dir := t.TempDir()
+	big := filepath.Join(dir, "big")
+	if err := ioutil.WriteFile(big, bytes.Repeat([]byte("x"), 1<<16), 0666); err != nil {
+		t.Fatal(err)
+	}
+	caps, err := ParseCapabilities("fs:read=" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, diags := Compile([]byte(`
+var s = readFile(` + strconv.Quote(big) + `);
+print "read";
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		err := NewVM(Backend(e), Allow(caps), MaxMemory(1<<15), Stdout(&out)).Run(context.Background(), p)
+		var q *QuotaExceeded
+		if !errors.As(err, &q) || *q != (QuotaExceeded{2, MemoryLimit}) || out.Len() > 0 {
+			t.Errorf("%v: got %v, printed %q, want the memory limit", e, err, out.String())
+		}
+		out.Reset()
+		err = NewVM(Backend(e), Allow(caps), MaxMemory(1<<17), Stdout(&out)).Run(context.Background(), p)
+		if err != nil || out.String() != "read\n" {
+			t.Errorf("%v: got %v, printed %q", e, err, out.String())
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package lox
+
+import "sort"
+
+// Opcodes of the bytecode VM. Operands follow the opcode: constant and global
+// name indexes and jump offsets take two bytes, everything else one.
+const (
+	opConstant = iota
+	opNil
+	opTrue
+	opFalse
+	opPop
+	opGetLocal
+	opSetLocal
+	opGetGlobal
+	opDefineGlobal
+	opSetGlobal
+	opGetUpvalue
+	opSetUpvalue
+	opEqual
+	opNotEqual
+	opGreater
+	opGreaterEqual
+	opLess
+	opLessEqual
+	opAdd
+	opSubtract
+	opMultiply
+	opDivide
+	opNot
+	opNegate
+	opPrint
+	opJump
+	opJumpIfFalse
+	opLoop
+	opCall
+	opTailCall
+	opClosure
+	opCloseUpvalue
+	opReturn
+	opGetProperty
+	opSetProperty
+	opSpawn
+	opSelect
+	opYield
+)
+
+var opnames = [...]string{
+	opConstant:     "CONSTANT",
+	opNil:          "NIL",
+	opTrue:         "TRUE",
+	opFalse:        "FALSE",
+	opPop:          "POP",
+	opGetLocal:     "GET_LOCAL",
+	opSetLocal:     "SET_LOCAL",
+	opGetGlobal:    "GET_GLOBAL",
+	opDefineGlobal: "DEFINE_GLOBAL",
+	opSetGlobal:    "SET_GLOBAL",
+	opGetUpvalue:   "GET_UPVALUE",
+	opSetUpvalue:   "SET_UPVALUE",
+	opEqual:        "EQUAL",
+	opNotEqual:     "NOT_EQUAL",
+	opGreater:      "GREATER",
+	opGreaterEqual: "GREATER_EQUAL",
+	opLess:         "LESS",
+	opLessEqual:    "LESS_EQUAL",
+	opAdd:          "ADD",
+	opSubtract:     "SUBTRACT",
+	opMultiply:     "MULTIPLY",
+	opDivide:       "DIVIDE",
+	opNot:          "NOT",
+	opNegate:       "NEGATE",
+	opPrint:        "PRINT",
+	opJump:         "JUMP",
+	opJumpIfFalse:  "JUMP_IF_FALSE",
+	opLoop:         "LOOP",
+	opCall:         "CALL",
+	opTailCall:     "TAIL_CALL",
+	opClosure:      "CLOSURE",
+	opCloseUpvalue: "CLOSE_UPVALUE",
+	opReturn:       "RETURN",
+	opGetProperty:  "GET_PROPERTY",
+	opSetProperty:  "SET_PROPERTY",
+	opSpawn:        "SPAWN",
+	opSelect:       "SELECT",
+	opYield:        "YIELD",
+}
+
+// operands returns the number of operand bytes following op.
+func operands(op byte) int {
+	switch op {
+	case opConstant, opGetGlobal, opDefineGlobal, opSetGlobal, opClosure, opJump, opJumpIfFalse, opLoop, opGetProperty, opSetProperty:
+		return 2
+	case opGetLocal, opSetLocal, opGetUpvalue, opSetUpvalue, opCall, opTailCall, opSpawn, opSelect:
+		return 1
+	}
+	return 0
+}
+
+// chunk is a piece of bytecode with its constant pool.
+type chunk struct {
+	Code []byte
+	// Lines has the source line of every byte in Code.
+	Lines  []int
+	Consts []Value
+	// caches has an inline cache for each constant used as a global name.
+	caches []globalCache
+	// stmts are where statements start, in order, for hooks.
+	stmts []stmtStart
+}
+
+type stmtStart struct {
+	ip   int
+	line int
+	kind byte
+	// locals are the names of the locals in scope, by slot from 1 on.
+	locals []string
+}
+
+// statements returns those starting at ip.
+func (c *chunk) statements(ip int) []stmtStart {
+	k := sort.Search(len(c.stmts), func(k int) bool { return c.stmts[k].ip >= ip })
+	n := k
+	for n < len(c.stmts) && c.stmts[n].ip == ip {
+		n++
+	}
+	return c.stmts[k:n]
+}
+
+func (c *chunk) write(b byte, line int) {
+	c.Code = append(c.Code, b)
+	c.Lines = append(c.Lines, line)
+}
+
+// proto is a compiled function. Closures are made out of it at runtime.
+type proto struct {
+	Name string
+	// Declares is the global a script declares. It's defined as nil if the
+	// script fails, as interpreter does.
+	Declares string
+	Arity    int
+	// Generator is set for functions that yield.
+	Generator bool
+	// Upvalues describes where the closure captures each upvalue from:
+	// a local slot of the enclosing function or one of its upvalues.
+	Upvalues []upvalueRef
+	Chunk    chunk
+	// Locals are names of locals visible in the function, for error messages.
+	Locals []string
+}
+
+type upvalueRef struct {
+	Local bool
+	Index byte
+	// Name is the name of the variable, for hooks.
+	Name string
+}
+
+func (p *proto) String() string {
+	if p.Name == "" {
+		return "<script>"
+	}
+	return "<fn " + p.Name + ">"
+}
+
+// closure is a function value of the VM.
+type closure struct {
+	proto    *proto
+	upvalues []*upvalue
+}
+
+func (c *closure) String() string {
+	return c.proto.String()
+}
+
+// upvalue is a variable captured by a closure. While the variable is still on
+// the stack of its machine, the upvalue refers to its slot there; after that
+// it holds the value.
+type upvalue struct {
+	slot int
+	// machine is the one with the variable on its stack, nil once closed.
+	// Tasks run on machines of their own.
+	machine *machine
+	closed  Value
+}
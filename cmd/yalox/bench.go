@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"private/lox"
+)
+
+// A benchmark is a global function without parameters whose name starts with
+// "bench". Top-level statements of its file run once before the benchmarks.
+
+// benchResult is the outcome of one benchmark, as saved in baseline files.
+type benchResult struct {
+	Name   string  `json:"name"`
+	Runs   int     `json:"runs"`
+	Mean   float64 `json:"mean_ns"`
+	Stddev float64 `json:"stddev_ns"`
+	Allocs float64 `json:"allocs_per_op"`
+	Bytes  float64 `json:"bytes_per_op"`
+}
+
+type benchBaseline struct {
+	Backend    string        `json:"backend"`
+	Benchmarks []benchResult `json:"benchmarks"`
+}
+
+// runbench runs benchmarks for `yalox bench` and reports whether they all ran
+// without errors or regressions.
+func runbench(args []string) bool {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	count := fs.Int("count", 10, "measured runs of each benchmark")
+	warmup := fs.Int("warmup", 2, "unmeasured runs before the measured ones")
+	baseline := fs.String("baseline", "", "compare against results saved in `file`")
+	save := fs.String("save", "", "save results as a baseline to `file`")
+	threshold := fs.Float64("threshold", 5, "slowdown in `percent` to report as a regression")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: yalox [-backend=tree|vm] bench [flags] [path...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *count < 2 {
+		fmt.Fprintln(os.Stderr, "need at least 2 runs")
+		return false
+	}
+
+	var base *benchBaseline
+	if *baseline != "" {
+		bs, err := ioutil.ReadFile(*baseline)
+		if err == nil {
+			base = &benchBaseline{}
+			err = json.Unmarshal(bs, base)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+		if base.Backend != *backend {
+			fmt.Fprintf(os.Stderr, "warning: baseline is for the %s backend, running on %s\n", base.Backend, *backend)
+		}
+	}
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		paths = []string{"bench"}
+	}
+	files, err := findbenches(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+
+	ok := true
+	results := &benchBaseline{Backend: *backend}
+	for _, f := range files {
+		rs, fok := runbenchfile(f, *warmup, *count)
+		ok = ok && fok
+		for _, r := range rs {
+			line := fmt.Sprintf("%-36s %3d runs %10s ± %-9s %10.0f allocs/op %12.0f B/op",
+				r.Name, r.Runs, duration(r.Mean), duration(r.Stddev), r.Allocs, r.Bytes)
+			if base != nil {
+				cmp, regressed := compare(base, r, *threshold)
+				line += "   " + cmp
+				ok = ok && !regressed
+			}
+			fmt.Println(line)
+			results.Benchmarks = append(results.Benchmarks, r)
+		}
+	}
+
+	if *save != "" {
+		bs, _ := json.MarshalIndent(results, "", "  ")
+		if err := ioutil.WriteFile(*save, append(bs, '\n'), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return false
+		}
+	}
+	return ok
+}
+
+func findbenches(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(path, ".lox") {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// runbenchfile runs the benchmarks of a file on the backend chosen by flags.
+func runbenchfile(path string, warmup, count int) ([]benchResult, bool) {
+	p, ok := compilefile(path)
+	if !ok {
+		return nil, false
+	}
+	ctx := context.Background()
+	vm := lox.NewVM(options()...)
+	if err := vm.Run(ctx, p); err != nil {
+		reporterr(path, err)
+		return nil, false
+	}
+
+	var results []benchResult
+	for _, f := range p.Functions() {
+		if !strings.HasPrefix(f.Name, "bench") || len(f.Params) > 0 {
+			continue
+		}
+		call, _ := lox.Compile([]byte(f.Name+"();"), options()...)
+		r, err := measure(func() error { return vm.Run(ctx, call) }, warmup, count)
+		if err != nil {
+			reporterr(path, err)
+			return results, false
+		}
+		r.Name = strings.TrimSuffix(filepath.Base(path), ".lox") + ":" + f.Name
+		results = append(results, r)
+	}
+	if len(results) == 0 {
+		fmt.Fprintf(os.Stderr, "%s: no benchmarks\n", path)
+	}
+	return results, true
+}
+
+// measure times count runs after warmup ones. The heap is collected before
+// each run, so runs don't pay for the garbage of others.
+func measure(run func() error, warmup, count int) (benchResult, error) {
+	for n := 0; n < warmup; n++ {
+		if err := run(); err != nil {
+			return benchResult{}, err
+		}
+	}
+	times := make([]float64, count)
+	var allocs, bytes uint64
+	var before, after runtime.MemStats
+	for n := range times {
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		start := time.Now()
+		err := run()
+		times[n] = float64(time.Since(start))
+		runtime.ReadMemStats(&after)
+		if err != nil {
+			return benchResult{}, err
+		}
+		allocs += after.Mallocs - before.Mallocs
+		bytes += after.TotalAlloc - before.TotalAlloc
+	}
+
+	r := benchResult{Runs: count}
+	for _, t := range times {
+		r.Mean += t
+	}
+	r.Mean /= float64(count)
+	for _, t := range times {
+		r.Stddev += (t - r.Mean) * (t - r.Mean)
+	}
+	r.Stddev = math.Sqrt(r.Stddev / float64(count-1))
+	r.Allocs = float64(allocs) / float64(count)
+	r.Bytes = float64(bytes) / float64(count)
+	return r, nil
+}
+
+// compare describes the change of r against its baseline. A slowdown is a
+// regression if it's over threshold percent and the difference of the means
+// is significant: more than twice its standard error.
+func compare(base *benchBaseline, r benchResult, threshold float64) (string, bool) {
+	var old *benchResult
+	for n := range base.Benchmarks {
+		if base.Benchmarks[n].Name == r.Name {
+			old = &base.Benchmarks[n]
+		}
+	}
+	if old == nil {
+		return "new", false
+	}
+	delta := (r.Mean - old.Mean) / old.Mean * 100
+	se := math.Sqrt(old.Stddev*old.Stddev/float64(old.Runs) + r.Stddev*r.Stddev/float64(r.Runs))
+	significant := math.Abs(r.Mean-old.Mean) > 2*se
+	switch {
+	case !significant:
+		return fmt.Sprintf("%+.1f%% (not significant)", delta), false
+	case delta > threshold:
+		return fmt.Sprintf("%+.1f%% REGRESSION", delta), true
+	}
+	return fmt.Sprintf("%+.1f%%", delta), false
+}
+
+// duration formats ns with four significant digits.
+func duration(ns float64) string {
+	d := time.Duration(ns)
+	r := time.Duration(1)
+	for r*10000 <= d {
+		r *= 10
+	}
+	return d.Round(r).String()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"private/lox"
+)
+
+// runbuild translates a script into another language for `yalox build`.
+func runbuild(args []string) bool {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	emit := fs.String("emit", "go", "`language` to translate to: go or wat")
+	out := fs.String("o", "", "output `file`, standard output if empty")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: yalox build [flags] script")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return false
+	}
+	path := fs.Arg(0)
+
+	p, ok := compilefile(path)
+	if !ok {
+		return false
+	}
+	src, err := p.Emit(*emit, path)
+	if err != nil {
+		reporterr(path, err)
+		return false
+	}
+
+	if *out == "" {
+		_, werr := os.Stdout.Write(src)
+		return werr == nil
+	}
+	if werr := ioutil.WriteFile(*out, src, 0644); werr != nil {
+		fmt.Fprintln(os.Stderr, werr)
+		return false
+	}
+	return true
+}
+
+// runcompile compiles a script to bytecode for `yalox compile`.
+func runcompile(args []string) bool {
+	fs := flag.NewFlagSet("compile", flag.ExitOnError)
+	out := fs.String("o", "", "output `file`, the script with a .loxc extension if empty")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: yalox compile [flags] script")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return false
+	}
+	path := fs.Arg(0)
+	if *out == "" {
+		*out = strings.TrimSuffix(path, filepath.Ext(path)) + ".loxc"
+	}
+
+	p, ok := compilefile(path)
+	if !ok {
+		return false
+	}
+	bs, err := p.Bytecode()
+	if err != nil {
+		reporterr(path, err)
+		return false
+	}
+	if err := ioutil.WriteFile(*out, bs, 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// rundisasm lists the bytecode of .loxc files, or of scripts compiled on the
+// fly, for `yalox disasm`.
+func rundisasm(args []string) bool {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: yalox disasm file...")
+		return false
+	}
+	ok := true
+	for _, path := range args {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ok = false
+			continue
+		}
+		var p *lox.Program
+		if lox.IsBytecode(bs) {
+			if p, err = lox.LoadBytecode(bs); err != nil {
+				reporterr(path, err)
+				ok = false
+				continue
+			}
+		} else {
+			var diags []lox.Diagnostic
+			if p, diags = lox.Compile(bs, options()...); diags != nil {
+				report(path, diags)
+				ok = false
+				continue
+			}
+		}
+		if err := p.Disassemble(os.Stdout); err != nil {
+			reporterr(path, err)
+			ok = false
+		}
+	}
+	return ok
+}
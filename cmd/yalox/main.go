@@ -0,0 +1,315 @@
+// Command yalox runs, tests and translates Lox scripts.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"runtime/pprof"
+	"strings"
+
+	"private/lox"
+)
+
+var (
+	maxDepth   = flag.Int("max-depth", lox.DefaultMaxDepth, "maximum depth of nested calls")
+	maxSteps   = flag.Int64("max-steps", 0, "maximum steps a script may take, 0 for no limit")
+	maxMemory  = flag.Int64("max-memory", 0, "maximum bytes a script may allocate, 0 for no limit")
+	maxOutput  = flag.Int64("max-output", 0, "maximum bytes a script may print, 0 for no limit")
+	backend    = flag.String("backend", "tree", "`backend` to run scripts with: tree or vm")
+	optimize   = flag.Bool("optimize", true, "fold constants and remove dead code before running")
+	cpuprofile = flag.String("cpuprofile", "", "write a CPU profile to `file`")
+	timeout    = flag.Duration("timeout", 0, "stop scripts and tests running longer than `duration`")
+	allow      = flag.String("allow", "time", "comma-separated `capabilities` scripts get, e.g. time,fs:read=/data")
+	restore    = flag.String("restore", "", "define the globals of the snapshot `file` before running")
+	snapshot   = flag.String("snapshot", "", "write the globals of the script to the snapshot `file` after running it")
+	trace      = flag.Bool("trace", false, "print each statement to stderr before running it")
+)
+
+// caps are the capabilities of -allow.
+var caps lox.Capabilities
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, `Usage: yalox [flags] [script]
+       yalox [flags] test [path...]
+       yalox [flags] build [-emit=go|wat] [-o file] script
+       yalox [flags] compile [-o file] script
+       yalox disasm file...
+       yalox [flags] bench [-count n] [-baseline file] [-save file] [path...]`)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *cpuprofile != "" {
+		f, err := os.Create(*cpuprofile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			log.Fatal(err)
+		}
+		defer pprof.StopCPUProfile()
+	}
+	if *backend != "tree" && *backend != "vm" {
+		flag.Usage()
+		exit(64)
+	}
+	var specs []string
+	if *allow != "" {
+		specs = strings.Split(*allow, ",")
+	}
+	var err error
+	if caps, err = lox.ParseCapabilities(specs...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(64)
+	}
+	args := flag.Args()
+	if len(args) > 0 && args[0] == "test" {
+		if !runtests(args[1:]) {
+			exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "build" {
+		if !runbuild(args[1:]) {
+			exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "compile" {
+		if !runcompile(args[1:]) {
+			exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "disasm" {
+		if !rundisasm(args[1:]) {
+			exit(1)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "bench" {
+		if !runbench(args[1:]) {
+			exit(1)
+		}
+		return
+	}
+	if len(args) > 1 {
+		flag.Usage()
+		exit(64)
+	} else if len(args) == 1 {
+		runfile(args[0])
+	} else {
+		runprompt()
+	}
+}
+
+// exit flushes the CPU profile, if any, since os.Exit skips deferred calls.
+func exit(code int) {
+	pprof.StopCPUProfile()
+	os.Exit(code)
+}
+
+// runcontext returns the context to run a script with, which -timeout ends.
+func runcontext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// options are the VM options set by flags.
+func options() []lox.Option {
+	opts := []lox.Option{
+		lox.MaxDepth(*maxDepth),
+		lox.MaxSteps(*maxSteps),
+		lox.MaxMemory(*maxMemory),
+		lox.MaxOutput(*maxOutput),
+		lox.Optimizations(*optimize),
+		lox.Allow(caps),
+	}
+	if *backend == "vm" {
+		opts = append(opts, lox.Backend(lox.Bytecode))
+	}
+	return opts
+}
+
+func runfile(path string) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exit(66)
+	}
+	var p *lox.Program
+	if lox.IsBytecode(bs) {
+		if p, err = lox.LoadBytecode(bs); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+			exit(65)
+		}
+	} else {
+		var diags []lox.Diagnostic
+		if p, diags = lox.Compile(bs, options()...); diags != nil {
+			report(path, diags)
+			exit(65)
+		}
+	}
+	var opts []lox.Option
+	if *trace {
+		opts = append(opts, tracer(path, bs))
+	}
+	vm := newvm(opts...)
+	ctx, cancel := runcontext()
+	defer cancel()
+	err = vm.Run(ctx, p)
+	if lerr := vm.RunLoop(ctx); err == nil {
+		err = lerr
+	}
+	cancel()
+	if *snapshot != "" {
+		if err := writesnapshot(vm, *snapshot); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", *snapshot, err)
+			exit(74)
+		}
+	}
+	if err != nil {
+		exit(70)
+	}
+}
+
+// tracer returns the hook of -trace for the script at path, which is src
+// unless it's bytecode.
+func tracer(path string, src []byte) lox.Option {
+	var lines [][]byte
+	if !lox.IsBytecode(src) {
+		lines = bytes.Split(src, []byte("\n"))
+	}
+	return lox.Hook(lox.Hooks{OnStatement: func(s lox.Statement, _ lox.Env) {
+		line := s.Line
+		if line < 1 || line > len(lines) {
+			fmt.Fprintf(os.Stderr, "%s:%d\n", path, line)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, line, bytes.TrimSpace(lines[line-1]))
+	}})
+}
+
+// newvm returns a VM for running scripts, with the globals of -restore.
+func newvm(opts ...lox.Option) *lox.VM {
+	var snap []byte
+	if *restore != "" {
+		var err error
+		if snap, err = ioutil.ReadFile(*restore); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exit(66)
+		}
+		restorebackend(snap)
+	}
+	opts = append(append(options(), opts...), lox.Stderr(os.Stderr))
+	vm := lox.NewVM(opts...)
+	if snap == nil {
+		return vm
+	}
+	if err := vm.Restore(bytes.NewReader(snap)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *restore, err)
+		exit(65)
+	}
+	return vm
+}
+
+// restorebackend sets -backend to the one snap was made with, unless it was
+// set to another one. Snapshots of .loxc files are always of vm.
+func restorebackend(snap []byte) {
+	e, err := lox.SnapshotEngine(snap)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", *restore, err)
+		exit(65)
+	}
+	name := "tree"
+	if e == lox.Bytecode {
+		name = "vm"
+	}
+	if name == *backend {
+		return
+	}
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == "backend"
+	})
+	if set {
+		fmt.Fprintf(os.Stderr, "%s: the snapshot can only be restored with -backend=%s\n", *restore, name)
+		exit(64)
+	}
+	*backend = name
+}
+
+func writesnapshot(vm *lox.VM, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := vm.Snapshot(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func runprompt() {
+	vm := newvm()
+	rr := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Print("> ")
+		line, err := rr.ReadBytes('\n')
+		if err != nil {
+			panic(err)
+		}
+		p, diags := lox.Compile(line, options()...)
+		if diags != nil {
+			for _, d := range diags {
+				fmt.Fprintln(os.Stderr, d)
+			}
+			continue
+		}
+		ctx, cancel := runcontext()
+		vm.Run(ctx, p)
+		vm.RunLoop(ctx)
+		cancel()
+	}
+}
+
+// report writes the diagnostics of a script to stderr.
+func report(path string, diags []lox.Diagnostic) {
+	for _, d := range diags {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, d.Line, d.Message)
+	}
+}
+
+// compilefile reads and compiles a script, reporting errors to stderr.
+func compilefile(path string) (*lox.Program, bool) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil, false
+	}
+	p, diags := lox.Compile(bs, options()...)
+	if diags != nil {
+		report(path, diags)
+		return nil, false
+	}
+	return p, true
+}
+
+// reporterr writes an error about a script to stderr, with its line if it
+// has one.
+func reporterr(path string, err error) {
+	if e, k := err.(*lox.Error); k {
+		fmt.Fprintf(os.Stderr, "%s:%d: %s\n", path, e.Token.Line, e.Message)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+}
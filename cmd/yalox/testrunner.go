@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"private/lox"
+)
+
+// runtests runs tests from every *_test.lox file found in paths and reports
+// whether all of them have passed.
+func runtests(paths []string) bool {
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	files, err := findtests(paths)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "no test files")
+		return true
+	}
+	ok := true
+	for _, f := range files {
+		ok = runtestfile(f) && ok
+	}
+	return ok
+}
+
+func findtests(paths []string) ([]string, error) {
+	var files []string
+	for _, p := range paths {
+		err := filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() || !strings.HasSuffix(path, "_test.lox") {
+				return nil
+			}
+			files = append(files, path)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// runtestfile runs each test of the file on its own VM. Top-level statements
+// of the file are executed before every test.
+func runtestfile(path string) bool {
+	start := time.Now()
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	p, diags := lox.Compile(bs, lox.Optimizations(*optimize))
+	if diags != nil {
+		for _, d := range diags {
+			fmt.Printf("%s:%d: %s\n", path, d.Line, d.Message)
+		}
+		fmt.Printf("FAIL\t%s\t[compile failed]\n", path)
+		return false
+	}
+
+	ok := true
+	for _, name := range p.Tests() {
+		tstart := time.Now()
+		// Timers of tests run on a virtual clock, so they don't wait.
+		clock := lox.NewVirtualClock(time.Unix(0, 0))
+		vm := lox.NewVM(append(options(), lox.Timers(clock))...)
+		ctx, cancel := runcontext()
+		err := vm.RunTest(ctx, p, name)
+		if err == nil {
+			err = vm.RunLoop(ctx)
+		}
+		cancel()
+		d := time.Since(tstart).Seconds()
+		if err == nil {
+			fmt.Printf("--- PASS: %s (%.2fs)\n", name, d)
+			continue
+		}
+		ok = false
+		fmt.Printf("--- FAIL: %s (%.2fs)\n", name, d)
+		line, msg := failure(err)
+		msg = strings.ReplaceAll(msg, "\n", "\n        ")
+		fmt.Printf("    %s:%d: %s\n", path, line, msg)
+	}
+	if ok {
+		fmt.Printf("ok  \t%s\t%.3fs\n", path, time.Since(start).Seconds())
+	} else {
+		fmt.Printf("FAIL\t%s\t%.3fs\n", path, time.Since(start).Seconds())
+	}
+	return ok
+}
+
+// failure returns the line and the bare message of err.
+func failure(err error) (int, string) {
+	line := 0
+	switch e := err.(type) {
+	case *lox.Error:
+		return e.Token.Line, e.Message
+	case *lox.RuntimeError:
+		return e.Line, e.Message
+	case *lox.QuotaExceeded:
+		line = e.Line
+	case *lox.Interrupted:
+		line = e.Line
+	default:
+		return 0, err.Error()
+	}
+	// These say "line N: message".
+	return line, strings.TrimPrefix(err.Error(), fmt.Sprintf("line %d: ", line))
+}
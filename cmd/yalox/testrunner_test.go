@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture returns what fn prints to stdout.
+func capture(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	out := make(chan string)
+	go func() {
+		bs, _ := ioutil.ReadAll(r)
+		out <- string(bs)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func eachBackend(t *testing.T, fn func(t *testing.T)) {
+	for _, b := range []string{"tree", "vm"} {
+		t.Run(b, func(t *testing.T) {
+			defer func(old string) { *backend = old }(*backend)
+			*backend = b
+			fn(t)
+		})
+	}
+}
+
+func TestRunTestsPass(t *testing.T) {
+	eachBackend(t, func(t *testing.T) {
+		var ok bool
+		out := capture(t, func() { ok = runtests([]string{"testdata/pass"}) })
+		if !ok {
+			t.Fatalf("tests failed:\n%s", out)
+		}
+		if n := strings.Count(out, "--- PASS"); n != 4 {
+			t.Errorf("got %d passing tests, want 4:\n%s", n, out)
+		}
+	})
+}
+
+func TestRunTestsFail(t *testing.T) {
+	eachBackend(t, func(t *testing.T) {
+		defer func(old int) { *maxDepth = old }(*maxDepth)
+		*maxDepth = 50
+		var ok bool
+		out := capture(t, func() { ok = runtests([]string{"testdata/fail"}) })
+		if ok {
+			t.Fatalf("tests passed:\n%s", out)
+		}
+		for _, want := range []string{
+			"--- PASS: passes",
+			"--- FAIL: assertion",
+			"fail_test.lox:10: values are not equal\n",
+			"expected: 3\n", "got: 2\n",
+			"--- FAIL: overflow",
+			// Quota errors get their line, and no "line N:" in the message.
+			"fail_test.lox:2: stack overflow\n",
+		} {
+			if !strings.Contains(out, want) {
+				t.Errorf("output is missing %q:\n%s", want, out)
+			}
+		}
+	})
+}
@@ -0,0 +1,572 @@
+package lox
+
+import "fmt"
+
+type local struct {
+	name     string
+	depth    int
+	captured bool
+}
+
+// funcState is the compiler's state for the function being compiled.
+type funcState struct {
+	enclosing *funcState
+	proto     *proto
+	locals    []local
+	depth     int
+	names     map[string]int
+	// declared has every local ever declared in the function
+	declared []string
+}
+
+// compiler turns statements into bytecode for the VM.
+type compiler struct {
+	fs   *funcState
+	line int
+}
+
+func newCompiler() *compiler {
+	return &compiler{}
+}
+
+// Compile compiles every top-level statement into a separate script, so a
+// runtime error stops only the statement it happened in, like in interpreter.
+func (c *compiler) Compile(stmts []stmt) ([]*proto, *Error) {
+	scripts := make([]*proto, 0, len(stmts))
+	for _, s := range stmts {
+		if _, k := s.(*testStmt); k {
+			continue
+		}
+		script, err := c.script(s)
+		if err != nil {
+			return nil, err
+		}
+		if v, k := s.(*varStmt); k && !v.Local {
+			script.Declares = string(v.Name.Lexeme)
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts, nil
+}
+
+func (c *compiler) script(s stmt) (*proto, *Error) {
+	c.begin("", 0)
+	if err := c.stmt(s); err != nil {
+		c.fs = nil
+		return nil, err
+	}
+	return c.end(), nil
+}
+
+func (c *compiler) begin(name string, arity int) {
+	c.fs = &funcState{
+		enclosing: c.fs,
+		proto:     &proto{Name: name, Arity: arity},
+		// Slot zero holds the function being called.
+		locals: []local{{}},
+		names:  make(map[string]int),
+	}
+}
+
+func (c *compiler) end() *proto {
+	c.emit(opNil)
+	c.emit(opReturn)
+	p := c.fs.proto
+	p.Chunk.caches = make([]globalCache, len(p.Chunk.Consts))
+	for fs := c.fs; fs != nil; fs = fs.enclosing {
+		p.Locals = append(p.Locals, fs.declared...)
+	}
+	c.fs = c.fs.enclosing
+	return p
+}
+
+func (c *compiler) stmt(s stmt) *Error {
+	if line, kind, k := statementAt(s); k {
+		locals := make([]string, len(c.fs.locals)-1)
+		for k, l := range c.fs.locals[1:] {
+			locals[k] = l.name
+		}
+		ch := c.chunk()
+		ch.stmts = append(ch.stmts, stmtStart{len(ch.Code), line, kind, locals})
+	}
+	_, err := s.Accept(c)
+	return err
+}
+
+func (c *compiler) expr(e expr) *Error {
+	_, err := e.Accept(c)
+	return err
+}
+
+func (c *compiler) Visit(v interface{}) (interface{}, *Error) {
+	switch a := v.(type) {
+	case *expressionStmt:
+		if err := c.expr(a.Expr); err != nil {
+			return nil, err
+		}
+		c.emit(opPop)
+	case *printStmt:
+		if err := c.expr(a.Expr); err != nil {
+			return nil, err
+		}
+		c.emit(opPrint)
+	case *varStmt:
+		c.line = a.Name.Line
+		if a.Init != nil {
+			if err := c.expr(a.Init); err != nil {
+				return nil, err
+			}
+		} else {
+			c.emit(opNil)
+		}
+		// The initializer can't see the variable, as in interpreter.
+		return nil, c.define(a.Name)
+	case *blockStmt:
+		c.fs.depth++
+		for _, s := range a.Stmts {
+			if err := c.stmt(s); err != nil {
+				return nil, err
+			}
+		}
+		c.endScope()
+	case *ifStmt:
+		if err := c.expr(a.Cond); err != nil {
+			return nil, err
+		}
+		then := c.jump(opJumpIfFalse)
+		c.emit(opPop)
+		if err := c.stmt(a.Then); err != nil {
+			return nil, err
+		}
+		els := c.jump(opJump)
+		c.patch(then)
+		c.emit(opPop)
+		if a.Else != nil {
+			if err := c.stmt(a.Else); err != nil {
+				return nil, err
+			}
+		}
+		c.patch(els)
+	case *whileStmt:
+		c.line = a.Keyword.Line
+		start := len(c.chunk().Code)
+		if err := c.expr(a.Cond); err != nil {
+			return nil, err
+		}
+		exit := c.jump(opJumpIfFalse)
+		c.emit(opPop)
+		if err := c.stmt(a.Body); err != nil {
+			return nil, err
+		}
+		c.line = a.Keyword.Line
+		c.loop(start)
+		c.patch(exit)
+		c.emit(opPop)
+	case *functionStmt:
+		c.line = a.Name.Line
+		if c.fs.depth > 0 {
+			// Declare it first so the function can call itself.
+			if err := c.addLocal(a.Name); err != nil {
+				return nil, err
+			}
+		}
+		if err := c.function(a); err != nil {
+			return nil, err
+		}
+		if c.fs.depth == 0 {
+			c.emitName(opDefineGlobal, string(a.Name.Lexeme))
+		}
+	case *returnStmt:
+		c.line = a.Keyword.Line
+		if a.Value != nil {
+			if err := c.expr(a.Value); err != nil {
+				return nil, err
+			}
+		} else {
+			c.emit(opNil)
+		}
+		c.emit(opReturn)
+	case *testStmt:
+		// Only run by `yalox test`.
+	case *selectStmt:
+		return nil, c.choose(a)
+
+	case *literalExpr:
+		switch a.Val.Kind() {
+		case KindNil:
+			c.emit(opNil)
+		case KindBool:
+			if a.Val.Bool() {
+				c.emit(opTrue)
+			} else {
+				c.emit(opFalse)
+			}
+		default:
+			return nil, c.emitConst(opConstant, a.Val)
+		}
+	case *groupingExpr:
+		return nil, c.expr(a.Expr)
+	case *unaryExpr:
+		if err := c.expr(a.Right); err != nil {
+			return nil, err
+		}
+		c.line = a.Op.Line
+		switch a.Op.Type {
+		case tokenMinus:
+			c.emit(opNegate)
+		case tokenBang:
+			c.emit(opNot)
+		default:
+			return nil, &Error{a.Op, "unknown unary operator"}
+		}
+	case *binaryExpr:
+		if err := c.expr(a.Left); err != nil {
+			return nil, err
+		}
+		if err := c.expr(a.Right); err != nil {
+			return nil, err
+		}
+		op, k := binaryops[a.Op.Type]
+		if !k {
+			return nil, &Error{a.Op, "unknown binary operator"}
+		}
+		c.line = a.Op.Line
+		c.emit(op)
+	case *logicalExpr:
+		if err := c.expr(a.Left); err != nil {
+			return nil, err
+		}
+		c.line = a.Op.Line
+		var end int
+		switch a.Op.Type {
+		case tokenOr:
+			els := c.jump(opJumpIfFalse)
+			end = c.jump(opJump)
+			c.patch(els)
+		case tokenAnd:
+			end = c.jump(opJumpIfFalse)
+		default:
+			return nil, &Error{a.Op, "unknown logical operator"}
+		}
+		c.emit(opPop)
+		if err := c.expr(a.Right); err != nil {
+			return nil, err
+		}
+		c.patch(end)
+	case *variableExpr:
+		c.line = a.Name.Line
+		return nil, c.variable(a.Name, false)
+	case *assignExpr:
+		if err := c.expr(a.Val); err != nil {
+			return nil, err
+		}
+		c.line = a.Name.Line
+		return nil, c.variable(a.Name, true)
+	case *callExpr:
+		if err := c.expr(a.Callee); err != nil {
+			return nil, err
+		}
+		for _, ar := range a.Args {
+			if err := c.expr(ar); err != nil {
+				return nil, err
+			}
+		}
+		if len(a.Args) > 255 {
+			return nil, &Error{a.Paren, "can't have more than 255 arguments"}
+		}
+		c.line = a.Paren.Line
+		if a.Tail {
+			// Return still follows, for natives.
+			c.emit(opTailCall, byte(len(a.Args)))
+		} else {
+			c.emit(opCall, byte(len(a.Args)))
+		}
+	case *getExpr:
+		if err := c.expr(a.Object); err != nil {
+			return nil, err
+		}
+		c.line = a.Name.Line
+		c.emitName(opGetProperty, string(a.Name.Lexeme))
+	case *setExpr:
+		if err := c.expr(a.Object); err != nil {
+			return nil, err
+		}
+		if err := c.expr(a.Val); err != nil {
+			return nil, err
+		}
+		c.line = a.Name.Line
+		c.emitName(opSetProperty, string(a.Name.Lexeme))
+	case *spawnExpr:
+		if err := c.expr(a.Call.Callee); err != nil {
+			return nil, err
+		}
+		for _, ar := range a.Call.Args {
+			if err := c.expr(ar); err != nil {
+				return nil, err
+			}
+		}
+		if len(a.Call.Args) > 255 {
+			return nil, &Error{a.Call.Paren, "can't have more than 255 arguments"}
+		}
+		c.line = a.Call.Paren.Line
+		c.emit(opSpawn, byte(len(a.Call.Args)))
+	case *yieldExpr:
+		if err := c.expr(a.Value); err != nil {
+			return nil, err
+		}
+		c.line = a.Keyword.Line
+		c.emit(opYield)
+	default:
+		return nil, &Error{Token{Line: c.line}, fmt.Sprintf("can't compile %T", v)}
+	}
+	return nil, nil
+}
+
+var binaryops = map[int]byte{
+	tokenPlus:         opAdd,
+	tokenMinus:        opSubtract,
+	tokenStar:         opMultiply,
+	tokenSlash:        opDivide,
+	tokenEqualEqual:   opEqual,
+	tokenBangEqual:    opNotEqual,
+	tokenGreater:      opGreater,
+	tokenGreaterEqual: opGreaterEqual,
+	tokenLess:         opLess,
+	tokenLessEqual:    opLessEqual,
+}
+
+func (c *compiler) function(f *functionStmt) *Error {
+	c.begin(string(f.Name.Lexeme), len(f.Params))
+	c.fs.depth++
+	for _, p := range f.Params {
+		if err := c.addLocal(p); err != nil {
+			return err
+		}
+	}
+	for _, s := range f.Body {
+		if err := c.stmt(s); err != nil {
+			return err
+		}
+	}
+	proto := c.end()
+	proto.Generator = f.Generator
+	return c.emitConst(opClosure, ObjectValue(proto))
+}
+
+// choose compiles a select. opSelect leaves the value received and the
+// index of the case that went on, -1 for the default, in hidden locals for
+// the cases to check in turn.
+func (c *compiler) choose(a *selectStmt) *Error {
+	if len(a.Cases) > 255 {
+		return &Error{a.Keyword, "can't have more than 255 cases in select"}
+	}
+	for _, cs := range a.Cases {
+		if err := c.expr(cs.Chan); err != nil {
+			return err
+		}
+		if cs.Value != nil {
+			if err := c.expr(cs.Value); err != nil {
+				return err
+			}
+			c.emit(opTrue)
+		} else {
+			c.emit(opNil)
+			c.emit(opFalse)
+		}
+	}
+	c.line = a.Keyword.Line
+	if a.Default != nil {
+		c.emit(opTrue)
+	} else {
+		c.emit(opFalse)
+	}
+	c.emit(opSelect, byte(len(a.Cases)))
+	c.fs.depth++
+	if len(c.fs.locals) > 254 {
+		return &Error{a.Keyword, "too many local variables in function"}
+	}
+	received := len(c.fs.locals)
+	c.fs.locals = append(c.fs.locals, local{depth: c.fs.depth}, local{depth: c.fs.depth})
+	var ends []int
+	for k, cs := range a.Cases {
+		c.line = cs.Keyword.Line
+		c.emit(opGetLocal, byte(received+1))
+		if err := c.emitConst(opConstant, NumberValue(float64(k))); err != nil {
+			return err
+		}
+		c.emit(opEqual)
+		next := c.jump(opJumpIfFalse)
+		c.emit(opPop)
+		c.fs.depth++
+		if cs.Name.Lexeme != nil {
+			c.emit(opGetLocal, byte(received))
+			if err := c.addLocal(cs.Name); err != nil {
+				return err
+			}
+		}
+		for _, s := range cs.Body {
+			if err := c.stmt(s); err != nil {
+				return err
+			}
+		}
+		c.endScope()
+		ends = append(ends, c.jump(opJump))
+		c.patch(next)
+		c.emit(opPop)
+	}
+	if a.Default != nil {
+		if err := c.stmt(a.Default); err != nil {
+			return err
+		}
+	}
+	for _, e := range ends {
+		c.patch(e)
+	}
+	c.endScope()
+	return nil
+}
+
+// define binds the value on top of the stack to a new variable.
+func (c *compiler) define(name Token) *Error {
+	if c.fs.depth == 0 {
+		c.emitName(opDefineGlobal, string(name.Lexeme))
+		return nil
+	}
+	return c.addLocal(name)
+}
+
+func (c *compiler) addLocal(name Token) *Error {
+	if len(c.fs.locals) > 255 {
+		return &Error{name, "too many local variables in function"}
+	}
+	c.fs.locals = append(c.fs.locals, local{name: string(name.Lexeme), depth: c.fs.depth})
+	c.fs.declared = append(c.fs.declared, string(name.Lexeme))
+	return nil
+}
+
+func (c *compiler) endScope() {
+	fs := c.fs
+	fs.depth--
+	for len(fs.locals) > 0 && fs.locals[len(fs.locals)-1].depth > fs.depth {
+		if fs.locals[len(fs.locals)-1].captured {
+			c.emit(opCloseUpvalue)
+		} else {
+			c.emit(opPop)
+		}
+		fs.locals = fs.locals[:len(fs.locals)-1]
+	}
+}
+
+func (c *compiler) variable(name Token, set bool) *Error {
+	lex := string(name.Lexeme)
+	get, put := byte(opGetLocal), byte(opSetLocal)
+	idx := resolveLocal(c.fs, lex)
+	if idx < 0 {
+		idx = resolveUpvalue(c.fs, lex)
+		get, put = opGetUpvalue, opSetUpvalue
+	}
+	if idx < 0 {
+		if set {
+			c.emitName(opSetGlobal, lex)
+		} else {
+			c.emitName(opGetGlobal, lex)
+		}
+		return nil
+	}
+	if idx > 255 {
+		return &Error{name, "too many closure variables in function"}
+	}
+	if set {
+		c.emit(put, byte(idx))
+	} else {
+		c.emit(get, byte(idx))
+	}
+	return nil
+}
+
+func resolveLocal(fs *funcState, name string) int {
+	for i := len(fs.locals) - 1; i > 0; i-- {
+		if fs.locals[i].name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func resolveUpvalue(fs *funcState, name string) int {
+	if fs.enclosing == nil {
+		return -1
+	}
+	if l := resolveLocal(fs.enclosing, name); l >= 0 {
+		fs.enclosing.locals[l].captured = true
+		return addUpvalue(fs, upvalueRef{true, byte(l), name})
+	}
+	if u := resolveUpvalue(fs.enclosing, name); u >= 0 {
+		return addUpvalue(fs, upvalueRef{false, byte(u), name})
+	}
+	return -1
+}
+
+func addUpvalue(fs *funcState, ref upvalueRef) int {
+	for i, u := range fs.proto.Upvalues {
+		if u == ref {
+			return i
+		}
+	}
+	fs.proto.Upvalues = append(fs.proto.Upvalues, ref)
+	return len(fs.proto.Upvalues) - 1
+}
+
+func (c *compiler) chunk() *chunk {
+	return &c.fs.proto.Chunk
+}
+
+func (c *compiler) emit(bs ...byte) {
+	for _, b := range bs {
+		c.chunk().write(b, c.line)
+	}
+}
+
+func (c *compiler) emitConst(op byte, val Value) *Error {
+	ch := c.chunk()
+	if len(ch.Consts) > 0xffff {
+		return &Error{Token{Line: c.line}, "too many constants in one chunk"}
+	}
+	ch.Consts = append(ch.Consts, val)
+	idx := len(ch.Consts) - 1
+	c.emit(op, byte(idx>>8), byte(idx))
+	return nil
+}
+
+// emitName is emitConst for variable names, which are interned per function.
+func (c *compiler) emitName(op byte, name string) {
+	idx, k := c.fs.names[name]
+	if !k {
+		ch := c.chunk()
+		ch.Consts = append(ch.Consts, StringValue([]byte(name)))
+		idx = len(ch.Consts) - 1
+		c.fs.names[name] = idx
+	}
+	c.emit(op, byte(idx>>8), byte(idx))
+}
+
+// jump emits a forward jump to be patched later and returns its position.
+func (c *compiler) jump(op byte) int {
+	c.emit(op, 0xff, 0xff)
+	return len(c.chunk().Code) - 2
+}
+
+func (c *compiler) patch(at int) {
+	code := c.chunk().Code
+	off := len(code) - at - 2
+	code[at] = byte(off >> 8)
+	code[at+1] = byte(off)
+}
+
+func (c *compiler) loop(start int) {
+	c.emit(opLoop)
+	off := len(c.chunk().Code) - start + 2
+	c.emit(byte(off>>8), byte(off))
+}
+
+var _ = visitor(&compiler{})
@@ -0,0 +1,71 @@
+package lox
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// disassemble writes a listing of p and the functions defined in it.
+func disassemble(w io.Writer, p *proto) {
+	fmt.Fprintf(w, "== %s ==\n", p)
+	if p.Arity > 0 || len(p.Upvalues) > 0 || p.Generator {
+		var ups []string
+		for _, u := range p.Upvalues {
+			if u.Local {
+				ups = append(ups, fmt.Sprintf("local %d", u.Index))
+			} else {
+				ups = append(ups, fmt.Sprintf("upvalue %d", u.Index))
+			}
+		}
+		kind := ""
+		if p.Generator {
+			kind = ", generator"
+		}
+		fmt.Fprintf(w, "arity %d, upvalues [%s]%s\n", p.Arity, strings.Join(ups, ", "), kind)
+	}
+	ch := &p.Chunk
+	for ip := 0; ip < len(ch.Code); {
+		ip = disassembleAt(w, ch, ip)
+	}
+	for _, c := range ch.Consts {
+		if fn, k := c.Object().(*proto); k {
+			fmt.Fprintln(w)
+			disassemble(w, fn)
+		}
+	}
+}
+
+// disassembleAt writes the instruction at ip and returns the next one.
+func disassembleAt(w io.Writer, ch *chunk, ip int) int {
+	line := fmt.Sprintf("%4d", ch.Lines[ip])
+	if ip > 0 && ch.Lines[ip] == ch.Lines[ip-1] {
+		line = "   |"
+	}
+	op := ch.Code[ip]
+	if int(op) >= len(opnames) {
+		fmt.Fprintf(w, "%04d %s ??? %d\n", ip, line, op)
+		return ip + 1
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%04d %s %-14s", ip, line, opnames[op])
+	arg := 0
+	switch operands(op) {
+	case 1:
+		arg = int(ch.Code[ip+1])
+	case 2:
+		arg = int(ch.Code[ip+1])<<8 | int(ch.Code[ip+2])
+	}
+	switch op {
+	case opConstant, opGetGlobal, opDefineGlobal, opSetGlobal, opClosure, opGetProperty, opSetProperty:
+		fmt.Fprintf(&sb, " %4d %s", arg, repr(ch.Consts[arg]))
+	case opJump, opJumpIfFalse:
+		fmt.Fprintf(&sb, " %4d -> %04d", arg, ip+3+arg)
+	case opLoop:
+		fmt.Fprintf(&sb, " %4d -> %04d", arg, ip+3-arg)
+	case opGetLocal, opSetLocal, opGetUpvalue, opSetUpvalue, opCall, opTailCall, opSpawn, opSelect:
+		fmt.Fprintf(&sb, " %4d", arg)
+	}
+	fmt.Fprintln(w, strings.TrimRight(sb.String(), " "))
+	return ip + 1 + operands(op)
+}
@@ -0,0 +1,41 @@
+// Package lox is an interpreter of the Lox language meant for embedding.
+//
+// Compile turns a script into a Program, which a VM runs:
+//
+//	p, diags := lox.Compile(src)
+//	if diags != nil {
+//		// report the diagnostics
+//	}
+//	vm := lox.NewVM(lox.Stdout(w))
+//	err := vm.Run(ctx, p)
+//
+// VM.Define gives scripts Go values, functions and structs, converted by
+// ValueOf. VM.Global gives the host the globals of scripts, and calls their
+// functions. Value.Decode converts results back.
+//
+// Runs of untrusted scripts can be bounded with a context and with the
+// MaxSteps, MaxMemory, MaxOutput and MaxDepth options. They reach outside the
+// VM only through the Capabilities granted with Allow, none by default.
+//
+// VM.Snapshot saves the globals of a VM, closures included, and VM.Restore
+// brings them back in a fresh one.
+//
+// The Hook option has the VM call Hooks as statements run, functions are
+// called and return, and errors happen, for debuggers, profilers and tracers.
+//
+// Scripts schedule callbacks with setTimeout and setInterval and chain them
+// with promises. VM.RunLoop runs them once Run returned, on the clock given
+// with the Timers option.
+//
+// spawn runs a call as a task, whose wait method returns the result. Tasks
+// talk over channels and wait on several of them with select. They take
+// turns, so only one runs at a time, but the others go on while one calls a
+// host function that takes a context.
+//
+// Functions that yield are generators: calling one returns a generator,
+// whose next method runs the function to its next yield, and
+// for (var x in generator) loops over what it yields.
+package lox
+
+//go:generate go run acceptgen/gen.go structs visiters
+//go:generate gofmt -w visiters.go
@@ -0,0 +1,404 @@
+package lox
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// goEmitter translates resolved statements into a Go program running on the
+// loxrt package. Expressions are flattened into temporaries, so operands are
+// evaluated left to right, like in interpreter.
+type goEmitter struct {
+	out   bytes.Buffer
+	decls bytes.Buffer
+	// Go and Lox names of the slots of every open scope
+	scopes [][]string
+	names  [][]string
+	// declared scope name lists by their contents
+	lists map[string]string
+	n     int
+	// depth of functions being emitted
+	funcs    int
+	needmath bool
+}
+
+// emitGo returns a gofmt'ed Go program doing what stmts do.
+func emitGo(stmts []stmt, source string) ([]byte, *Error) {
+	g := &goEmitter{lists: make(map[string]string)}
+	g.line("func main() {")
+	g.line("loxrt.Run(")
+	for _, s := range stmts {
+		if _, k := s.(*testStmt); k {
+			continue
+		}
+		g.line("func() {")
+		if err := g.stmt(s); err != nil {
+			return nil, err
+		}
+		g.line("},")
+	}
+	g.line(")")
+	g.line("}")
+
+	var prog bytes.Buffer
+	fmt.Fprintf(&prog, "// Code generated by yalox from %s. DO NOT EDIT.\n\n", source)
+	prog.WriteString("package main\n\nimport (\n")
+	if g.needmath {
+		prog.WriteString("\"math\"\n")
+	}
+	prog.WriteString("\"private/lox/loxrt\"\n)\n\n")
+	prog.Write(g.decls.Bytes())
+	prog.Write(g.out.Bytes())
+	src, ferr := format.Source(prog.Bytes())
+	if ferr != nil {
+		return nil, &Error{Token{}, "generated invalid Go: " + ferr.Error()}
+	}
+	return src, nil
+}
+
+func (g *goEmitter) line(format string, args ...interface{}) {
+	fmt.Fprintf(&g.out, format+"\n", args...)
+}
+
+func (g *goEmitter) tmp() string {
+	g.n++
+	return "t" + strconv.Itoa(g.n)
+}
+
+func (g *goEmitter) stmt(s stmt) *Error {
+	_, err := s.Accept(g)
+	return err
+}
+
+func (g *goEmitter) stmts(stmts []stmt) *Error {
+	for _, s := range stmts {
+		if err := g.stmt(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// expr emits the statements computing e and returns the Go expression holding
+// its value.
+func (g *goEmitter) expr(e expr) (string, *Error) {
+	v, err := e.Accept(g)
+	if err != nil {
+		return "", err
+	}
+	return v.(string), nil
+}
+
+// open declares Go variables for a scope of Lox names.
+func (g *goEmitter) open(names []string) {
+	vars := make([]string, len(names))
+	blanks := make([]string, len(names))
+	for i, n := range names {
+		g.n++
+		vars[i] = fmt.Sprintf("v_%s_%d", n, g.n)
+		blanks[i] = "_"
+	}
+	g.line("var %s loxrt.Value", strings.Join(vars, ", "))
+	g.line("%s = %s", strings.Join(blanks, ", "), strings.Join(vars, ", "))
+	g.scopes = append(g.scopes, vars)
+	g.names = append(g.names, names)
+}
+
+func (g *goEmitter) close() {
+	g.scopes = g.scopes[:len(g.scopes)-1]
+	g.names = g.names[:len(g.names)-1]
+}
+
+func (g *goEmitter) local(depth, slot int) string {
+	return g.scopes[len(g.scopes)-1-depth][slot]
+}
+
+// visible returns a package variable listing the locals in scope.
+func (g *goEmitter) visible() string {
+	var all []string
+	for _, ns := range g.names {
+		all = append(all, ns...)
+	}
+	if len(all) == 0 {
+		return "nil"
+	}
+	key := strings.Join(all, " ")
+	if v, k := g.lists[key]; k {
+		return v
+	}
+	v := fmt.Sprintf("locals%d", len(g.lists)+1)
+	g.lists[key] = v
+	quoted := make([]string, len(all))
+	for i := range all {
+		quoted[i] = strconv.Quote(all[i])
+	}
+	fmt.Fprintf(&g.decls, "var %s = []string{%s}\n\n", v, strings.Join(quoted, ", "))
+	return v
+}
+
+func (g *goEmitter) number(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		g.needmath = true
+		return "loxrt.Num(math.NaN())"
+	case math.IsInf(f, 0):
+		g.needmath = true
+		return fmt.Sprintf("loxrt.Num(math.Inf(%d))", int(math.Copysign(1, f)))
+	case f == 0 && math.Signbit(f):
+		g.needmath = true
+		return "loxrt.Num(math.Copysign(0, -1))"
+	}
+	return "loxrt.Num(" + strconv.FormatFloat(f, 'g', -1, 64) + ")"
+}
+
+var gobinaryops = map[int]string{
+	tokenPlus:         "Add",
+	tokenMinus:        "Sub",
+	tokenStar:         "Mul",
+	tokenSlash:        "Div",
+	tokenGreater:      "Greater",
+	tokenGreaterEqual: "GreaterEqual",
+	tokenLess:         "Less",
+	tokenLessEqual:    "LessEqual",
+}
+
+func (g *goEmitter) Visit(v interface{}) (interface{}, *Error) {
+	switch a := v.(type) {
+	case *expressionStmt:
+		e, err := g.expr(a.Expr)
+		if err != nil {
+			return nil, err
+		}
+		g.line("_ = %s", e)
+	case *printStmt:
+		e, err := g.expr(a.Expr)
+		if err != nil {
+			return nil, err
+		}
+		g.line("loxrt.Print(%s)", e)
+	case *varStmt:
+		e := "loxrt.Nil"
+		if a.Init != nil {
+			var err *Error
+			if e, err = g.expr(a.Init); err != nil {
+				return nil, err
+			}
+		}
+		if a.Local {
+			g.line("%s = %s", g.local(0, a.Slot), e)
+		} else {
+			g.line("loxrt.Define(%q, %s)", a.Name.Lexeme, e)
+		}
+	case *blockStmt:
+		g.line("{")
+		if len(a.Names) > 0 {
+			g.open(a.Names)
+			defer g.close()
+		}
+		if err := g.stmts(a.Stmts); err != nil {
+			return nil, err
+		}
+		g.line("}")
+	case *ifStmt:
+		c, err := g.expr(a.Cond)
+		if err != nil {
+			return nil, err
+		}
+		g.line("if loxrt.Truthy(%s) {", c)
+		if err := g.stmt(a.Then); err != nil {
+			return nil, err
+		}
+		if a.Else != nil {
+			g.line("} else {")
+			if err := g.stmt(a.Else); err != nil {
+				return nil, err
+			}
+		}
+		g.line("}")
+	case *whileStmt:
+		g.line("for {")
+		c, err := g.expr(a.Cond)
+		if err != nil {
+			return nil, err
+		}
+		g.line("if !loxrt.Truthy(%s) {", c)
+		g.line("break")
+		g.line("}")
+		if err := g.stmt(a.Body); err != nil {
+			return nil, err
+		}
+		g.line("}")
+	case *functionStmt:
+		t := g.tmp()
+		g.line("%s := loxrt.NewFunc(%q, %d, func(args []loxrt.Value) loxrt.Value {", t, a.Name.Lexeme, len(a.Params))
+		g.funcs++
+		if len(a.Names) > 0 {
+			g.open(a.Names)
+			for i := range a.Params {
+				g.line("%s = args[%d]", g.local(0, i), i)
+			}
+		}
+		if err := g.stmts(a.Body); err != nil {
+			return nil, err
+		}
+		if len(a.Names) > 0 {
+			g.close()
+		}
+		g.funcs--
+		g.line("return loxrt.Nil")
+		g.line("})")
+		if a.Local {
+			g.line("%s = %s", g.local(0, a.Slot), t)
+		} else {
+			g.line("loxrt.Define(%q, %s)", a.Name.Lexeme, t)
+		}
+	case *returnStmt:
+		e := "loxrt.Nil"
+		if a.Value != nil {
+			var err *Error
+			if e, err = g.expr(a.Value); err != nil {
+				return nil, err
+			}
+		}
+		if g.funcs == 0 {
+			// interpreter reports returning from top-level code like this.
+			g.line("_ = %s", e)
+			g.line("loxrt.Fail(0, \"\")")
+		} else {
+			g.line("return %s", e)
+		}
+	case *testStmt:
+
+	case *literalExpr:
+		switch a.Val.Kind() {
+		case KindNil:
+			return "loxrt.Nil", nil
+		case KindBool:
+			if a.Val.Bool() {
+				return "loxrt.True", nil
+			}
+			return "loxrt.False", nil
+		case KindNumber:
+			return g.number(a.Val.Number()), nil
+		case KindString:
+			return "loxrt.Str(" + strconv.Quote(string(a.Val.Bytes())) + ")", nil
+		}
+		return nil, &Error{Token{}, "can't translate literal " + stringify(a.Val)}
+	case *groupingExpr:
+		return g.expr(a.Expr)
+	case *unaryExpr:
+		r, err := g.expr(a.Right)
+		if err != nil {
+			return nil, err
+		}
+		t := g.tmp()
+		switch a.Op.Type {
+		case tokenMinus:
+			g.line("%s := loxrt.Neg(%s, %d)", t, r, a.Op.Line)
+		case tokenBang:
+			g.line("%s := loxrt.Not(%s)", t, r)
+		default:
+			return nil, &Error{a.Op, "unknown unary operator"}
+		}
+		return t, nil
+	case *binaryExpr:
+		l, err := g.expr(a.Left)
+		if err != nil {
+			return nil, err
+		}
+		r, err := g.expr(a.Right)
+		if err != nil {
+			return nil, err
+		}
+		t := g.tmp()
+		switch a.Op.Type {
+		case tokenEqualEqual:
+			g.line("%s := loxrt.Equal(%s, %s)", t, l, r)
+		case tokenBangEqual:
+			g.line("%s := loxrt.NotEqual(%s, %s)", t, l, r)
+		default:
+			fn, k := gobinaryops[a.Op.Type]
+			if !k {
+				return nil, &Error{a.Op, "unknown binary operator"}
+			}
+			g.line("%s := loxrt.%s(%s, %s, %d)", t, fn, l, r, a.Op.Line)
+		}
+		return t, nil
+	case *logicalExpr:
+		l, err := g.expr(a.Left)
+		if err != nil {
+			return nil, err
+		}
+		t := g.tmp()
+		g.line("%s := %s", t, l)
+		switch a.Op.Type {
+		case tokenOr:
+			g.line("if !loxrt.Truthy(%s) {", t)
+		case tokenAnd:
+			g.line("if loxrt.Truthy(%s) {", t)
+		default:
+			return nil, &Error{a.Op, "unknown logical operator"}
+		}
+		r, err := g.expr(a.Right)
+		if err != nil {
+			return nil, err
+		}
+		g.line("%s = %s", t, r)
+		g.line("}")
+		return t, nil
+	case *variableExpr:
+		t := g.tmp()
+		if a.Local {
+			g.line("%s := %s", t, g.local(a.Depth, a.Slot))
+		} else {
+			g.line("%s := loxrt.Get(%q, %d, %s)", t, a.Name.Lexeme, a.Name.Line, g.visible())
+		}
+		return t, nil
+	case *assignExpr:
+		val, err := g.expr(a.Val)
+		if err != nil {
+			return nil, err
+		}
+		if a.Local {
+			g.line("%s = %s", g.local(a.Depth, a.Slot), val)
+			return val, nil
+		}
+		t := g.tmp()
+		g.line("%s := loxrt.Set(%q, %s, %d, %s)", t, a.Name.Lexeme, val, a.Name.Line, g.visible())
+		return t, nil
+	case *callExpr:
+		callee, err := g.expr(a.Callee)
+		if err != nil {
+			return nil, err
+		}
+		args := []string{callee, strconv.Itoa(a.Paren.Line)}
+		for _, ar := range a.Args {
+			e, err := g.expr(ar)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, e)
+		}
+		call := "Call"
+		if a.Tail {
+			call = "TailCall"
+		}
+		t := g.tmp()
+		g.line("%s := loxrt.%s(%s)", t, call, strings.Join(args, ", "))
+		return t, nil
+	case *getExpr:
+		// Only objects of the host have properties.
+		return nil, &Error{a.Name, "can't translate property access to Go"}
+	case *setExpr:
+		return nil, &Error{a.Name, "can't translate property access to Go"}
+	default:
+		return nil, &Error{Token{}, fmt.Sprintf("can't translate %T to Go", v)}
+	}
+	return nil, nil
+}
+
+var _ = visitor(&goEmitter{})
@@ -0,0 +1,109 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go/format"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// goPrograms are the programs emitGo is tested with, on top of watPrograms.
+var goPrograms = map[string]string{
+	"natives": `
+assert(1 < 2);
+assertEqual(1 + 1, 2);
+assertNotEqual("a", "b");
+assertEqual(2, 1 + 2);
+assert(nil);
+fail("no");
+print "after";
+`,
+	"shadowing": `
+var a = "global";
+fun f() { print a; var a = "local"; print a; { var a = "inner"; print a; } print a; }
+f();
+print a;
+fun adders() {
+  var x = 1;
+  fun add(y) { x = x + y; return x; }
+  return add;
+}
+var p = adders(); var q = adders();
+p(10); print p(1); print q(1);
+`,
+}
+
+func TestEmitGo(t *testing.T) {
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command to build the programs with")
+	}
+	root, err := filepath.Abs(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The programs are built in a module of their own, using this one.
+	dir := t.TempDir()
+	mod := "module emitted\n\ngo 1.16\n\nrequire private/lox v0.0.0\n\nreplace private/lox => " + root + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "go.mod"), []byte(mod), 0666); err != nil {
+		t.Fatal(err)
+	}
+	programs := make(map[string]string)
+	for name, src := range watPrograms {
+		programs[name] = src
+	}
+	for name, src := range goPrograms {
+		programs[name] = src
+	}
+	for name, src := range programs {
+		t.Run(name, func(t *testing.T) {
+			p, diags := Compile([]byte(src))
+			if diags != nil {
+				t.Fatal(diags)
+			}
+			out, err := p.Emit("go", name+".lox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if formatted, err := format.Source(out); err != nil || !bytes.Equal(formatted, out) {
+				t.Errorf("output isn't gofmt'ed: %v\n%s", err, out)
+			}
+			pkg := filepath.Join(dir, filepath.Base(t.Name()))
+			if err := os.Mkdir(pkg, 0777); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(pkg, "main.go"), out, 0666); err != nil {
+				t.Fatal(err)
+			}
+			bin := filepath.Join(pkg, "prog")
+			build := exec.Command(gobin, "build", "-o", bin, ".")
+			build.Dir = pkg
+			build.Env = append(os.Environ(), "GOFLAGS=-mod=mod", "GOWORK=off")
+			if msg, err := build.CombinedOutput(); err != nil {
+				t.Fatalf("%v\n%s\n%s", err, msg, out)
+			}
+			got, err := exec.Command(bin).CombinedOutput()
+			// Programs exit with 70 when a statement failed.
+			var exit *exec.ExitError
+			if err != nil && !(errors.As(err, &exit) && exit.ExitCode() == 70) {
+				t.Fatalf("%v\n%s", err, got)
+			}
+
+			caps, err := ParseCapabilities("time")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			vm := NewVM(Stdout(&want), Stderr(&want), Allow(caps))
+			vm.Run(context.Background(), p)
+			if string(got) != want.String() {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want.String())
+			}
+		})
+	}
+}
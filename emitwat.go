@@ -0,0 +1,1205 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// watEmitter translates resolved statements into a WebAssembly text module.
+//
+// Values are pointers to objects in linear memory, allocated with a bump
+// allocator and never freed:
+//
+//	nil     {tag 0}
+//	bool    {tag 1, 0 or 1}
+//	number  {tag 2, _, f64}
+//	string  {tag 3, length, bytes...}
+//	closure {tag 4, table index, arity, environment, name or 0 for natives}
+//
+// Local scopes are frames of {parent, slots...}, like environment. Each
+// top-level statement is a function of its own, so the host can report a
+// runtime error and go on with the next one, like interpreter does. Calls
+// returned from functions use return_call_indirect of the tail call
+// extension, so they don't go deeper either.
+//
+// The module imports from "lox":
+//
+//	print(ptr, len i32)          prints a line of UTF-8
+//	print_number(f64)            prints a number and a newline
+//	error(line, ptr, len i32)    reports a runtime error, the module traps next
+//	clock() f64                  seconds since some epoch
+//
+// and exports its "memory", the number of "statements" and "run", which runs
+// the statement with the given index.
+type watEmitter struct {
+	fn    *watFunc
+	funcs []*watFunc
+	// top-level statements come first in the function table
+	nstmts int
+	data   bytes.Buffer
+	consts map[string]int
+	// global variables and the arities of called functions
+	globals map[string]bool
+	arities map[int]bool
+	labels  int
+}
+
+type watFunc struct {
+	name   string
+	params int
+	lox    bool
+	body   bytes.Buffer
+	calls  int
+	indent int
+}
+
+const (
+	watNil   = 16
+	watTrue  = 24
+	watFalse = 32
+	watData  = 40
+)
+
+// watStrings are the strings the runtime needs, by their global names.
+var watStrings = map[string]string{
+	"str_nil":      "nil",
+	"str_true":     "true",
+	"str_false":    "false",
+	"str_native":   "<native fn>",
+	"str_fn":       "<fn ",
+	"str_gt":       ">",
+	"str_empty":    "",
+	"msg_operand":  "operand must be a number",
+	"msg_operands": "operands must be numbers",
+	"msg_add":      "both operands must be either strings or numbers",
+	"msg_callable": "can only call functions and classes",
+	"msg_expected": "expected ",
+	"msg_got":      " arguments but got ",
+	"msg_overflow": "stack overflow",
+	"msg_nomemory": "out of memory",
+}
+
+// emitWat returns a WebAssembly text module doing what stmts do.
+func emitWat(stmts []stmt, source string) ([]byte, *Error) {
+	g := &watEmitter{
+		consts:  make(map[string]int),
+		globals: map[string]bool{"clock": true},
+		arities: map[int]bool{0: true},
+	}
+	// nil, true and false
+	g.data.Write(make([]byte, watData-watNil))
+	binary.LittleEndian.PutUint32(g.data.Bytes()[watTrue-watNil:], 1)
+	binary.LittleEndian.PutUint32(g.data.Bytes()[watTrue-watNil+4:], 1)
+	binary.LittleEndian.PutUint32(g.data.Bytes()[watFalse-watNil:], 1)
+
+	var top []stmt
+	for _, s := range stmts {
+		if _, k := s.(*testStmt); !k {
+			top = append(top, s)
+		}
+	}
+	g.nstmts = len(top)
+	var body []*watFunc
+	for n, s := range top {
+		g.fn = &watFunc{name: fmt.Sprintf("$s%d", n)}
+		body = append(body, g.fn)
+		if err := g.stmt(s); err != nil {
+			return nil, err
+		}
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, ";; Code generated by yalox from %s. DO NOT EDIT.\n\n", source)
+	out.WriteString("(module\n")
+	out.WriteString(`  (import "lox" "print" (func $host_print (param i32 i32)))
+  (import "lox" "print_number" (func $host_print_number (param f64)))
+  (import "lox" "error" (func $host_error (param i32 i32 i32)))
+  (import "lox" "clock" (func $host_clock (result f64)))
+`)
+	g.types(&out)
+
+	names := make([]string, 0, len(watStrings))
+	for n := range watStrings {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		fmt.Fprintf(&out, "  (global $%s i32 (i32.const %d))\n", n, g.str(watStrings[n]))
+	}
+	fmt.Fprintf(&out, "  (global $nil i32 (i32.const %d))\n", watNil)
+	fmt.Fprintf(&out, "  (global $true i32 (i32.const %d))\n", watTrue)
+	fmt.Fprintf(&out, "  (global $false i32 (i32.const %d))\n", watFalse)
+	fmt.Fprintf(&out, "  (global $maxdepth i32 (i32.const %d))\n", DefaultMaxDepth)
+	fmt.Fprintf(&out, "  (global $statements (export \"statements\") i32 (i32.const %d))\n", g.nstmts)
+	heap := watNil + g.data.Len()
+	fmt.Fprintf(&out, "  (global $hp (mut i32) (i32.const %d))\n", heap)
+	out.WriteString("  (global $depth (mut i32) (i32.const 0))\n")
+	globals := make([]string, 0, len(g.globals))
+	for n := range g.globals {
+		globals = append(globals, n)
+	}
+	sort.Strings(globals)
+	for _, n := range globals {
+		fmt.Fprintf(&out, "  (global $g_%s (mut i32) (i32.const 0))\n", n)
+	}
+
+	fmt.Fprintf(&out, "  (memory (export \"memory\") %d)\n", heap/65536+1)
+	fmt.Fprintf(&out, "  (data (i32.const %d) \"%s\")\n", watNil, watQuote(g.data.Bytes()))
+
+	native := g.nstmts + len(g.funcs)
+	fmt.Fprintf(&out, "  (table %d funcref)\n", native+1)
+	out.WriteString("  (elem (i32.const 0)")
+	for _, f := range append(body, g.funcs...) {
+		out.WriteString(" " + f.name)
+	}
+	out.WriteString(" $native_clock)\n")
+
+	out.WriteString(watRuntime)
+	fmt.Fprintf(&out, `
+  (func $init
+    i32.const %d
+    i32.const 0
+    i32.const 0
+    i32.const 0
+    call $closure
+    global.set $g_clock)
+  (start $init)
+`, native)
+
+	for _, f := range append(body, g.funcs...) {
+		f.write(&out)
+	}
+	out.WriteString(")\n")
+	return out.Bytes(), nil
+}
+
+func (g *watEmitter) types(out *bytes.Buffer) {
+	out.WriteString("  (type $stmt (func))\n")
+	var arities []int
+	for n := range g.arities {
+		arities = append(arities, n)
+	}
+	sort.Ints(arities)
+	for _, n := range arities {
+		fmt.Fprintf(out, "  (type $fn%d (func (param i32)%s (result i32)))\n", n, strings.Repeat(" (param i32)", n))
+	}
+}
+
+// write appends the function definition to out.
+func (f *watFunc) write(out *bytes.Buffer) {
+	if f.lox {
+		fmt.Fprintf(out, "  (func %s (type $fn%d) (param $clo i32)", f.name, f.params)
+		for i := 0; i < f.params; i++ {
+			fmt.Fprintf(out, " (param $a%d i32)", i)
+		}
+		out.WriteString(" (result i32)\n")
+	} else {
+		fmt.Fprintf(out, "  (func %s (type $stmt)\n", f.name)
+	}
+	out.WriteString("    (local $env i32) (local $t i32)")
+	for i := 1; i <= f.calls; i++ {
+		fmt.Fprintf(out, " (local $c%d i32)", i)
+	}
+	out.WriteString("\n")
+	out.Write(f.body.Bytes())
+	if f.lox {
+		out.WriteString("    global.get $nil\n")
+	}
+	out.WriteString("  )\n")
+}
+
+func watQuote(bs []byte) string {
+	var sb strings.Builder
+	for _, b := range bs {
+		if b >= 0x20 && b < 0x7f && b != '"' && b != '\\' {
+			sb.WriteByte(b)
+		} else {
+			fmt.Fprintf(&sb, "\\%02x", b)
+		}
+	}
+	return sb.String()
+}
+
+// object puts a constant object into the data segment and returns its address.
+func (g *watEmitter) object(obj []byte) int {
+	if addr, k := g.consts[string(obj)]; k {
+		return addr
+	}
+	addr := watNil + g.data.Len()
+	g.consts[string(obj)] = addr
+	g.data.Write(obj)
+	for g.data.Len()%8 != 0 {
+		g.data.WriteByte(0)
+	}
+	return addr
+}
+
+func (g *watEmitter) str(s string) int {
+	obj := make([]byte, 8, 8+len(s))
+	binary.LittleEndian.PutUint32(obj, 3)
+	binary.LittleEndian.PutUint32(obj[4:], uint32(len(s)))
+	return g.object(append(obj, s...))
+}
+
+func (g *watEmitter) number(f float64) int {
+	obj := make([]byte, 16)
+	binary.LittleEndian.PutUint32(obj, 2)
+	binary.LittleEndian.PutUint64(obj[8:], math.Float64bits(f))
+	return g.object(obj)
+}
+
+func (g *watEmitter) line(format string, args ...interface{}) {
+	g.fn.body.WriteString(strings.Repeat("  ", g.fn.indent+2))
+	fmt.Fprintf(&g.fn.body, format+"\n", args...)
+}
+
+func (g *watEmitter) label() string {
+	g.labels++
+	return fmt.Sprintf("$l%d", g.labels)
+}
+
+func (g *watEmitter) stmt(s stmt) *Error {
+	_, err := s.Accept(g)
+	return err
+}
+
+func (g *watEmitter) stmts(stmts []stmt) *Error {
+	for _, s := range stmts {
+		if err := g.stmt(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *watEmitter) expr(e expr) *Error {
+	_, err := e.Accept(g)
+	return err
+}
+
+// env pushes the address of the frame depth scopes up.
+func (g *watEmitter) env(depth int) {
+	g.line("local.get $env")
+	for ; depth > 0; depth-- {
+		g.line("i32.load")
+	}
+}
+
+func (g *watEmitter) global(name Token) string {
+	g.globals[string(name.Lexeme)] = true
+	return "$g_" + string(name.Lexeme)
+}
+
+var watbinaryops = map[int]string{
+	tokenPlus:         "$add",
+	tokenMinus:        "$sub",
+	tokenStar:         "$mul",
+	tokenSlash:        "$div",
+	tokenGreater:      "$gt",
+	tokenGreaterEqual: "$ge",
+	tokenLess:         "$lt",
+	tokenLessEqual:    "$le",
+}
+
+func (g *watEmitter) Visit(v interface{}) (interface{}, *Error) {
+	switch a := v.(type) {
+	case *expressionStmt:
+		if err := g.expr(a.Expr); err != nil {
+			return nil, err
+		}
+		g.line("drop")
+	case *printStmt:
+		if err := g.expr(a.Expr); err != nil {
+			return nil, err
+		}
+		g.line("call $print")
+	case *varStmt:
+		if a.Local {
+			g.env(0)
+		}
+		if a.Init != nil {
+			if err := g.expr(a.Init); err != nil {
+				return nil, err
+			}
+		} else {
+			g.line("global.get $nil")
+		}
+		if a.Local {
+			g.line("i32.store offset=%d", 4+4*a.Slot)
+		} else {
+			g.line("global.set %s", g.global(a.Name))
+		}
+	case *blockStmt:
+		if len(a.Names) > 0 {
+			g.line("local.get $env")
+			g.line("i32.const %d", len(a.Names))
+			g.line("call $frame")
+			g.line("local.set $env")
+		}
+		if err := g.stmts(a.Stmts); err != nil {
+			return nil, err
+		}
+		if len(a.Names) > 0 {
+			g.line("local.get $env")
+			g.line("i32.load")
+			g.line("local.set $env")
+		}
+	case *ifStmt:
+		if err := g.expr(a.Cond); err != nil {
+			return nil, err
+		}
+		g.line("call $truthy")
+		g.line("if")
+		g.fn.indent++
+		if err := g.stmt(a.Then); err != nil {
+			return nil, err
+		}
+		if a.Else != nil {
+			g.fn.indent--
+			g.line("else")
+			g.fn.indent++
+			if err := g.stmt(a.Else); err != nil {
+				return nil, err
+			}
+		}
+		g.fn.indent--
+		g.line("end")
+	case *whileStmt:
+		brk, cont := g.label(), g.label()
+		g.line("block %s", brk)
+		g.fn.indent++
+		g.line("loop %s", cont)
+		g.fn.indent++
+		if err := g.expr(a.Cond); err != nil {
+			return nil, err
+		}
+		g.line("call $truthy")
+		g.line("i32.eqz")
+		g.line("br_if %s", brk)
+		if err := g.stmt(a.Body); err != nil {
+			return nil, err
+		}
+		g.line("br %s", cont)
+		g.fn.indent--
+		g.line("end")
+		g.fn.indent--
+		g.line("end")
+	case *functionStmt:
+		if a.Local {
+			g.env(0)
+		}
+		f := &watFunc{name: fmt.Sprintf("$f%d", len(g.funcs)+1), params: len(a.Params), lox: true}
+		g.line("i32.const %d", g.nstmts+len(g.funcs))
+		g.funcs = append(g.funcs, f)
+		g.arities[f.params] = true
+		g.line("i32.const %d", f.params)
+		g.line("local.get $env")
+		g.line("i32.const %d", g.str(string(a.Name.Lexeme)))
+		g.line("call $closure")
+		if a.Local {
+			g.line("i32.store offset=%d", 4+4*a.Slot)
+		} else {
+			g.line("global.set %s", g.global(a.Name))
+		}
+
+		outer := g.fn
+		g.fn = f
+		g.line("local.get $clo")
+		g.line("i32.load offset=12")
+		if len(a.Names) > 0 {
+			g.line("i32.const %d", len(a.Names))
+			g.line("call $frame")
+		}
+		g.line("local.set $env")
+		if len(a.Names) > 0 {
+			for i := range a.Params {
+				g.env(0)
+				g.line("local.get $a%d", i)
+				g.line("i32.store offset=%d", 4+4*i)
+			}
+		}
+		err := g.stmts(a.Body)
+		g.fn = outer
+		if err != nil {
+			return nil, err
+		}
+	case *returnStmt:
+		if a.Value != nil {
+			if err := g.expr(a.Value); err != nil {
+				return nil, err
+			}
+		} else {
+			g.line("global.get $nil")
+		}
+		if g.fn.lox {
+			g.line("return")
+		} else {
+			// interpreter reports returning from top-level code like this.
+			g.line("drop")
+			g.line("i32.const 0")
+			g.line("global.get $str_empty")
+			g.line("call $fail")
+		}
+	case *testStmt:
+
+	case *literalExpr:
+		switch a.Val.Kind() {
+		case KindNil:
+			g.line("global.get $nil")
+		case KindBool:
+			if a.Val.Bool() {
+				g.line("global.get $true")
+			} else {
+				g.line("global.get $false")
+			}
+		case KindNumber:
+			g.line("i32.const %d", g.number(a.Val.Number()))
+		case KindString:
+			g.line("i32.const %d", g.str(string(a.Val.Bytes())))
+		default:
+			return nil, &Error{Token{}, "can't translate literal " + stringify(a.Val)}
+		}
+	case *groupingExpr:
+		return nil, g.expr(a.Expr)
+	case *unaryExpr:
+		if err := g.expr(a.Right); err != nil {
+			return nil, err
+		}
+		switch a.Op.Type {
+		case tokenMinus:
+			g.line("i32.const %d", a.Op.Line)
+			g.line("call $neg")
+		case tokenBang:
+			g.line("call $not")
+		default:
+			return nil, &Error{a.Op, "unknown unary operator"}
+		}
+	case *binaryExpr:
+		if err := g.expr(a.Left); err != nil {
+			return nil, err
+		}
+		if err := g.expr(a.Right); err != nil {
+			return nil, err
+		}
+		switch a.Op.Type {
+		case tokenEqualEqual:
+			g.line("call $equal")
+			g.line("call $bool")
+		case tokenBangEqual:
+			g.line("call $equal")
+			g.line("i32.eqz")
+			g.line("call $bool")
+		default:
+			fn, k := watbinaryops[a.Op.Type]
+			if !k {
+				return nil, &Error{a.Op, "unknown binary operator"}
+			}
+			g.line("i32.const %d", a.Op.Line)
+			g.line("call %s", fn)
+		}
+	case *logicalExpr:
+		if err := g.expr(a.Left); err != nil {
+			return nil, err
+		}
+		g.line("local.tee $t")
+		g.line("call $truthy")
+		switch a.Op.Type {
+		case tokenOr:
+			g.line("if (result i32)")
+			g.line("  local.get $t")
+			g.line("else")
+		case tokenAnd:
+			g.line("if (result i32)")
+		default:
+			return nil, &Error{a.Op, "unknown logical operator"}
+		}
+		g.fn.indent++
+		if err := g.expr(a.Right); err != nil {
+			return nil, err
+		}
+		g.fn.indent--
+		if a.Op.Type == tokenAnd {
+			g.line("else")
+			g.line("  local.get $t")
+		}
+		g.line("end")
+	case *variableExpr:
+		if a.Local {
+			g.env(a.Depth)
+			g.line("i32.load offset=%d", 4+4*a.Slot)
+		} else {
+			g.line("global.get %s", g.global(a.Name))
+			g.line("i32.const %d", a.Name.Line)
+			g.line("i32.const %d", g.str(fmt.Sprintf("undefined variable '%s'", a.Name.Lexeme)))
+			g.line("call $defined")
+		}
+	case *assignExpr:
+		if err := g.expr(a.Val); err != nil {
+			return nil, err
+		}
+		g.line("local.set $t")
+		if a.Local {
+			g.env(a.Depth)
+			g.line("local.get $t")
+			g.line("i32.store offset=%d", 4+4*a.Slot)
+		} else {
+			name := g.global(a.Name)
+			g.line("global.get %s", name)
+			g.line("i32.const %d", a.Name.Line)
+			g.line("i32.const %d", g.str(fmt.Sprintf("undefined variable '%s'", a.Name.Lexeme)))
+			g.line("call $defined")
+			g.line("drop")
+			g.line("local.get $t")
+			g.line("global.set %s", name)
+		}
+		g.line("local.get $t")
+	case *callExpr:
+		if err := g.expr(a.Callee); err != nil {
+			return nil, err
+		}
+		g.fn.calls++
+		c := fmt.Sprintf("$c%d", g.fn.calls)
+		g.line("local.tee %s", c)
+		for _, ar := range a.Args {
+			if err := g.expr(ar); err != nil {
+				return nil, err
+			}
+		}
+		g.arities[len(a.Args)] = true
+		g.line("local.get %s", c)
+		g.line("i32.const %d", len(a.Args))
+		g.line("i32.const %d", a.Paren.Line)
+		if a.Tail {
+			g.line("call $tail")
+			g.line("return_call_indirect (type $fn%d)", len(a.Args))
+		} else {
+			g.line("call $enter")
+			g.line("call_indirect (type $fn%d)", len(a.Args))
+			g.line("call $leave")
+		}
+	case *getExpr:
+		// Only objects of the host have properties.
+		return nil, &Error{a.Name, "can't translate property access to WebAssembly"}
+	case *setExpr:
+		return nil, &Error{a.Name, "can't translate property access to WebAssembly"}
+	default:
+		return nil, &Error{Token{}, fmt.Sprintf("can't translate %T to WebAssembly", v)}
+	}
+	return nil, nil
+}
+
+var _ = visitor(&watEmitter{})
+
+// watRuntime implements the operations on values.
+const watRuntime = `
+  (func $alloc (param $n i32) (result i32) (local $p i32)
+    global.get $hp
+    local.set $p
+    global.get $hp
+    local.get $n
+    i32.const 7
+    i32.add
+    i32.const -8
+    i32.and
+    i32.add
+    global.set $hp
+    block $ok
+      global.get $hp
+      memory.size
+      i32.const 16
+      i32.shl
+      i32.le_u
+      br_if $ok
+      global.get $hp
+      memory.size
+      i32.const 16
+      i32.shl
+      i32.sub
+      i32.const 16
+      i32.shr_u
+      i32.const 1
+      i32.add
+      memory.grow
+      i32.const -1
+      i32.ne
+      br_if $ok
+      i32.const 0
+      global.get $msg_nomemory
+      call $fail
+    end
+    local.get $p)
+
+  (func $fail (param $line i32) (param $msg i32)
+    local.get $line
+    local.get $msg
+    i32.const 8
+    i32.add
+    local.get $msg
+    i32.load offset=4
+    call $host_error
+    unreachable)
+
+  (func $defined (param $v i32) (param $line i32) (param $msg i32) (result i32)
+    local.get $v
+    i32.eqz
+    if
+      local.get $line
+      local.get $msg
+      call $fail
+    end
+    local.get $v)
+
+  (func $frame (param $parent i32) (param $n i32) (result i32) (local $p i32) (local $i i32)
+    local.get $n
+    i32.const 2
+    i32.shl
+    i32.const 4
+    i32.add
+    call $alloc
+    local.tee $p
+    local.get $parent
+    i32.store
+    block $done
+      loop $fill
+        local.get $i
+        local.get $n
+        i32.ge_u
+        br_if $done
+        local.get $p
+        local.get $i
+        i32.const 2
+        i32.shl
+        i32.add
+        global.get $nil
+        i32.store offset=4
+        local.get $i
+        i32.const 1
+        i32.add
+        local.set $i
+        br $fill
+      end
+    end
+    local.get $p)
+
+  (func $closure (param $idx i32) (param $arity i32) (param $env i32) (param $name i32) (result i32) (local $p i32)
+    i32.const 20
+    call $alloc
+    local.tee $p
+    i32.const 4
+    i32.store
+    local.get $p
+    local.get $idx
+    i32.store offset=4
+    local.get $p
+    local.get $arity
+    i32.store offset=8
+    local.get $p
+    local.get $env
+    i32.store offset=12
+    local.get $p
+    local.get $name
+    i32.store offset=16
+    local.get $p)
+
+  (func $native_clock (type $fn0) (param $clo i32) (result i32)
+    call $host_clock
+    call $num)
+
+  (func $num (param $f f64) (result i32) (local $p i32)
+    i32.const 16
+    call $alloc
+    local.tee $p
+    i32.const 2
+    i32.store
+    local.get $p
+    local.get $f
+    f64.store offset=8
+    local.get $p)
+
+  (func $bool (param $b i32) (result i32)
+    global.get $true
+    global.get $false
+    local.get $b
+    select)
+
+  (func $truthy (param $v i32) (result i32)
+    local.get $v
+    i32.load
+    i32.const 1
+    i32.eq
+    if (result i32)
+      local.get $v
+      i32.load offset=4
+    else
+      local.get $v
+      i32.load
+      i32.const 0
+      i32.ne
+    end)
+
+  (func $not (param $v i32) (result i32)
+    local.get $v
+    call $truthy
+    i32.eqz
+    call $bool)
+
+  (func $equal (param $a i32) (param $b i32) (result i32) (local $i i32)
+    local.get $a
+    i32.load
+    local.get $b
+    i32.load
+    i32.ne
+    if
+      i32.const 0
+      return
+    end
+    block $other
+      block $string
+        block $number
+          block $bool
+            block $nil
+              local.get $a
+              i32.load
+              br_table $nil $bool $number $string $other
+            end
+            i32.const 1
+            return
+          end
+          local.get $a
+          i32.load offset=4
+          local.get $b
+          i32.load offset=4
+          i32.eq
+          return
+        end
+        local.get $a
+        f64.load offset=8
+        local.get $b
+        f64.load offset=8
+        f64.eq
+        return
+      end
+      local.get $a
+      i32.load offset=4
+      local.get $b
+      i32.load offset=4
+      i32.ne
+      if
+        i32.const 0
+        return
+      end
+      block $done
+        loop $bytes
+          local.get $i
+          local.get $a
+          i32.load offset=4
+          i32.ge_u
+          br_if $done
+          local.get $a
+          local.get $i
+          i32.add
+          i32.load8_u offset=8
+          local.get $b
+          local.get $i
+          i32.add
+          i32.load8_u offset=8
+          i32.ne
+          if
+            i32.const 0
+            return
+          end
+          local.get $i
+          i32.const 1
+          i32.add
+          local.set $i
+          br $bytes
+        end
+      end
+      i32.const 1
+      return
+    end
+    local.get $a
+    local.get $b
+    i32.eq)
+
+  (func $concat (param $a i32) (param $b i32) (result i32) (local $p i32)
+    local.get $a
+    i32.load offset=4
+    local.get $b
+    i32.load offset=4
+    i32.add
+    i32.const 8
+    i32.add
+    call $alloc
+    local.tee $p
+    i32.const 3
+    i32.store
+    local.get $p
+    local.get $a
+    i32.load offset=4
+    local.get $b
+    i32.load offset=4
+    i32.add
+    i32.store offset=4
+    local.get $p
+    i32.const 8
+    i32.add
+    local.get $a
+    i32.const 8
+    i32.add
+    local.get $a
+    i32.load offset=4
+    memory.copy
+    local.get $p
+    i32.const 8
+    i32.add
+    local.get $a
+    i32.load offset=4
+    i32.add
+    local.get $b
+    i32.const 8
+    i32.add
+    local.get $b
+    i32.load offset=4
+    memory.copy
+    local.get $p)
+
+  (func $itoa (param $n i32) (result i32) (local $p i32) (local $i i32)
+    i32.const 18
+    call $alloc
+    local.tee $p
+    i32.const 3
+    i32.store
+    i32.const 18
+    local.set $i
+    loop $digits
+      local.get $p
+      local.get $i
+      i32.const 1
+      i32.sub
+      local.tee $i
+      i32.add
+      local.get $n
+      i32.const 10
+      i32.rem_u
+      i32.const 48
+      i32.add
+      i32.store8
+      local.get $n
+      i32.const 10
+      i32.div_u
+      local.tee $n
+      br_if $digits
+    end
+    local.get $p
+    i32.const 8
+    i32.add
+    local.get $p
+    local.get $i
+    i32.add
+    i32.const 18
+    local.get $i
+    i32.sub
+    memory.copy
+    local.get $p
+    i32.const 18
+    local.get $i
+    i32.sub
+    i32.store offset=4
+    local.get $p)
+
+  (func $isnumber (param $v i32) (result i32)
+    local.get $v
+    i32.load
+    i32.const 2
+    i32.eq)
+
+  (func $neg (param $v i32) (param $line i32) (result i32)
+    local.get $v
+    call $isnumber
+    i32.eqz
+    if
+      local.get $line
+      global.get $msg_operand
+      call $fail
+    end
+    local.get $v
+    f64.load offset=8
+    f64.neg
+    call $num)
+
+  (func $numbers (param $a i32) (param $b i32) (param $line i32)
+    local.get $a
+    call $isnumber
+    local.get $b
+    call $isnumber
+    i32.and
+    i32.eqz
+    if
+      local.get $line
+      global.get $msg_operands
+      call $fail
+    end)
+
+  (func $add (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    call $isnumber
+    local.get $b
+    call $isnumber
+    i32.and
+    if
+      local.get $a
+      f64.load offset=8
+      local.get $b
+      f64.load offset=8
+      f64.add
+      call $num
+      return
+    end
+    local.get $a
+    i32.load
+    i32.const 3
+    i32.eq
+    local.get $b
+    i32.load
+    i32.const 3
+    i32.eq
+    i32.and
+    if
+      local.get $a
+      local.get $b
+      call $concat
+      return
+    end
+    local.get $line
+    global.get $msg_add
+    call $fail
+    unreachable)
+
+  (func $sub (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.sub
+    call $num)
+
+  (func $mul (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.mul
+    call $num)
+
+  (func $div (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.div
+    call $num)
+
+  (func $gt (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.gt
+    call $bool)
+
+  (func $ge (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.ge
+    call $bool)
+
+  (func $lt (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.lt
+    call $bool)
+
+  (func $le (param $a i32) (param $b i32) (param $line i32) (result i32)
+    local.get $a
+    local.get $b
+    local.get $line
+    call $numbers
+    local.get $a
+    f64.load offset=8
+    local.get $b
+    f64.load offset=8
+    f64.le
+    call $bool)
+
+  (func $print (param $v i32)
+    block $closure
+      block $string
+        block $number
+          block $bool
+            block $nil
+              local.get $v
+              i32.load
+              br_table $nil $bool $number $string $closure
+            end
+            global.get $str_nil
+            call $print_string
+            return
+          end
+          global.get $str_true
+          global.get $str_false
+          local.get $v
+          i32.load offset=4
+          select
+          call $print_string
+          return
+        end
+        local.get $v
+        f64.load offset=8
+        call $host_print_number
+        return
+      end
+      local.get $v
+      call $print_string
+      return
+    end
+    local.get $v
+    i32.load offset=16
+    i32.eqz
+    if
+      global.get $str_native
+      call $print_string
+      return
+    end
+    global.get $str_fn
+    local.get $v
+    i32.load offset=16
+    call $concat
+    global.get $str_gt
+    call $concat
+    call $print_string)
+
+  (func $print_string (param $s i32)
+    local.get $s
+    i32.const 8
+    i32.add
+    local.get $s
+    i32.load offset=4
+    call $host_print)
+
+  ;; enter checks a call and returns the table index of the callee.
+  (func $check (param $v i32) (param $n i32) (param $line i32)
+    local.get $v
+    i32.load
+    i32.const 4
+    i32.ne
+    if
+      local.get $line
+      global.get $msg_callable
+      call $fail
+    end
+    local.get $v
+    i32.load offset=8
+    local.get $n
+    i32.ne
+    if
+      local.get $line
+      global.get $msg_expected
+      local.get $v
+      i32.load offset=8
+      call $itoa
+      call $concat
+      global.get $msg_got
+      call $concat
+      local.get $n
+      call $itoa
+      call $concat
+      call $fail
+    end)
+
+  (func $deep (param $line i32)
+    global.get $depth
+    global.get $maxdepth
+    i32.ge_u
+    if
+      local.get $line
+      global.get $msg_overflow
+      call $fail
+    end)
+
+  (func $enter (param $v i32) (param $n i32) (param $line i32) (result i32)
+    local.get $v
+    local.get $n
+    local.get $line
+    call $check
+    local.get $line
+    call $deep
+    global.get $depth
+    i32.const 1
+    i32.add
+    global.set $depth
+    local.get $v
+    i32.load offset=4)
+
+  ;; tail is enter for calls returned from functions, which take the place of
+  ;; the caller. Natives don't, so they are as deep as other calls.
+  (func $tail (param $v i32) (param $n i32) (param $line i32) (result i32)
+    local.get $v
+    local.get $n
+    local.get $line
+    call $check
+    local.get $v
+    i32.load offset=16
+    i32.eqz
+    if
+      local.get $line
+      call $deep
+    end
+    local.get $v
+    i32.load offset=4)
+
+  (func $leave (param $v i32) (result i32)
+    global.get $depth
+    i32.const 1
+    i32.sub
+    global.set $depth
+    local.get $v)
+
+  (func $run (export "run") (param $i i32)
+    i32.const 0
+    global.set $depth
+    local.get $i
+    call_indirect (type $stmt))
+`
@@ -0,0 +1,640 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var watPrograms = map[string]string{
+	"values": `
+print 1 + 2 * 3;
+print "a" + "b" == "ab";
+print "ab" != "ac";
+print nil == false;
+print -0;
+print 1/0;
+print 0.5 - 1000000;
+print 1234567;
+print 0.00001;
+print nil or "x";
+print 1 and nil;
+print !nil;
+print clock() > 0;
+print clock;
+`,
+	"scopes": `
+var x = "global";
+{ var a = 1; { var b = a + 1; print b; a = 10; } print a; }
+var s = ""; var i = 0;
+while (i < 5) { s = s + "x"; i = i + 1; }
+print s;
+for (var j = 0; j < 3; j = j + 1) if (j == 1) print "one"; else print j;
+print x;
+`,
+	"functions": `
+fun fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); }
+print fib(20);
+fun counter() { var c = 0; fun inc() { c = c + 1; return c; } return inc; }
+var c1 = counter(); c1(); print c1();
+fun f(a, b) { return a; }
+print f;
+fun g() {}
+print g();
+`,
+	"tail calls": `
+fun loop(n, acc) { if (n == 0) return acc; return loop(n - 1, acc + 1); }
+print loop(100000, 0);
+fun even(n) { if (n == 0) return true; return odd(n - 1); }
+fun odd(n) { if (n == 0) return false; return (even(n - 1)); }
+print even(100001);
+fun bad() { return nope(1); }
+bad();
+fun arity(a) { return arity(); }
+arity(1);
+fun now() { return clock(); }
+print now() > 0;
+`,
+	"errors": `
+print y;
+print 1 + "a";
+var x = 3;
+x();
+fun f(a) { return a; }
+f(1, 2);
+print -"a";
+fun deep(n) { return 1 + deep(n + 1); }
+deep(0);
+print "after";
+`,
+}
+
+func TestEmitWat(t *testing.T) {
+	node, _ := exec.LookPath("node")
+	for name, src := range watPrograms {
+		t.Run(name, func(t *testing.T) {
+			p, diags := Compile([]byte(src))
+			if diags != nil {
+				t.Fatal(diags)
+			}
+			wat, err := p.Emit("wat", name+".lox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			wasm, err := assembleWat(wat)
+			if err != nil {
+				t.Fatalf("%v\n%s", err, wat)
+			}
+			if node == "" {
+				t.Skip("no node to run the module with")
+			}
+			dir := t.TempDir()
+			mod, host := filepath.Join(dir, name+".wasm"), filepath.Join(dir, "host.js")
+			if err := ioutil.WriteFile(mod, wasm, 0666); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(host, []byte(watHost), 0666); err != nil {
+				t.Fatal(err)
+			}
+			got, err := exec.Command(node, host, mod).CombinedOutput()
+			if err != nil {
+				t.Fatalf("%v\n%s", err, got)
+			}
+
+			// Modules always have a clock.
+			caps, err := ParseCapabilities("time")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			vm := NewVM(Stdout(&want), Stderr(&want), Allow(caps))
+			vm.Run(context.Background(), p)
+			if string(got) != want.String() {
+				t.Errorf("got:\n%s\nwant:\n%s", got, want.String())
+			}
+		})
+	}
+}
+
+// watHost runs a module with the imports emitWat expects, reporting errors
+// like VM does.
+const watHost = `
+const fs = require('fs');
+const dec = new TextDecoder();
+let mem, err;
+// Like Go's fmt.Sprint.
+function format(f) {
+  if (Number.isNaN(f)) return 'NaN';
+  if (f === Infinity) return '+Inf';
+  if (f === -Infinity) return '-Inf';
+  if (f === 0) return Object.is(f, -0) ? '-0' : '0';
+  const e = Math.floor(Math.log10(Math.abs(f)));
+  if (e < -4 || e >= 6) {
+    return f.toExponential().replace(/e([+-])(\d)$/, 'e$10$2');
+  }
+  return String(f);
+}
+const imports = {lox: {
+  print: (p, n) => console.log(dec.decode(new Uint8Array(mem.buffer, p, n))),
+  print_number: f => console.log(format(f)),
+  error: (line, p, n) => { err = 'at line ' + line + ': ' + dec.decode(new Uint8Array(mem.buffer, p, n)); },
+  clock: () => Date.now() / 1000,
+}};
+const inst = new WebAssembly.Instance(new WebAssembly.Module(fs.readFileSync(process.argv[2])), imports);
+mem = inst.exports.memory;
+for (let i = 0; i < inst.exports.statements.value; i++) {
+  err = null;
+  try {
+    inst.exports.run(i);
+  } catch (e) {
+    console.log(err !== null ? err : 'trap: ' + e.message);
+  }
+}
+`
+
+// sexpr is an atom or a list of a WebAssembly text module.
+type sexpr struct {
+	atom string
+	list []*sexpr
+}
+
+func (s *sexpr) is(head string) bool {
+	return len(s.list) > 0 && s.list[0].atom == head
+}
+
+func parseWat(src string) (*sexpr, error) {
+	var toks []string
+	for i := 0; i < len(src); {
+		switch c := src[i]; {
+		case strings.HasPrefix(src[i:], ";;"):
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case c == ' ' || c == '\n' || c == '\t':
+			i++
+		case c == '(' || c == ')':
+			toks = append(toks, src[i:i+1])
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(src) && src[j] != '"'; j++ {
+				if src[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(src) {
+				return nil, fmt.Errorf("unterminated string")
+			}
+			toks = append(toks, src[i:j+1])
+			i = j + 1
+		default:
+			j := i
+			for j < len(src) && !strings.ContainsRune(" \n\t()", rune(src[j])) {
+				j++
+			}
+			toks = append(toks, src[i:j])
+			i = j
+		}
+	}
+	var parse func() (*sexpr, error)
+	parse = func() (*sexpr, error) {
+		if len(toks) == 0 {
+			return nil, fmt.Errorf("unexpected end of module")
+		}
+		tok := toks[0]
+		toks = toks[1:]
+		switch tok {
+		case ")":
+			return nil, fmt.Errorf("unexpected ')'")
+		case "(":
+			s := &sexpr{}
+			for len(toks) > 0 && toks[0] != ")" {
+				e, err := parse()
+				if err != nil {
+					return nil, err
+				}
+				s.list = append(s.list, e)
+			}
+			if len(toks) == 0 {
+				return nil, fmt.Errorf("missing ')'")
+			}
+			toks = toks[1:]
+			return s, nil
+		}
+		return &sexpr{atom: tok}, nil
+	}
+	mod, err := parse()
+	if err == nil && len(toks) > 0 {
+		err = fmt.Errorf("%q after the module", toks[0])
+	}
+	if err == nil && !mod.is("module") {
+		err = fmt.Errorf("not a module")
+	}
+	return mod, err
+}
+
+func watString(s string) []byte {
+	var out []byte
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			panic(fmt.Errorf("bad escape in %s", s))
+		}
+		out = append(out, byte(b))
+		i += 2
+	}
+	return out
+}
+
+func uleb(n uint64) []byte {
+	var b []byte
+	for ; n >= 0x80; n >>= 7 {
+		b = append(b, byte(n)|0x80)
+	}
+	return append(b, byte(n))
+}
+
+func sleb(n int64) []byte {
+	var b []byte
+	for {
+		c := byte(n & 0x7f)
+		n >>= 7
+		if (n == 0 && c&0x40 == 0) || (n == -1 && c&0x40 != 0) {
+			return append(b, c)
+		}
+		b = append(b, c|0x80)
+	}
+}
+
+func wasmName(s string) []byte {
+	bs := watString(s)
+	return append(uleb(uint64(len(bs))), bs...)
+}
+
+func wasmVec(items [][]byte) []byte {
+	out := uleb(uint64(len(items)))
+	for _, it := range items {
+		out = append(out, it...)
+	}
+	return out
+}
+
+var wasmTypes = map[string]byte{"i32": 0x7f, "i64": 0x7e, "f32": 0x7d, "f64": 0x7c}
+
+func wasmType(s *sexpr) byte {
+	t, k := wasmTypes[s.atom]
+	if !k {
+		panic(fmt.Errorf("unknown value type %q", s.atom))
+	}
+	return t
+}
+
+var wasmOps = map[string]byte{
+	"unreachable": 0x00, "else": 0x05, "return": 0x0f, "drop": 0x1a, "select": 0x1b,
+	"i32.eqz": 0x45, "i32.eq": 0x46, "i32.ne": 0x47, "i32.lt_s": 0x48, "i32.lt_u": 0x49,
+	"i32.gt_s": 0x4a, "i32.gt_u": 0x4b, "i32.le_s": 0x4c, "i32.le_u": 0x4d, "i32.ge_s": 0x4e,
+	"i32.ge_u": 0x4f, "f64.eq": 0x61, "f64.ne": 0x62, "f64.lt": 0x63, "f64.gt": 0x64,
+	"f64.le": 0x65, "f64.ge": 0x66, "i32.add": 0x6a, "i32.sub": 0x6b, "i32.mul": 0x6c,
+	"i32.div_s": 0x6d, "i32.div_u": 0x6e, "i32.rem_s": 0x6f, "i32.rem_u": 0x70, "i32.and": 0x71,
+	"i32.or": 0x72, "i32.xor": 0x73, "i32.shl": 0x74, "i32.shr_s": 0x75, "i32.shr_u": 0x76,
+	"f64.neg": 0x9a, "f64.add": 0xa0, "f64.sub": 0xa1, "f64.mul": 0xa2, "f64.div": 0xa3,
+}
+
+// wasmMemOps are the opcodes and alignments of loads and stores.
+var wasmMemOps = map[string][2]byte{
+	"i32.load": {0x28, 2}, "f64.load": {0x2b, 3}, "i32.load8_u": {0x2d, 0},
+	"i32.store": {0x36, 2}, "f64.store": {0x39, 3}, "i32.store8": {0x3a, 0},
+}
+
+// wasmSig is the type of a function.
+type wasmSig struct {
+	params, results []byte
+	names           []string
+}
+
+func (s wasmSig) encode() []byte {
+	b := append([]byte{0x60}, uleb(uint64(len(s.params)))...)
+	b = append(b, s.params...)
+	b = append(b, uleb(uint64(len(s.results)))...)
+	return append(b, s.results...)
+}
+
+// watAssembler turns the subset of the text format emitWat writes into a
+// binary module, failing on any name or instruction it doesn't know.
+type watAssembler struct {
+	types   []wasmSig
+	typeIdx map[string]int
+	funcs   map[string]int
+	globals map[string]int
+}
+
+func (a *watAssembler) index(names map[string]int, s *sexpr) int {
+	if n, k := names[s.atom]; k {
+		return n
+	}
+	panic(fmt.Errorf("undefined %s", s.atom))
+}
+
+// sig reads the type, param and result clauses of a function.
+func (a *watAssembler) sig(items []*sexpr) (wasmSig, int) {
+	var s wasmSig
+	typ := -1
+	for _, it := range items {
+		if it.list == nil {
+			// the body
+			break
+		}
+		switch {
+		case it.is("type"):
+			typ = a.index(a.typeIdx, it.list[1])
+		case it.is("param"):
+			if rest := it.list[1:]; strings.HasPrefix(rest[0].atom, "$") {
+				s.names = append(s.names, rest[0].atom)
+				s.params = append(s.params, wasmType(rest[1]))
+			} else {
+				for _, r := range rest {
+					s.names = append(s.names, "")
+					s.params = append(s.params, wasmType(r))
+				}
+			}
+		case it.is("result"):
+			for _, r := range it.list[1:] {
+				s.results = append(s.results, wasmType(r))
+			}
+		}
+	}
+	if typ >= 0 {
+		t := a.types[typ]
+		if s.params != nil && string(s.encode()) != string(t.encode()) {
+			panic(fmt.Errorf("function doesn't match its type"))
+		}
+		return s, typ
+	}
+	for i, t := range a.types {
+		if string(s.encode()) == string(t.encode()) {
+			return s, i
+		}
+	}
+	a.types = append(a.types, s)
+	return s, len(a.types) - 1
+}
+
+func (a *watAssembler) code(items []*sexpr, s wasmSig) []byte {
+	locals := make(map[string]int)
+	for i, n := range s.names {
+		locals[n] = i
+	}
+	var types []byte
+	var instrs []*sexpr
+	for _, it := range items {
+		switch {
+		case it.is("local"):
+			locals[it.list[1].atom] = len(s.params) + len(types)
+			types = append(types, wasmType(it.list[2]))
+		case it.list == nil:
+			instrs = append(instrs, it)
+		case len(instrs) > 0:
+			// (result) of a block
+			instrs = append(instrs, it)
+		}
+	}
+	var labels []string
+	label := func(s *sexpr) []byte {
+		for d := len(labels) - 1; d >= 0; d-- {
+			if labels[d] == s.atom {
+				return uleb(uint64(len(labels) - 1 - d))
+			}
+		}
+		panic(fmt.Errorf("undefined label %s", s.atom))
+	}
+	var body []byte
+	for i := 0; i < len(instrs); i++ {
+		op := instrs[i].atom
+		next := func() *sexpr {
+			i++
+			if i == len(instrs) {
+				panic(fmt.Errorf("%s needs an operand", op))
+			}
+			return instrs[i]
+		}
+		switch op {
+		case "block", "loop", "if":
+			l, bt := "", byte(0x40)
+			if i+1 < len(instrs) && strings.HasPrefix(instrs[i+1].atom, "$") {
+				l = next().atom
+			}
+			if i+1 < len(instrs) && instrs[i+1].is("result") {
+				bt = wasmType(next().list[1])
+			}
+			labels = append(labels, l)
+			body = append(body, map[string]byte{"block": 0x02, "loop": 0x03, "if": 0x04}[op], bt)
+		case "end":
+			if len(labels) == 0 {
+				panic(fmt.Errorf("unbalanced end"))
+			}
+			labels = labels[:len(labels)-1]
+			body = append(body, 0x0b)
+		case "br":
+			body = append(append(body, 0x0c), label(next())...)
+		case "br_if":
+			body = append(append(body, 0x0d), label(next())...)
+		case "br_table":
+			var ls [][]byte
+			for i+1 < len(instrs) && strings.HasPrefix(instrs[i+1].atom, "$") {
+				ls = append(ls, label(next()))
+			}
+			body = append(body, 0x0e)
+			body = append(body, uleb(uint64(len(ls)-1))...)
+			for _, l := range ls {
+				body = append(body, l...)
+			}
+		case "call":
+			body = append(append(body, 0x10), uleb(uint64(a.index(a.funcs, next())))...)
+		case "call_indirect", "return_call_indirect":
+			t := next()
+			if !t.is("type") {
+				panic(fmt.Errorf("%s needs a type", op))
+			}
+			body = append(body, map[string]byte{"call_indirect": 0x11, "return_call_indirect": 0x13}[op])
+			body = append(body, uleb(uint64(a.index(a.typeIdx, t.list[1])))...)
+			body = append(body, 0)
+		case "local.get", "local.set", "local.tee":
+			body = append(body, map[string]byte{"local.get": 0x20, "local.set": 0x21, "local.tee": 0x22}[op])
+			body = append(body, uleb(uint64(a.index(locals, next())))...)
+		case "global.get", "global.set":
+			body = append(body, map[string]byte{"global.get": 0x23, "global.set": 0x24}[op])
+			body = append(body, uleb(uint64(a.index(a.globals, next())))...)
+		case "i32.const":
+			n, err := strconv.ParseInt(next().atom, 0, 32)
+			if err != nil {
+				panic(err)
+			}
+			body = append(append(body, 0x41), sleb(n)...)
+		case "memory.size":
+			body = append(body, 0x3f, 0)
+		case "memory.grow":
+			body = append(body, 0x40, 0)
+		case "memory.copy":
+			body = append(body, 0xfc, 10, 0, 0)
+		default:
+			if m, k := wasmMemOps[op]; k {
+				off := 0
+				if i+1 < len(instrs) && strings.HasPrefix(instrs[i+1].atom, "offset=") {
+					off, _ = strconv.Atoi(strings.TrimPrefix(next().atom, "offset="))
+				}
+				body = append(append(body, m[0], m[1]), uleb(uint64(off))...)
+			} else if c, k := wasmOps[op]; k {
+				body = append(body, c)
+			} else {
+				panic(fmt.Errorf("unknown instruction %q", op))
+			}
+		}
+	}
+	if len(labels) > 0 {
+		panic(fmt.Errorf("unterminated block"))
+	}
+	var decls [][]byte
+	for _, t := range types {
+		decls = append(decls, []byte{1, t})
+	}
+	out := append(wasmVec(decls), append(body, 0x0b)...)
+	return append(uleb(uint64(len(out))), out...)
+}
+
+func wasmConst(s *sexpr) []byte {
+	if !s.is("i32.const") {
+		panic(fmt.Errorf("not a constant"))
+	}
+	n, err := strconv.ParseInt(s.list[1].atom, 0, 32)
+	if err != nil {
+		panic(err)
+	}
+	return append(append([]byte{0x41}, sleb(n)...), 0x0b)
+}
+
+func wasmSection(id byte, items [][]byte) []byte {
+	content := wasmVec(items)
+	return append(append([]byte{id}, uleb(uint64(len(content)))...), content...)
+}
+
+// assembleWat returns the binary module of wat.
+func assembleWat(wat []byte) (wasm []byte, err error) {
+	mod, err := parseWat(string(wat))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	a := &watAssembler{typeIdx: make(map[string]int), funcs: make(map[string]int), globals: make(map[string]int)}
+	fields := mod.list[1:]
+	for _, f := range fields {
+		if f.is("type") {
+			_, t := a.sig(f.list[2].list[1:])
+			a.typeIdx[f.list[1].atom] = t
+		}
+	}
+	var imports, funcs, tables, mems, globals, exports, elems, codes, datas [][]byte
+	var start []byte
+	// Imported functions come first.
+	for _, f := range fields {
+		if f.is("import") {
+			fn := f.list[3]
+			_, t := a.sig(fn.list[2:])
+			a.funcs[fn.list[1].atom] = len(a.funcs)
+			imp := append(wasmName(f.list[1].atom), wasmName(f.list[2].atom)...)
+			imports = append(imports, append(append(imp, 0), uleb(uint64(t))...))
+		}
+	}
+	for _, f := range fields {
+		if f.is("func") {
+			a.funcs[f.list[1].atom] = len(a.funcs)
+		}
+		if f.is("global") {
+			a.globals[f.list[1].atom] = len(a.globals)
+		}
+	}
+	export := func(s *sexpr, kind byte, n int) {
+		exports = append(exports, append(append(wasmName(s.list[1].atom), kind), uleb(uint64(n))...))
+	}
+	for _, f := range fields {
+		switch {
+		case f.is("func"):
+			s, t := a.sig(f.list[2:])
+			funcs = append(funcs, uleb(uint64(t)))
+			if f.list[2].is("export") {
+				export(f.list[2], 0, a.funcs[f.list[1].atom])
+			}
+			codes = append(codes, a.code(f.list[2:], s))
+		case f.is("global"):
+			rest := f.list[2:]
+			if rest[0].is("export") {
+				export(rest[0], 3, a.globals[f.list[1].atom])
+				rest = rest[1:]
+			}
+			var g []byte
+			if rest[0].is("mut") {
+				g = []byte{wasmType(rest[0].list[1]), 1}
+			} else {
+				g = []byte{wasmType(rest[0]), 0}
+			}
+			globals = append(globals, append(g, wasmConst(rest[1])...))
+		case f.is("memory"):
+			rest := f.list[1:]
+			if rest[0].is("export") {
+				export(rest[0], 2, 0)
+				rest = rest[1:]
+			}
+			n, _ := strconv.Atoi(rest[0].atom)
+			mems = append(mems, append([]byte{0}, uleb(uint64(n))...))
+		case f.is("table"):
+			n, _ := strconv.Atoi(f.list[1].atom)
+			tables = append(tables, append([]byte{0x70, 0}, uleb(uint64(n))...))
+		case f.is("elem"):
+			var idxs [][]byte
+			for _, it := range f.list[2:] {
+				idxs = append(idxs, uleb(uint64(a.index(a.funcs, it))))
+			}
+			elems = append(elems, append(append([]byte{0}, wasmConst(f.list[1])...), wasmVec(idxs)...))
+		case f.is("data"):
+			d := watString(f.list[2].atom)
+			datas = append(datas, append(append([]byte{0}, wasmConst(f.list[1])...), append(uleb(uint64(len(d))), d...)...))
+		case f.is("start"):
+			start = uleb(uint64(a.index(a.funcs, f.list[1])))
+		}
+	}
+	var types [][]byte
+	for _, t := range a.types {
+		types = append(types, t.encode())
+	}
+	var out bytes.Buffer
+	out.Write([]byte{0, 'a', 's', 'm', 1, 0, 0, 0})
+	out.Write(wasmSection(1, types))
+	out.Write(wasmSection(2, imports))
+	out.Write(wasmSection(3, funcs))
+	out.Write(wasmSection(4, tables))
+	out.Write(wasmSection(5, mems))
+	out.Write(wasmSection(6, globals))
+	out.Write(wasmSection(7, exports))
+	if start != nil {
+		out.Write([]byte{8, byte(len(start))})
+		out.Write(start)
+	}
+	out.Write(wasmSection(9, elems))
+	out.Write(wasmSection(10, codes))
+	out.Write(wasmSection(11, datas))
+	return out.Bytes(), nil
+}
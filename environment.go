@@ -1,46 +1,138 @@
-package main
+package lox
 
 import (
 	"fmt"
-	"sync"
+	"sync/atomic"
 )
 
-type Environment struct {
-	sync.Mutex
-	enclosing *Environment
-	values    map[string]interface{}
+// environment holds variables. Globals are kept by name in values, locals are
+// resolved beforehand and kept in slots.
+type environment struct {
+	enclosing *environment
+	values    map[string]*global
+	slots     []Value
+	// names of the slots, for error messages and hooks
+	locals []string
+	// live counts the slots declared so far, for hooks.
+	live int
 }
 
-func (e *Environment) Define(name string, val interface{}) {
-	e.values[name] = val
+// global is the binding of a global variable. Redefining a global updates its
+// binding, and bindings are never removed, so caches can hold on to them.
+type global struct {
+	val Value
 }
 
-func (e *Environment) Get(name Token) (interface{}, *Error) {
-	val, ok := e.values[string(name.Lexeme)]
-	if !ok {
-		if e.enclosing != nil {
-			return e.enclosing.Get(name)
+// globalCache is an inline cache of the global binding of one name, kept at
+// the place the name is used. It's safe for concurrent use.
+type globalCache struct {
+	// v holds a *cachedGlobal
+	v atomic.Value
+}
+
+type cachedGlobal struct {
+	env *environment
+	g   *global
+}
+
+// lookup returns the binding of name in the global environment e, or nil if
+// there's none yet.
+func (c *globalCache) lookup(e *environment, name []byte) *global {
+	if cg, k := c.v.Load().(*cachedGlobal); k && cg.env == e {
+		return cg.g
+	}
+	g := e.values[string(name)]
+	if g != nil {
+		c.v.Store(&cachedGlobal{e, g})
+	}
+	return g
+}
+
+func (e *environment) Define(name string, val Value) {
+	if g, k := e.values[name]; k {
+		g.val = val
+		return
+	}
+	e.values[name] = &global{val}
+}
+
+func (e *environment) Get(name Token) (Value, *Error) {
+	for env := e; env != nil; env = env.enclosing {
+		if g, ok := env.values[string(name.Lexeme)]; ok {
+			return g.val, nil
 		}
-		return nil, &Error{name, "undefined variable '" + string(name.Lexeme) + "'"}
 	}
-	return val, nil
+	return Nil, e.undefined(name)
+}
+
+func newEnvironment(enclosing *environment) *environment {
+	return &environment{
+		enclosing: enclosing,
+		values:    make(map[string]*global),
+	}
 }
 
-func NewEnvironment(enclosing *Environment) *Environment {
-	return &Environment{
+// newLocalEnvironment makes an environment with a slot for each of names.
+func newLocalEnvironment(enclosing *environment, names []string) *environment {
+	return &environment{
 		enclosing: enclosing,
-		values:    make(map[string]interface{}),
+		slots:     make([]Value, len(names)),
+		locals:    names,
 	}
 }
 
-func (e *Environment) Assign(name Token, value interface{}) *Error {
+// declare sets the local in slot, which is declared from then on.
+func (e *environment) declare(slot int, v Value) {
+	e.slots[slot] = v
+	if slot >= e.live {
+		e.live = slot + 1
+	}
+}
+
+func (e *environment) ancestor(depth int) *environment {
+	for ; depth > 0; depth-- {
+		e = e.enclosing
+	}
+	return e
+}
+
+func (e *environment) GetAt(depth, slot int) Value {
+	return e.ancestor(depth).slots[slot]
+}
+
+func (e *environment) AssignAt(depth, slot int, value Value) {
+	e.ancestor(depth).slots[slot] = value
+}
+
+func (e *environment) Assign(name Token, value Value) *Error {
 	lex := string(name.Lexeme)
-	if _, k := e.values[lex]; k {
-		e.values[lex] = value
-		return nil
+	for env := e; env != nil; env = env.enclosing {
+		if g, k := env.values[lex]; k {
+			g.val = value
+			return nil
+		}
+	}
+	return e.undefined(name)
+}
+
+// undefined makes an error for an unknown name, suggesting names visible from
+// e and extra ones.
+func (e *environment) undefined(name Token, extra ...string) *Error {
+	lex := string(name.Lexeme)
+	return &Error{name, fmt.Sprintf("undefined variable '%s'", lex) + suggest(lex, append(e.names(), extra...))}
+}
+
+// names lists every name visible from e, natives included.
+func (e *environment) names() []string {
+	var names []string
+	for ; e != nil; e = e.enclosing {
+		for k := range e.values {
+			names = append(names, k)
+		}
+		names = append(names, e.locals...)
 	}
-	if e.enclosing != nil {
-		return e.enclosing.Assign(name, value)
+	for k := range natives {
+		names = append(names, k)
 	}
-	return &Error{name, fmt.Sprintf("undefined variable '%s'", lex)}
+	return names
 }
@@ -0,0 +1,167 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// parallelScript reads globals in loops and calls, so the inline caches of a
+// shared Program are hit by every VM.
+const parallelScript = `
+fun fib(n) { if (n < 2) return n; return fib(n - 1) + fib(n - 2); }
+fun adder(n) { fun add(x) { return x + n; } return add; }
+var total = 0;
+for (var i = 0; i < 50; i = i + 1) total = total + id;
+print adder(total)(fib(10));
+print clock();
+`
+
+// TestParallelVMs runs hundreds of VMs at once, which is meant to be done
+// with -race.
+func TestParallelVMs(t *testing.T) {
+	shared, diags := Compile([]byte(parallelScript))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	bytecode, err := shared.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	spin, diags := Compile([]byte("while (true) {}"))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 400)
+	for n := 0; n < cap(errs); n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			errs <- parallelVM(n, shared, bytecode, spin)
+		}(n)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func parallelVM(n int, shared *Program, bytecode []byte, spin *Program) error {
+	engine := []Engine{TreeWalker, Bytecode}[n%2]
+	p := shared
+	switch n % 3 {
+	case 1:
+		var diags []Diagnostic
+		if p, diags = Compile([]byte(parallelScript)); diags != nil {
+			return diags[0]
+		}
+	case 2:
+		var err error
+		if p, err = LoadBytecode(bytecode); err != nil {
+			return err
+		}
+	}
+	caps, err := ParseCapabilities("time:frozen=" + strconv.Itoa(n+1))
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	vm := NewVM(Backend(engine), Allow(caps), Stdout(&out), MaxSteps(100000))
+	if err := vm.Define("id", n); err != nil {
+		return err
+	}
+	want := fmt.Sprintf("%d\n%d\n", 50*n+55, n+1)
+	for run := 0; run < 3; run++ {
+		out.Reset()
+		if err := vm.Run(context.Background(), p); err != nil {
+			return fmt.Errorf("vm %d: %v", n, err)
+		}
+		if out.String() != want {
+			return fmt.Errorf("vm %d printed %q, want %q", n, out.String(), want)
+		}
+	}
+
+	switch n % 4 {
+	case 1:
+		var q *QuotaExceeded
+		if err := vm.Run(context.Background(), spin); !errors.As(err, &q) || q.Limit != StepLimit {
+			return fmt.Errorf("vm %d: spinning got %v, want the step limit", n, err)
+		}
+	case 3:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		vm := NewVM(Backend(engine))
+		var i *Interrupted
+		if err := vm.Run(ctx, spin); !errors.As(err, &i) {
+			return fmt.Errorf("vm %d: spinning got %v, want a timeout", n, err)
+		}
+	}
+	return nil
+}
+
+// TestGlobalCaches checks that inline caches of globals see redefinitions,
+// and don't mix up VMs running the same Program.
+func TestGlobalCaches(t *testing.T) {
+	p, diags := Compile([]byte(`
+var g = 1;
+fun get() { return g; }
+fun f() { return "f1"; }
+fun h() { return f(); }
+fun late() { return later; }
+print get() + 10;
+var g = 2;
+print get() + 10;
+g = 3;
+print get() + 10;
+print h();
+fun f() { return "f2"; }
+print h();
+late();
+var later = "later";
+print late();
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	ctx := context.Background()
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var outs [2]bytes.Buffer
+		var vms [2]*VM
+		for k := range vms {
+			vms[k] = NewVM(Backend(e), Stdout(&outs[k]), Stderr(&outs[k]))
+			vms[k].Run(ctx, p)
+		}
+		want := "11\n12\n13\nf1\nf2\nat line 6: undefined variable 'later'; did you mean 'late'?\nlater\n"
+		for k := range vms {
+			if outs[k].String() != want {
+				t.Errorf("%v: vm %d printed %q, want %q", e, k, outs[k].String(), want)
+			}
+		}
+
+		// The same sites now run for one VM then the other.
+		vals := [2]float64{3, 3}
+		for n := 0; n < 4; n++ {
+			k := n % 2
+			vals[k] = float64(100*k + n)
+			if err := vms[k].Define("g", vals[k]); err != nil {
+				t.Fatal(err)
+			}
+			for _, m := range []int{k, 1 - k} {
+				v, err := vms[m].Global("get").Call(ctx)
+				if err != nil || v.Interface() != vals[m] {
+					t.Errorf("%v: round %d: vm %d got %v, %v, want %v", e, n, m, v.Interface(), err, vals[m])
+				}
+			}
+		}
+	}
+}
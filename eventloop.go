@@ -0,0 +1,522 @@
+package lox
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Clock is the time of timers.
+type Clock interface {
+	Now() time.Time
+	// Sleep waits for d to pass, or for ctx to be done.
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// Timers makes timers run on c instead of the real clock.
+func Timers(c Clock) Option {
+	return func(conf *config) { conf.clock = c }
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// VirtualClock is a Clock that doesn't wait: sleeping moves its time forward
+// at once. Scripts using timers run on it without delay and always the same
+// way.
+type VirtualClock struct {
+	now time.Time
+}
+
+// NewVirtualClock returns a VirtualClock telling start.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	return c.now
+}
+
+func (c *VirtualClock) Sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.now = c.now.Add(d)
+	return nil
+}
+
+// eventLoop has what scripts scheduled for VM.RunLoop: timers, and the
+// callbacks of settled promises, which run first.
+type eventLoop struct {
+	vm     *VM
+	clock  Clock
+	timers timerHeap
+	// active are the timers not cleared yet, by id.
+	active map[int]*timer
+	lastID int
+	jobs   []job
+	// rejected are the promises rejected before anything handled them.
+	rejected []*promise
+}
+
+func newEventLoop(vm *VM, clock Clock) *eventLoop {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &eventLoop{vm: vm, clock: clock, active: make(map[int]*timer)}
+}
+
+// reset drops everything scheduled.
+func (l *eventLoop) reset() {
+	l.timers, l.jobs, l.rejected = nil, nil, nil
+	l.active = make(map[int]*timer)
+}
+
+// natives returns the natives scheduling work on l.
+func (l *eventLoop) natives() map[string]callable {
+	return map[string]callable{
+		"setTimeout":    &nf_setTimer{l, false},
+		"setInterval":   &nf_setTimer{l, true},
+		"clearTimeout":  &nf_clearTimer{l},
+		"clearInterval": &nf_clearTimer{l},
+		"promise":       &nf_promise{l},
+	}
+}
+
+type timer struct {
+	id    int
+	due   time.Time
+	every time.Duration
+	fn    Value
+	// index is the position of the timer in the heap.
+	index int
+}
+
+// timerHeap orders timers by when they're due, then by when they were set.
+type timerHeap []*timer
+
+func (h timerHeap) Len() int { return len(h) }
+
+func (h timerHeap) Less(i, j int) bool {
+	if h[i].due.Equal(h[j].due) {
+		return h[i].id < h[j].id
+	}
+	return h[i].due.Before(h[j].due)
+}
+
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return t
+}
+
+// job calls the handler of a reaction with the value of a settled promise.
+type job struct {
+	r        reaction
+	rejected bool
+	v        Value
+}
+
+// RunLoop runs the timers and the promise callbacks that scripts scheduled,
+// until none are left. Callbacks spend what's left of the quotas of the last
+// run, and a run stopped by its context or a quota drops what it scheduled.
+// Errors of callbacks are reported like those of statements, and RunLoop
+// returns the first one. A rejected promise nothing handles is an error once
+// the loop is done.
+//
+// Tasks run after each callback until they're done or blocked. Those still
+// blocked once nothing is scheduled fail, as nothing can wake them anymore.
+func (vm *VM) RunLoop(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return &Interrupted{Err: err}
+	}
+	if vm.running > 0 {
+		return errors.New("lox: RunLoop called while the VM is running")
+	}
+	vm.running++
+	defer func() { vm.running-- }()
+	if vm.ran == Bytecode {
+		vm.bytecode().SetContext(ctx)
+	} else {
+		vm.interpreter().SetContext(ctx)
+	}
+	vm.tasks.begin(ctx)
+	defer vm.tasks.finish()
+	l := vm.loop
+	var first error
+	// fail records err, after those of tasks, and tells if the loop must
+	// stop, dropping what's left then.
+	fail := func(err *Error) bool {
+		e := vm.fail(ctx, err)
+		if first == nil {
+			if first = vm.tasks.err; first == nil {
+				first = e
+			}
+		}
+		if err != nil && fatal(err) {
+			l.reset()
+			vm.tasks.reset()
+			return true
+		}
+		return false
+	}
+	for {
+		for len(l.jobs) > 0 {
+			j := l.jobs[0]
+			l.jobs = l.jobs[1:]
+			if fail(l.run(j)) || fail(vm.tasks.drain()) {
+				return first
+			}
+		}
+		if len(l.timers) == 0 {
+			if fail(vm.tasks.deadlock()) {
+				return first
+			}
+			if len(l.jobs) == 0 && len(l.timers) == 0 {
+				break
+			}
+			continue
+		}
+		t := l.timers[0]
+		if d := t.due.Sub(l.clock.Now()); d > 0 {
+			if err := l.clock.Sleep(ctx, d); err != nil {
+				fail(&Error{Token{Type: interrupted, Literal: err}, err.Error()})
+				return first
+			}
+		}
+		if t.every > 0 {
+			t.due = t.due.Add(t.every)
+			heap.Fix(&l.timers, 0)
+		} else {
+			heap.Pop(&l.timers)
+			delete(l.active, t.id)
+		}
+		_, err := vm.invoke(t.fn, nil)
+		if fail(err) || fail(vm.tasks.drain()) {
+			return first
+		}
+	}
+	rejected := l.rejected
+	l.rejected = nil
+	for _, p := range rejected {
+		if p.handled {
+			continue
+		}
+		e := fmt.Errorf("uncaught rejection: %s", repr(p.v))
+		if vm.conf.stderr != nil {
+			fmt.Fprintln(vm.conf.stderr, e)
+		}
+		if vm.conf.hooks.OnError != nil {
+			vm.conf.hooks.OnError(e)
+		}
+		if first == nil {
+			first = e
+		}
+	}
+	return first
+}
+
+// invoke calls fn on the engine of the current task, that of the last run
+// unless a spawned one has the turn, for natives and the event loop.
+func (vm *VM) invoke(fn Value, args []Value) (Value, *Error) {
+	v, _, err := vm.tasks.engine(vm.tasks.current).call(fn, args)
+	return v, err
+}
+
+// run runs a job, settling the promise of its reaction with what the
+// handler returns. Uncatchable errors are returned, others reject the
+// promise.
+func (l *eventLoop) run(j job) *Error {
+	handler := j.r.fulfilled
+	if j.rejected {
+		handler = j.r.rejected
+	}
+	if handler.Kind() == KindNil {
+		// Nothing to do here, the next promise of the chain gets the value.
+		j.r.next.settle(j.rejected, j.v)
+		return nil
+	}
+	v, err := l.vm.invoke(handler, []Value{j.v})
+	if err != nil {
+		if uncatchable(err) {
+			return err
+		}
+		j.r.next.settle(true, StringValue([]byte(err.Message)))
+		return nil
+	}
+	j.r.next.resolve(v)
+	return nil
+}
+
+// callback checks that v is a function taking n arguments.
+func callback(v Value, n int) *Error {
+	var a int
+	switch fn := v.Object().(type) {
+	case *closure:
+		a = fn.proto.Arity
+	case callable:
+		a = fn.Arity()
+	default:
+		return &Error{Token{}, "callback must be a function"}
+	}
+	if a >= 0 && a != n {
+		return &Error{Token{}, fmt.Sprintf("callback must take %d arguments, not %d", n, a)}
+	}
+	return nil
+}
+
+type nf_setTimer struct {
+	l *eventLoop
+	// repeat is set for setInterval.
+	repeat bool
+}
+
+func (f *nf_setTimer) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if err := callback(args[0], 0); err != nil {
+		return Nil, err
+	}
+	if args[1].Kind() != KindNumber {
+		return Nil, &Error{Token{}, "delay must be a number of milliseconds"}
+	}
+	d := time.Duration(args[1].Number() * float64(time.Millisecond))
+	if d < 0 {
+		d = 0
+	}
+	l := f.l
+	l.lastID++
+	t := &timer{id: l.lastID, due: l.clock.Now().Add(d), fn: args[0]}
+	if f.repeat {
+		// An interval of 0 would never let time pass.
+		if t.every = d; t.every < time.Millisecond {
+			t.every = time.Millisecond
+		}
+	}
+	heap.Push(&l.timers, t)
+	l.active[t.id] = t
+	return NumberValue(float64(t.id)), nil
+}
+
+func (*nf_setTimer) Arity() int {
+	return 2
+}
+
+func (*nf_setTimer) String() string {
+	return "<native fn>"
+}
+
+type nf_clearTimer struct {
+	l *eventLoop
+}
+
+func (f *nf_clearTimer) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if args[0].Kind() != KindNumber {
+		return Nil, &Error{Token{}, "timer must be a number"}
+	}
+	if t, k := f.l.active[int(args[0].Number())]; k {
+		heap.Remove(&f.l.timers, t.index)
+		delete(f.l.active, t.id)
+	}
+	return Nil, nil
+}
+
+func (*nf_clearTimer) Arity() int {
+	return 1
+}
+
+func (*nf_clearTimer) String() string {
+	return "<native fn>"
+}
+
+type promiseState int
+
+const (
+	promisePending promiseState = iota
+	promiseFulfilled
+	promiseRejected
+)
+
+// promise is the eventual result of some work, which scripts get with
+// then and catch.
+type promise struct {
+	l     *eventLoop
+	state promiseState
+	v     Value
+	// reactions are to settle, or adopt, when the promise settles.
+	reactions []reaction
+	// resolved is set once the promise got a value, which may be a promise
+	// it's still waiting for.
+	resolved bool
+	// handled is set once the promise has a reaction.
+	handled bool
+}
+
+// reaction is what to call once a promise settles: the handler for how it
+// did, or none to pass its result on. next gets the result of the handler.
+type reaction struct {
+	fulfilled Value
+	rejected  Value
+	next      *promise
+}
+
+func (p *promise) String() string {
+	return "<promise>"
+}
+
+func (p *promise) Get(name string) (Value, *Error) {
+	switch name {
+	case "then":
+		return ObjectValue(&builtin{-1, func(args []Value) (Value, *Error) {
+			if len(args) < 1 || len(args) > 2 {
+				return Nil, &Error{Token{}, fmt.Sprintf("expected 1 or 2 arguments but got %d", len(args))}
+			}
+			r := reaction{fulfilled: args[0], next: p.l.promise()}
+			if len(args) == 2 {
+				r.rejected = args[1]
+			}
+			return p.then(r)
+		}}), nil
+	case "catch":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			return p.then(reaction{rejected: args[0], next: p.l.promise()})
+		}}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("promise has no property '%s'", name)}
+}
+
+func (p *promise) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of a promise", name)}
+}
+
+func (l *eventLoop) promise() *promise {
+	return &promise{l: l}
+}
+
+// then adds a reaction from scripts and returns the promise of its result.
+func (p *promise) then(r reaction) (Value, *Error) {
+	for _, h := range []Value{r.fulfilled, r.rejected} {
+		if h.Kind() == KindNil {
+			continue
+		}
+		if err := callback(h, 1); err != nil {
+			return Nil, err
+		}
+	}
+	p.react(r)
+	return ObjectValue(r.next), nil
+}
+
+func (p *promise) react(r reaction) {
+	p.handled = true
+	if p.state == promisePending {
+		p.reactions = append(p.reactions, r)
+		return
+	}
+	p.l.jobs = append(p.l.jobs, job{r, p.state == promiseRejected, p.v})
+}
+
+// resolve fulfills p with v, or makes it wait for v if that's a promise.
+func (p *promise) resolve(v Value) {
+	if p.resolved {
+		return
+	}
+	q, k := v.Object().(*promise)
+	if !k {
+		p.settle(false, v)
+		return
+	}
+	if q == p {
+		p.settle(true, StringValue([]byte("promise resolved with itself")))
+		return
+	}
+	p.resolved = true
+	q.react(reaction{next: p})
+}
+
+// settle fulfills or rejects p with v, unless it's settled already.
+func (p *promise) settle(reject bool, v Value) {
+	if p.state != promisePending {
+		return
+	}
+	p.resolved = true
+	p.state, p.v = promiseFulfilled, v
+	if reject {
+		p.state = promiseRejected
+		if !p.handled {
+			p.l.rejected = append(p.l.rejected, p)
+		}
+	}
+	for _, r := range p.reactions {
+		p.l.jobs = append(p.l.jobs, job{r, reject, v})
+	}
+	p.reactions = nil
+}
+
+// nf_promise makes a promise, calling its argument with the functions
+// resolving and rejecting it. Errors of the call reject it, except
+// uncatchable ones.
+type nf_promise struct {
+	l *eventLoop
+}
+
+func (f *nf_promise) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if err := callback(args[0], 2); err != nil {
+		return Nil, err
+	}
+	p := f.l.promise()
+	resolve := &builtin{1, func(args []Value) (Value, *Error) {
+		p.resolve(args[0])
+		return Nil, nil
+	}}
+	reject := &builtin{1, func(args []Value) (Value, *Error) {
+		if !p.resolved {
+			p.settle(true, args[0])
+		}
+		return Nil, nil
+	}}
+	_, err := f.l.vm.invoke(args[0], []Value{ObjectValue(resolve), ObjectValue(reject)})
+	if err != nil {
+		if uncatchable(err) {
+			return Nil, err
+		}
+		if !p.resolved {
+			p.settle(true, StringValue([]byte(err.Message)))
+		}
+	}
+	return ObjectValue(p), nil
+}
+
+func (*nf_promise) Arity() int {
+	return 1
+}
+
+func (*nf_promise) String() string {
+	return "<native fn>"
+}
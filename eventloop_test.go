@@ -0,0 +1,133 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestQuotaErrorsUncaught checks that promises don't catch stack overflows
+// of executors, handlers, waited tasks or generators.
+func TestQuotaErrorsUncaught(t *testing.T) {
+	const src = `
+fun deep() { deep(); }
+fun caught(e) { print "caught: " + e; }
+fun overflow(res, rej) { deep(); }
+promise(overflow).catch(caught);
+fun one(res, rej) { res(1); }
+fun handler(v) { deep(); }
+promise(one).then(handler).catch(caught);
+var t = spawn deep();
+fun waits(res, rej) { res(t.wait()); }
+promise(waits).catch(caught);
+fun gen() { deep(); yield 1; }
+var g = gen();
+fun nexts(res, rej) { res(g.next()); }
+promise(nexts).catch(caught);
+fun fails(res, rej) { nil(); }
+promise(fails).catch(caught);
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), MaxDepth(100), Stdout(&out), Stderr(&out))
+		err := vm.Run(context.Background(), p)
+		if lerr := vm.RunLoop(context.Background()); err == nil {
+			err = lerr
+		}
+		var q *QuotaExceeded
+		if !errors.As(err, &q) || q.Limit != DepthLimit {
+			t.Errorf("%v: got %v, want a stack overflow", e, err)
+		}
+		if n := strings.Count(out.String(), "caught: "); n != 1 {
+			t.Errorf("%v: %d errors caught, want only the call of nil:\n%s", e, n, out.String())
+		}
+		if n := strings.Count(out.String(), "stack overflow"); n != 5 {
+			t.Errorf("%v: %d stack overflows reported, want 5:\n%s", e, n, out.String())
+		}
+	}
+}
+
+// TestVirtualClock checks the order timers run in, without waiting.
+func TestVirtualClock(t *testing.T) {
+	const src = `
+fun a() { print "a"; }
+fun b() { print "b"; }
+fun c() { print "c"; }
+fun never() { print "never"; }
+var n = 0;
+var every;
+fun tick() {
+  n = n + 1;
+  print n;
+  if (n == 3) clearInterval(every);
+}
+setTimeout(b, 20);
+setTimeout(a, 10);
+var cleared = setTimeout(never, 15);
+setTimeout(c, 20);
+every = setInterval(tick, 7);
+clearTimeout(cleared);
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		start := time.Unix(0, 0)
+		clock := NewVirtualClock(start)
+		vm := NewVM(Backend(e), Timers(clock), Stdout(&out), Stderr(&out))
+		err := vm.Run(context.Background(), p)
+		if err == nil {
+			err = vm.RunLoop(context.Background())
+		}
+		if err != nil {
+			t.Fatalf("%v: %v", e, err)
+		}
+		if got, want := strings.Fields(out.String()), []string{"1", "a", "2", "b", "c", "3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", e, got, want)
+		}
+		if d := clock.Now().Sub(start); d != 21*time.Millisecond {
+			t.Errorf("%v: clock moved %v, want 21ms", e, d)
+		}
+	}
+}
+
+// brokenClock fails to sleep.
+type brokenClock struct{ VirtualClock }
+
+var errBroken = errors.New("clock broken")
+
+func (*brokenClock) Sleep(ctx context.Context, d time.Duration) error {
+	return errBroken
+}
+
+func TestClockFailure(t *testing.T) {
+	p, diags := Compile([]byte(`fun f() {} setTimeout(f, 10);`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), Timers(&brokenClock{}), Stderr(&out))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		err := vm.RunLoop(context.Background())
+		var i *Interrupted
+		if !errors.As(err, &i) || !errors.Is(err, errBroken) {
+			t.Fatalf("%v: got %v, want the error of the clock", e, err)
+		}
+		if !strings.Contains(err.Error(), "clock broken") || !strings.Contains(out.String(), "clock broken") {
+			t.Errorf("%v: got %q, reported %q", e, err, out.String())
+		}
+	}
+}
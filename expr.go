@@ -1,19 +1,30 @@
-package main
+package lox
 
-// Expr is an expression of the parser.
-type Expr interface {
-	Accept(Visitor) (interface{}, *Error)
+import "context"
+
+// expr is an expression of the parser.
+type expr interface {
+	Accept(visitor) (interface{}, *Error)
 }
 
-type Stmt interface {
-	Accept(Visitor) (interface{}, *Error)
+type stmt interface {
+	Accept(visitor) (interface{}, *Error)
 }
 
-type Visitor interface {
+type visitor interface {
 	Visit(interface{}) (interface{}, *Error)
 }
 
-type Callable interface {
-	Call(i *Interpreter, args []interface{}) (interface{}, *Error)
+type callable interface {
+	// Call gets the context of the run, and the interpreter when running on
+	// one.
+	Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error)
+	// Arity is the number of arguments, or -1 if Call checks them itself.
 	Arity() int
 }
+
+// instance is an object with properties, read and written with a dot.
+type instance interface {
+	Get(name string) (Value, *Error)
+	Set(name string, v Value) *Error
+}
@@ -1,23 +1,64 @@
-package main
+package lox
 
-type Func struct {
-	declaration *Function
+import "context"
+
+type function struct {
+	declaration *functionStmt
+	closure     *environment
+}
+
+// Call runs f, or makes a generator running it if f yields.
+func (f *function) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if f.declaration.Generator {
+		i.hooks.call(ObjectValue(f), args)
+		g, err := i.generate(f, args)
+		if err == nil {
+			i.hooks.ret(ObjectValue(f), g)
+		}
+		return g, err
+	}
+	return f.run(i, args)
 }
 
-func (f *Func) Call(i *Interpreter, args []interface{}) interface{} {
-	env := NewEnvironment(i.globals)
-	for i := range f.declaration.Params {
-		env.Define(string(f.declaration.Params[i].Lexeme), args[i])
+// run runs the body of f.
+func (f *function) run(i *interpreter, args []Value) (Value, *Error) {
+	// elided counts the tail calls that led to f.
+	for elided := 0; ; elided++ {
+		i.hooks.call(ObjectValue(f), args)
+		env := f.closure
+		if len(f.declaration.Names) > 0 {
+			if err := i.allocenv(len(f.declaration.Names)); err != nil {
+				return Nil, err
+			}
+			env = newLocalEnvironment(f.closure, f.declaration.Names)
+			// Parameters are the first slots.
+			env.live = copy(env.slots, args)
+		}
+		err := i.executeBlock(f.declaration.Body, env)
+		switch err {
+		case returning:
+			i.hooks.ret(ObjectValue(f), i.ret)
+			return i.ret, nil
+		case tailcalling:
+			// The callee takes the place of f, so tail calls don't grow the
+			// Go stack or count towards MaxDepth.
+			i.hooks.ret(ObjectValue(f), Nil)
+			f, args = i.tail, i.args
+			i.tail, i.args = nil, nil
+			continue
+		case nil:
+			i.hooks.ret(ObjectValue(f), Nil)
+			return Nil, nil
+		}
+		i.unwind(f, elided, err)
+		return Nil, err
 	}
-	ni := NewInterpreter(env)
-	ni.Interpret(append(f.declaration.Body, &Return{}))
-	return <-ni.ret
 }
 
-func (f *Func) Arity() int {
+func (f *function) Arity() int {
 	return len(f.declaration.Params)
 }
 
-func (f *Func) String() string {
+func (f *function) String() string {
 	return "<fn " + string(f.declaration.Name.Lexeme) + ">"
 }
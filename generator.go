@@ -0,0 +1,139 @@
+package lox
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// Generators are what calling functions that yield returns. Each next() runs
+// the function until it yields again, on a goroutine of its own that waits
+// in between, so the function's environments, blocks and loops are left as
+// they were. Like tasks, the generator and what resumes it take turns.
+
+// generator runs a generator function a yield at a time.
+type generator struct {
+	s      *scheduler
+	engine engine
+	fn     Value
+	args   []Value
+	co     *coroutine
+	// running is set while the generator has the turn, started once it had
+	// it, and done once its function returned.
+	running, started, done bool
+}
+
+// coroutine passes the turn between a generator and what resumes it. The
+// goroutine of the generator refers to it but not to the generator, so
+// generators scripts drop while suspended can be finalized.
+type coroutine struct {
+	in  chan Value
+	out chan yielded
+}
+
+// yielded is what a generator gives back with the turn: a value yielded, or
+// the end of its function, with the error it failed with.
+type yielded struct {
+	v   Value
+	err *Error
+	end bool
+}
+
+// generate makes a generator calling fn with args on e, whose yields go
+// through co.
+func (s *scheduler) generate(e engine, co *coroutine, fn Value, args []Value) *generator {
+	g := &generator{s: s, engine: e, fn: fn, args: args, co: co}
+	runtime.SetFinalizer(g, (*generator).drop)
+	return g
+}
+
+func newCoroutine() *coroutine {
+	return &coroutine{make(chan Value), make(chan yielded)}
+}
+
+// yield gives v to what resumed the generator, and waits for the value of
+// its next resumption.
+func (co *coroutine) yield(v Value) Value {
+	co.out <- yielded{v: v}
+	v, k := <-co.in
+	if !k {
+		// Dropped while suspended, so there's nothing left to run for.
+		runtime.Goexit()
+	}
+	return v
+}
+
+// drop ends the goroutine of a generator nothing refers to anymore.
+func (g *generator) drop() {
+	if g.started && !g.done {
+		close(g.co.in)
+	}
+}
+
+func (g *generator) String() string {
+	return "<generator>"
+}
+
+func (g *generator) Get(name string) (Value, *Error) {
+	switch name {
+	case "next":
+		return ObjectValue(&builtin{-1, func(args []Value) (Value, *Error) {
+			if len(args) > 1 {
+				return Nil, &Error{Token{}, fmt.Sprintf("expected 0 or 1 arguments but got %d", len(args))}
+			}
+			v := Nil
+			if len(args) == 1 {
+				v = args[0]
+			}
+			return g.resume(v)
+		}}), nil
+	case "done":
+		return BoolValue(g.done), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("generator has no property '%s'", name)}
+}
+
+func (g *generator) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of a generator", name)}
+}
+
+// resume runs the generator until it yields or returns, and returns what it
+// yielded. v is what the yield it's suspended at evaluates to. Done
+// generators return nil.
+func (g *generator) resume(v Value) (Value, *Error) {
+	if g.done {
+		return Nil, nil
+	}
+	if g.running {
+		return Nil, &Error{Token{}, "generator is already running"}
+	}
+	// The generator runs as part of the current task: on its turn, with its
+	// quotas and below its calls.
+	t := g.s.current
+	r := g.s.engine(t)
+	depth, max := r.nesting()
+	g.engine.limit(max - depth)
+	g.engine.SetContext(g.s.ctx)
+	*g.engine.budget() = *r.budget()
+	outer := t.engine
+	t.engine = g.engine
+	g.running = true
+	if !g.started {
+		g.started = true
+		e, co, fn, args := g.engine, g.co, g.fn, g.args
+		go func() {
+			err := e.start(fn, args)
+			co.out <- yielded{err: err, end: true}
+		}()
+	} else {
+		g.co.in <- v
+	}
+	y := <-g.co.out
+	g.running = false
+	t.engine = outer
+	*r.budget() = *g.engine.budget()
+	if y.end {
+		g.done = true
+		g.engine, g.fn, g.args = nil, Nil, nil
+	}
+	return y.v, y.err
+}
@@ -0,0 +1,115 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerators(t *testing.T) {
+	for _, c := range []struct {
+		name, src string
+		want      []string
+	}{
+		{"nested", `
+fun upto(n) { for (var i = 0; i < n; i = i + 1) yield i; }
+fun pairs(n) { for (var i in upto(n)) for (var j in upto(i)) yield i * 10 + j; }
+for (var p in pairs(3)) print p;
+`, []string{"10", "20", "21"}},
+		{"recursive", `
+fun countdown(n) {
+  if (n > 0) {
+    yield n;
+    for (var x in countdown(n - 1)) yield x;
+  }
+}
+for (var x in countdown(3)) print x;
+`, []string{"3", "2", "1"}},
+		{"nil", `
+fun gen() { yield 1; yield nil; yield 3; }
+for (var x in gen()) print x;
+var g = gen();
+print g.next();
+print g.next();
+print g.done;
+print g.next();
+print g.next();
+print g.done;
+`, []string{"1", "nil", "3", "1", "nil", "false", "3", "nil", "true"}},
+		{"errors", `
+fun bad() { yield 1; nil(); yield 2; }
+var g = bad();
+print g.next();
+print g.next();
+print g.done;
+print g.next();
+fun sum() {
+  var s = 0;
+  for (var x in bad()) s = s + x;
+  return s;
+}
+print sum();
+print "after";
+`, []string{
+			"1", "at line 2: can only call functions and classes", "true", "nil",
+			"at line 2: can only call functions and classes", "after",
+		}},
+	} {
+		p, diags := Compile([]byte(c.src))
+		if diags != nil {
+			t.Fatalf("%s: %v", c.name, diags)
+		}
+		for _, e := range []Engine{TreeWalker, Bytecode} {
+			var out bytes.Buffer
+			NewVM(Backend(e), Stdout(&out), Stderr(&out)).Run(context.Background(), p)
+			got := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("%s: %v: got %q, want %q", c.name, e, got, c.want)
+			}
+		}
+	}
+}
+
+// TestGeneratorsLeftEarly checks that generators left suspended by a return
+// out of a for-in loop don't keep their goroutines.
+func TestGeneratorsLeftEarly(t *testing.T) {
+	const src = `
+fun naturals() {
+  var n = 0;
+  while (true) {
+    yield n;
+    n = n + 1;
+  }
+}
+fun find(k) {
+  for (var x in naturals()) if (x == k) return x;
+}
+for (var i = 0; i < 10; i = i + 1) find(i);
+print find(5);
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	before := runtime.NumGoroutine()
+	for n := 0; n < 20; n++ {
+		var out bytes.Buffer
+		vm := NewVM(Backend([]Engine{TreeWalker, Bytecode}[n%2]), Stdout(&out))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != "5\n" {
+			t.Fatalf("got %q", out.String())
+		}
+	}
+	for wait := 0; runtime.NumGoroutine() > before; wait++ {
+		if wait == 100 {
+			t.Fatalf("%d goroutines left, want %d", runtime.NumGoroutine(), before)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
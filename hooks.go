@@ -0,0 +1,202 @@
+package lox
+
+// Hooks are called as scripts run, so debuggers, profilers, coverage tools
+// and tracers can be built on top of the VM. Any of them may be nil, and
+// hooks that are nil cost nothing.
+type Hooks struct {
+	// OnStatement is called before a statement runs, and before the
+	// condition of a loop is checked again. env must not be kept.
+	OnStatement func(s Statement, env Env)
+	// OnCall is called before fn runs. args must not be kept.
+	OnCall func(fn Value, args []Value)
+	// OnReturn is called once fn returned result. A tail call returns nil
+	// from the caller before the callee is called, and calls ended by an
+	// error don't return.
+	OnReturn func(fn Value, result Value)
+	// OnError is called with the errors runs and calls end with, before
+	// they're returned.
+	OnError func(err error)
+}
+
+// Hook makes the VM call h as scripts run. Hooks of several Hook options are
+// all called, in order.
+func Hook(h Hooks) Option {
+	return func(c *config) { c.hooks = c.hooks.then(h) }
+}
+
+// then returns hooks calling those of h and then those of next.
+func (h Hooks) then(next Hooks) Hooks {
+	if a, b := h.OnStatement, next.OnStatement; a != nil && b != nil {
+		h.OnStatement = func(s Statement, env Env) { a(s, env); b(s, env) }
+	} else if b != nil {
+		h.OnStatement = b
+	}
+	if a, b := h.OnCall, next.OnCall; a != nil && b != nil {
+		h.OnCall = func(fn Value, args []Value) { a(fn, args); b(fn, args) }
+	} else if b != nil {
+		h.OnCall = b
+	}
+	if a, b := h.OnReturn, next.OnReturn; a != nil && b != nil {
+		h.OnReturn = func(fn, result Value) { a(fn, result); b(fn, result) }
+	} else if b != nil {
+		h.OnReturn = b
+	}
+	if a, b := h.OnError, next.OnError; a != nil && b != nil {
+		h.OnError = func(err error) { a(err); b(err) }
+	} else if b != nil {
+		h.OnError = b
+	}
+	return h
+}
+
+func (h *Hooks) call(fn Value, args []Value) {
+	if h.OnCall != nil {
+		h.OnCall(fn, args)
+	}
+}
+
+func (h *Hooks) ret(fn, result Value) {
+	if h.OnReturn != nil {
+		h.OnReturn(fn, result)
+	}
+}
+
+// Statement is a statement about to run.
+type Statement struct {
+	Line int
+	// Kind is the keyword the statement starts with: "print", "var", "if",
+	// "while", "fun", "return" or "select", or "expression" for expressions
+	// run for their effect. Loops of every kind are "while".
+	Kind string
+}
+
+// statementKinds are the kinds of statements, numbered in this order in
+// .loxc files.
+var statementKinds = []string{"expression", "print", "var", "if", "while", "fun", "return", "select"}
+
+const (
+	kindExpression = iota
+	kindPrint
+	kindVar
+	kindIf
+	kindWhile
+	kindFun
+	kindReturn
+	kindSelect
+)
+
+// statementAt returns the line and kind of a statement OnStatement is
+// called for. Blocks and tests aren't, only what they hold is, and neither
+// are literals standing alone, which have no line.
+func statementAt(s interface{}) (line int, kind byte, k bool) {
+	switch a := s.(type) {
+	case *expressionStmt:
+		line := exprLine(a.Expr)
+		return line, kindExpression, line > 0
+	case *printStmt:
+		return a.Keyword.Line, kindPrint, true
+	case *varStmt:
+		return a.Name.Line, kindVar, true
+	case *ifStmt:
+		return a.Keyword.Line, kindIf, true
+	case *whileStmt:
+		return a.Keyword.Line, kindWhile, true
+	case *functionStmt:
+		return a.Name.Line, kindFun, true
+	case *returnStmt:
+		return a.Keyword.Line, kindReturn, true
+	case *selectStmt:
+		return a.Keyword.Line, kindSelect, true
+	}
+	return 0, 0, false
+}
+
+// Env is a read-only view of the variables a statement sees: locals,
+// globals and natives. On the Bytecode engine, it sees the locals of
+// enclosing functions only if the function uses them.
+type Env struct {
+	// env is the environment of a statement of the TreeWalker engine.
+	env *environment
+	// Statements of the Bytecode engine run in frame of vm, with locals.
+	vm     *machine
+	frame  *frame
+	locals []string
+}
+
+// Lookup returns the value of the variable called name, and whether the
+// statement sees one.
+func (e Env) Lookup(name string) (Value, bool) {
+	if e.vm == nil {
+		for env := e.env; env != nil; env = env.enclosing {
+			for k := env.live - 1; k >= 0; k-- {
+				if env.locals[k] == name {
+					return env.slots[k], true
+				}
+			}
+			if g, k := env.values[name]; k {
+				return g.val, true
+			}
+		}
+		return Nil, false
+	}
+	for k := len(e.locals) - 1; k >= 0; k-- {
+		// The called closure is in the first slot of the frame.
+		if slot := e.frame.base + 1 + k; e.locals[k] == name && slot < len(e.vm.stack) {
+			return e.vm.stack[slot], true
+		}
+	}
+	cl := e.frame.closure
+	for k, u := range cl.proto.Upvalues {
+		if u.Name == name && k < len(cl.upvalues) {
+			return e.vm.upvalue(cl.upvalues[k]), true
+		}
+	}
+	if g, k := e.vm.globals.values[name]; k {
+		return g.val, true
+	}
+	return Nil, false
+}
+
+// exprLine returns the line an expression starts on, 0 for literals.
+func exprLine(e expr) int {
+	switch a := e.(type) {
+	case *binaryExpr:
+		if l := exprLine(a.Left); l > 0 {
+			return l
+		}
+		return a.Op.Line
+	case *logicalExpr:
+		if l := exprLine(a.Left); l > 0 {
+			return l
+		}
+		return a.Op.Line
+	case *groupingExpr:
+		return exprLine(a.Expr)
+	case *unaryExpr:
+		return a.Op.Line
+	case *variableExpr:
+		return a.Name.Line
+	case *assignExpr:
+		return a.Name.Line
+	case *callExpr:
+		if l := exprLine(a.Callee); l > 0 {
+			return l
+		}
+		return a.Paren.Line
+	case *getExpr:
+		if l := exprLine(a.Object); l > 0 {
+			return l
+		}
+		return a.Name.Line
+	case *setExpr:
+		if l := exprLine(a.Object); l > 0 {
+			return l
+		}
+		return a.Name.Line
+	case *spawnExpr:
+		return a.Keyword.Line
+	case *yieldExpr:
+		return a.Keyword.Line
+	}
+	return 0
+}
@@ -0,0 +1,105 @@
+package lox
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestHooks(t *testing.T) {
+	p, diags := Compile([]byte(`
+var g = "global";
+fun add(a, b) {
+  var sum = a + b;
+  return sum;
+}
+fun outer() {
+  var x = 1;
+  fun inner() { return x + 1; }
+  return inner();
+}
+print add(1, 2);
+print outer();
+nil();
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	bs, err := p.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBytecode(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The last run is of the program loaded from .loxc.
+	var logs [3][]string
+	for k, e := range []Engine{TreeWalker, Bytecode, Bytecode} {
+		var log []string
+		logf := func(format string, args ...interface{}) {
+			log = append(log, fmt.Sprintf(format, args...))
+		}
+		vm := NewVM(Backend(e), Stdout(ioutil.Discard), Hook(Hooks{
+			OnStatement: func(s Statement, env Env) {
+				vars := ""
+				for _, name := range []string{"g", "a", "sum", "x"} {
+					if v, k := env.Lookup(name); k {
+						vars += fmt.Sprintf(" %s=%s", name, repr(v))
+					}
+				}
+				logf("%d %s%s", s.Line, s.Kind, vars)
+			},
+			OnCall: func(fn Value, args []Value) {
+				logf("call %s%s", repr(fn), reprs(args))
+			},
+			OnReturn: func(fn Value, result Value) {
+				logf("return %s %s", repr(fn), repr(result))
+			},
+			OnError: func(err error) {
+				logf("error %v", err)
+			},
+		}))
+		if k == 2 {
+			p = loaded
+		}
+		vm.Run(context.Background(), p)
+		logs[k] = log
+	}
+	want := []string{
+		"2 var",
+		"3 fun g=\"global\"",
+		"7 fun g=\"global\"",
+		"12 print g=\"global\"",
+		"call <fn add> 1 2",
+		"4 var g=\"global\" a=1",
+		"5 return g=\"global\" a=1 sum=3",
+		"return <fn add> 3",
+		"13 print g=\"global\"",
+		"call <fn outer>",
+		"8 var g=\"global\"",
+		"9 fun g=\"global\" x=1",
+		"10 return g=\"global\" x=1",
+		"return <fn outer> nil",
+		"call <fn inner>",
+		"9 return g=\"global\" x=1",
+		"return <fn inner> 2",
+		"14 expression g=\"global\"",
+		"error line 14: can only call functions and classes",
+	}
+	for k, name := range []string{"tree", "vm", "loxc"} {
+		if !reflect.DeepEqual(logs[k], want) {
+			t.Errorf("%s: got\n%q\nwant\n%q", name, logs[k], want)
+		}
+	}
+}
+
+func reprs(vs []Value) string {
+	s := ""
+	for _, v := range vs {
+		s += " " + repr(v)
+	}
+	return s
+}
@@ -1,8 +1,10 @@
-package main
+package lox
 
 import (
+	"context"
 	"fmt"
-	"time"
+	"io"
+	"os"
 )
 
 type Error struct {
@@ -10,59 +12,220 @@ type Error struct {
 	Message string
 }
 
-type Interpreter struct {
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Token.Line, e.Message)
+}
+
+// DefaultMaxDepth is deep enough for sane recursion and shallow enough for the
+// Go stack.
+const DefaultMaxDepth = 10000
+
+type interpreter struct {
 	raise   chan *Error
-	env     *Environment
-	globals *Environment
-	ret     chan interface{}
+	env     *environment
+	globals *environment
+
+	// MaxDepth is the maximum depth of nested calls.
+	MaxDepth int
+	// Stdout is where print writes.
+	Stdout io.Writer
+	ctx    context.Context
+	// done is the Done channel of ctx, nil if it can't be cancelled.
+	done  <-chan struct{}
+	depth int
+	quota
+	hooks Hooks
+	// tasks are those of the VM, nil when not running on one.
+	tasks *scheduler
+	// co is the coroutine of the generator the interpreter runs, if any.
+	co *coroutine
+	// pos is the last token the interpreter has seen, for errors without one.
+	pos Token
+	// ret is the value being returned with the returning error.
+	ret Value
+	// tail and args are the function to call with the tailcalling error.
+	tail *function
+	args []Value
+	// trace has the frames of the functions an error unwound, innermost
+	// first. callLine is the line of the call the error came out of, for
+	// the frame of the function making it.
+	trace    []Frame
+	callLine int
 }
 
-type nf_clock struct{}
+// returning is the error a return statement unwinds the function with.
+var returning = &Error{Token{Type: returnMe}, ""}
+
+// tailcalling is the error a tail call unwinds the calling function with, so
+// function.Call can run the callee in its place.
+var tailcalling = &Error{Token{Type: returnMe}, ""}
 
-func (*nf_clock) Call(i *Interpreter, args []interface{}) interface{} {
-	return time.Now().Unix()
+func newInterpreter(env *environment) *interpreter {
+	i := &interpreter{
+		raise:    make(chan *Error),
+		globals:  env,
+		MaxDepth: DefaultMaxDepth,
+		Stdout:   os.Stdout,
+		ctx:      context.Background(),
+		quota:    unlimited,
+	}
+	i.env = i.globals
+	for name, fn := range natives {
+		i.globals.Define(name, ObjectValue(fn))
+	}
+	return i
 }
 
-func (*nf_clock) Arity() int {
-	return 0
+// fork returns an interpreter sharing the globals and settings of i, for a
+// task or a generator.
+func (i *interpreter) fork() *interpreter {
+	return &interpreter{
+		globals:  i.globals,
+		env:      i.globals,
+		MaxDepth: i.MaxDepth,
+		Stdout:   i.Stdout,
+		ctx:      i.ctx,
+		done:     i.done,
+		quota:    i.quota,
+		hooks:    i.hooks,
+		tasks:    i.tasks,
+	}
 }
 
-func (*nf_clock) String() string {
-	return "<native fn>"
+// start runs the body of the generator function fn, as the first call of
+// the interpreter.
+func (i *interpreter) start(fn Value, args []Value) (err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{i.pos, fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+	if i.depth >= i.MaxDepth {
+		return exceeded(DepthLimit, 0)
+	}
+	_, err = fn.Object().(*function).run(i, args)
+	return err
+}
+
+func (i *interpreter) nesting() (int, int) {
+	return i.depth, i.MaxDepth
+}
+
+func (i *interpreter) limit(max int) {
+	i.MaxDepth = max
+}
+
+// SetContext makes the interpreter stop when ctx is done, and passes ctx to
+// natives.
+func (i *interpreter) SetContext(ctx context.Context) {
+	i.ctx, i.done = ctx, ctx.Done()
 }
 
-func NewInterpreter(env *Environment) *Interpreter {
-	i := &Interpreter{
-		raise:   make(chan *Error),
-		globals: env,
-		ret:     make(chan interface{}, 0),
+// stopped returns the error to stop a run with once done is closed.
+func stopped(ctx context.Context, done <-chan struct{}, line int) *Error {
+	select {
+	case <-done:
+		return &Error{Token{Type: interrupted, Line: line}, ctx.Err().Error()}
+	default:
+		return nil
 	}
-	i.env = i.globals
-	i.globals.Define("clock", &nf_clock{})
-	return i
 }
 
-func (i *Interpreter) Interpret(stmts []Stmt) {
+// interpret runs stmts, stopping at the first error.
+func (i *interpreter) interpret(stmts []stmt) *Error {
 	for _, s := range stmts {
-		err := i.exec(s)
+		if err := i.guarded(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// guarded executes a top-level statement, turning a Go panic into an error so
+// the host survives bugs in the interpreter.
+func (i *interpreter) guarded(s stmt) (err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{i.pos, fmt.Sprintf("internal error: %v", r)}
+			i.env = i.globals
+			i.depth = 0
+		}
+	}()
+	i.trace, i.callLine = i.trace[:0], 0
+	return i.exec(s)
+}
+
+// call calls fn for the host, which may be running a script already. It
+// returns the trace of the error, if any.
+func (i *interpreter) call(callee Value, args []Value) (v Value, trace []Frame, err *Error) {
+	env, depth, mark := i.env, i.depth, len(i.trace)
+	defer func() {
+		if r := recover(); r != nil {
+			v, err = Nil, &Error{i.pos, fmt.Sprintf("internal error: %v", r)}
+		}
 		if err != nil {
-			loxerr2(err)
+			trace = append(trace, i.trace[mark:]...)
 		}
+		i.env, i.depth, i.trace, i.callLine = env, depth, i.trace[:mark], 0
+	}()
+	fn, k := callee.Object().(callable)
+	if !k {
+		return Nil, nil, &Error{Token{}, "can only call functions and classes"}
+	}
+	if n := fn.Arity(); n >= 0 && len(args) != n {
+		return Nil, nil, &Error{Token{}, fmt.Sprintf("expected %d arguments but got %d", n, len(args))}
+	}
+	if i.depth >= i.MaxDepth {
+		return Nil, nil, exceeded(DepthLimit, 0)
+	}
+	i.depth++
+	_, script := fn.(*function)
+	if !script {
+		i.hooks.call(callee, args)
+	}
+	v, err = i.tasks.native(fn, i.ctx, i, args)
+	if !script && err == nil {
+		i.hooks.ret(callee, v)
 	}
+	return v, nil, err
 }
 
-func (i *Interpreter) exec(s Stmt) *Error {
-	_, err := s.Accept(i)
-	return err
+// unwind adds the frame of f to the trace of err.
+func (i *interpreter) unwind(f *function, elided int, err *Error) {
+	line := i.callLine
+	if line == 0 {
+		line = err.Token.Line
+	}
+	i.trace = append(i.trace, Frame{string(f.declaration.Name.Lexeme), line, elided})
+	i.callLine = 0
+}
+
+// tick is the slow path of counting the step of executing v.
+func (i *interpreter) tick(v interface{}) *Error {
+	if !i.step() {
+		return exceeded(StepLimit, i.pos.Line)
+	}
+	if line, kind, k := statementAt(v); k {
+		i.hooks.OnStatement(Statement{line, statementKinds[kind]}, Env{env: i.env})
+	}
+	return nil
 }
 
-func (i *Interpreter) eval(e Expr) (interface{}, *Error) {
-	return e.Accept(i)
+func (i *interpreter) exec(s stmt) *Error {
+	_, err := s.Accept(i)
+	return err
 }
 
-func (i *Interpreter) Visit(v interface{}) (interface{}, *Error) {
+// Visit executes statements. Expressions are evaluated by eval, which
+// doesn't box values into interface{}.
+func (i *interpreter) Visit(v interface{}) (interface{}, *Error) {
+	if i.steps--; i.steps < 0 {
+		if err := i.tick(v); err != nil {
+			return nil, err
+		}
+	}
 	switch a := v.(type) {
-	case *If:
+	case *ifStmt:
 		v, err := i.eval(a.Cond)
 		if err != nil {
 			return nil, err
@@ -73,59 +236,105 @@ func (i *Interpreter) Visit(v interface{}) (interface{}, *Error) {
 			err = i.exec(a.Else)
 		}
 		return nil, err
-	case *Return:
-		val := interface{}(nil)
-		var err *Error
+	case *returnStmt:
+		i.ret = Nil
 		if a.Value != nil {
-			val, err = i.eval(a.Value)
+			val, err := i.eval(a.Value)
+			if err != nil {
+				return nil, err
+			}
+			i.ret = val
 		}
-		if err != nil {
-			err = &Error{Token{Type: returnMe, Literal: val}, ""}
+		return nil, returning
+	case *blockStmt:
+		if len(a.Names) == 0 {
+			return nil, i.executeBlock(a.Stmts, i.env)
 		}
-		return nil, err
-	case *Block:
-		i.executeBlock(a.Stmts, NewEnvironment(i.env))
+		if err := i.allocenv(len(a.Names)); err != nil {
+			return nil, err
+		}
+		return nil, i.executeBlock(a.Stmts, newLocalEnvironment(i.env, a.Names))
+	case *testStmt:
+		// Tests are only run by `yalox test`.
 		return nil, nil
-	case *Expression:
+	case *selectStmt:
+		return nil, i.choose(a)
+	case *expressionStmt:
 		_, err := i.eval(a.Expr)
 		return nil, err
-	case *Function:
-		fn := &Func{a}
-		i.env.Define(string(a.Name.Lexeme), fn)
+	case *functionStmt:
+		if err := i.alloc(funcSize); err != nil {
+			err.Token.Line = a.Name.Line
+			return nil, err
+		}
+		fn := ObjectValue(&function{a, i.env})
+		if a.Local {
+			i.env.declare(a.Slot, fn)
+		} else {
+			i.globals.Define(string(a.Name.Lexeme), fn)
+		}
 		return nil, nil
-	case *Print:
+	case *printStmt:
 		v, err := i.eval(a.Expr)
-		if err == nil {
-			fmt.Println(stringify(v))
+		if err != nil {
+			return nil, err
 		}
-		return nil, err
-	case *Var:
-		var val interface{}
+		s := stringify(v)
+		if err := i.write(len(s)); err != nil {
+			err.Token.Line = i.pos.Line
+			return nil, err
+		}
+		fmt.Fprintln(i.Stdout, s)
+		return nil, nil
+	case *varStmt:
+		val := Nil
 		var err *Error
 		if a.Init != nil {
 			val, err = i.eval(a.Init)
 		}
-		i.env.Define(string(a.Name.Lexeme), val)
-		return nil, err
-	case *While:
-		v, err := i.eval(a.Cond)
-		if err != nil {
-			return nil, err
+		if a.Local {
+			i.env.declare(a.Slot, val)
+		} else {
+			i.globals.Define(string(a.Name.Lexeme), val)
 		}
-		for istruthy(v) {
-			err := i.exec(a.Body)
+		return nil, err
+	case *whileStmt:
+		for {
+			i.pos = a.Keyword
+			v, err := i.eval(a.Cond)
 			if err != nil {
 				return nil, err
 			}
+			if !istruthy(v) {
+				return nil, nil
+			}
+			err = i.exec(a.Body)
+			if err != nil {
+				return nil, err
+			}
+			if i.done != nil {
+				if err := stopped(i.ctx, i.done, a.Keyword.Line); err != nil {
+					return nil, err
+				}
+			}
+			if i.watched {
+				i.hooks.OnStatement(Statement{a.Keyword.Line, "while"}, Env{env: i.env})
+			}
 		}
-		return nil, nil
-		//
-	case *Literal:
+	case expr:
+		return i.eval(a)
+	}
+	return nil, &Error{i.pos, fmt.Sprintf("can't execute %T", v)}
+}
+
+func (i *interpreter) eval(e expr) (Value, *Error) {
+	switch a := e.(type) {
+	case *literalExpr:
 		return a.Val, nil
-	case *Logical:
+	case *logicalExpr:
 		l, err := i.eval(a.Left)
 		if err != nil {
-			return nil, err
+			return Nil, err
 		}
 		switch a.Op.Type {
 		case tokenOr:
@@ -137,112 +346,304 @@ func (i *Interpreter) Visit(v interface{}) (interface{}, *Error) {
 				return l, nil
 			}
 		default:
-			panic("unreachable")
+			return Nil, &Error{a.Op, "unknown logical operator"}
 		}
 		return i.eval(a.Right)
-	case *Grouping:
+	case *groupingExpr:
 		return i.eval(a.Expr)
-	case *Unary:
+	case *unaryExpr:
+		i.pos = a.Op
 		r, err := i.eval(a.Right)
+		if err != nil {
+			return Nil, err
+		}
 		switch a.Op.Type {
 		case tokenMinus:
 			v, err := i.maybefloat(a.Op, r)
-			return -v, err
+			return NumberValue(-v), err
 		case tokenBang:
-			return !istruthy(r), err
+			return BoolValue(!istruthy(r)), nil
 		}
-		panic("unreachable")
-	case *Binary:
+		return Nil, &Error{a.Op, "unknown unary operator"}
+	case *binaryExpr:
+		i.pos = a.Op
 		l, err := i.eval(a.Left)
 		if err != nil {
-			return nil, err
+			return Nil, err
 		}
 		r, err := i.eval(a.Right)
 		if err != nil {
-			return nil, err
+			return Nil, err
 		}
 		switch a.Op.Type {
 		case tokenMinus:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl - fr, err
+			return NumberValue(fl - fr), err
 		case tokenSlash:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl / fr, err
+			return NumberValue(fl / fr), err
 		case tokenStar:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl * fr, err
+			return NumberValue(fl * fr), err
 		case tokenPlus:
-			switch le := l.(type) {
-			case float64:
-				if re, k := r.(float64); k {
-					return le + re, nil
-				}
-				goto fail
-			case []byte:
-				if re, k := r.([]byte); k {
-					return append(le, re...), nil
+			if l.kind == KindNumber && r.kind == KindNumber {
+				return NumberValue(l.num + r.num), nil
+			}
+			if l.kind == KindString && r.kind == KindString {
+				le, re := l.Bytes(), r.Bytes()
+				if err := i.alloc(int64(len(le) + len(re))); err != nil {
+					err.Token.Line = a.Op.Line
+					return Nil, err
 				}
-				goto fail
+				// le may point into the source, don't append in place
+				s := make([]byte, 0, len(le)+len(re))
+				return StringValue(append(append(s, le...), re...)), nil
 			}
-		fail:
-			return nil, &Error{a.Op, "both operands must be either strings or numbers"}
+			return Nil, &Error{a.Op, "both operands must be either strings or numbers"}
 		case tokenGreater:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl > fr, err
+			return BoolValue(fl > fr), err
 		case tokenGreaterEqual:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl >= fr, err
+			return BoolValue(fl >= fr), err
 		case tokenLess:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl < fr, err
+			return BoolValue(fl < fr), err
 		case tokenLessEqual:
 			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl <= fr, err
+			return BoolValue(fl <= fr), err
 		case tokenEqualEqual:
-			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl == fr, err
+			return BoolValue(isequal(l, r)), nil
 		case tokenBangEqual:
-			fl, fr, err := i.maybefloats(a.Op, l, r)
-			return fl != fr, err
+			return BoolValue(!isequal(l, r)), nil
+		}
+		return Nil, &Error{a.Op, "unknown binary operator"}
+	case *callExpr:
+		i.pos = a.Paren
+		if i.done != nil {
+			if err := stopped(i.ctx, i.done, a.Paren.Line); err != nil {
+				return Nil, err
+			}
 		}
-	case *Call:
 		callee, err := i.eval(a.Callee)
 		if err != nil {
-			return nil, err
+			return Nil, err
 		}
 
-		args := make([]interface{}, 0, 10)
+		args := make([]Value, 0, len(a.Args))
 		for _, ar := range a.Args {
 			v, err := i.eval(ar)
 			if err != nil {
-				return nil, err
+				return Nil, err
 			}
 			args = append(args, v)
 		}
-		fn, k := callee.(Callable)
+		fn, k := callee.Object().(callable)
 		if !k {
-			return nil, &Error{a.Paren, "can only call functions and classes"}
+			return Nil, &Error{a.Paren, "can only call functions and classes"}
+		}
+		if n := fn.Arity(); n >= 0 && len(args) != n {
+			return Nil, &Error{a.Paren, fmt.Sprintf("expected %d arguments but got %d", fn.Arity(), len(args))}
+		}
+		if f, k := fn.(*function); k && a.Tail && !f.declaration.Generator {
+			i.tail, i.args = f, args
+			return Nil, tailcalling
+		}
+		if i.depth >= i.MaxDepth {
+			return Nil, exceeded(DepthLimit, a.Paren.Line)
+		}
+		i.depth++
+		_, script := fn.(*function)
+		if !script {
+			i.hooks.call(callee, args)
 		}
-		if len(args) != fn.Arity() {
-			return nil, &Error{a.Paren, fmt.Sprintf("expected %d arguments but got %d", len(args), fn.Arity())}
+		v, err := i.tasks.native(fn, i.ctx, i, args)
+		i.depth--
+		if !script && err == nil {
+			i.hooks.ret(callee, v)
 		}
-		return fn.Call(i, args)
+		if err != nil {
+			if err.Token.Line == 0 {
+				// Natives don't know where they were called from
+				err.Token.Line = a.Paren.Line
+			}
+			if _, k := fn.(*function); k {
+				i.callLine = a.Paren.Line
+			}
+		}
+		return v, err
 
-	case *Variable:
-		v, err := i.env.Get(a.Name)
+	case *getExpr:
+		obj, err := i.eval(a.Object)
+		if err != nil {
+			return Nil, err
+		}
+		inst, k := obj.Object().(instance)
+		if !k {
+			return Nil, &Error{a.Name, "only objects have properties"}
+		}
+		v, err := inst.Get(string(a.Name.Lexeme))
+		if err != nil && err.Token.Line == 0 {
+			err.Token.Line = a.Name.Line
+		}
 		return v, err
-	case *Assign:
+	case *setExpr:
+		obj, err := i.eval(a.Object)
+		if err != nil {
+			return Nil, err
+		}
+		inst, k := obj.Object().(instance)
+		if !k {
+			return Nil, &Error{a.Name, "only objects have properties"}
+		}
+		v, err := i.eval(a.Val)
+		if err != nil {
+			return Nil, err
+		}
+		if err := inst.Set(string(a.Name.Lexeme), v); err != nil {
+			if err.Token.Line == 0 {
+				err.Token.Line = a.Name.Line
+			}
+			return Nil, err
+		}
+		return v, nil
+	case *variableExpr:
+		if a.Local {
+			return i.env.GetAt(a.Depth, a.Slot), nil
+		}
+		i.pos = a.Name
+		if g := a.cache.lookup(i.globals, a.Name.Lexeme); g != nil {
+			return g.val, nil
+		}
+		return i.env.Get(a.Name)
+	case *assignExpr:
 		value, err := i.eval(a.Val)
 		if err != nil {
-			return nil, err
+			return Nil, err
+		}
+		if a.Local {
+			i.env.AssignAt(a.Depth, a.Slot, value)
+			return value, nil
+		}
+		if g := a.cache.lookup(i.globals, a.Name.Lexeme); g != nil {
+			g.val = value
+			return value, nil
 		}
 		err = i.env.Assign(a.Name, value)
 		return value, err
+	case *spawnExpr:
+		return i.spawn(a)
+	case *yieldExpr:
+		v, err := i.eval(a.Value)
+		if err != nil {
+			return Nil, err
+		}
+		if i.co == nil {
+			return Nil, &Error{a.Keyword, "can't yield outside of a generator"}
+		}
+		return i.co.yield(v), nil
 	}
-	panic("unreachable")
+	return Nil, &Error{i.pos, fmt.Sprintf("can't evaluate %T", e)}
 }
 
-func (i *Interpreter) executeBlock(stmts []Stmt, env *Environment) *Error {
+// generate makes a generator calling f with args.
+func (i *interpreter) generate(f *function, args []Value) (Value, *Error) {
+	if i.tasks == nil {
+		return Nil, &Error{Token{}, "can't make generators outside of a VM"}
+	}
+	if err := i.alloc(genSize); err != nil {
+		return Nil, err
+	}
+	e := i.fork()
+	e.co = newCoroutine()
+	return ObjectValue(i.tasks.generate(e, e.co, ObjectValue(f), args)), nil
+}
+
+// spawn evaluates the call of a spawn and starts a task making it.
+func (i *interpreter) spawn(a *spawnExpr) (Value, *Error) {
+	i.pos = a.Keyword
+	callee, err := i.eval(a.Call.Callee)
+	if err != nil {
+		return Nil, err
+	}
+	args := make([]Value, 0, len(a.Call.Args))
+	for _, ar := range a.Call.Args {
+		v, err := i.eval(ar)
+		if err != nil {
+			return Nil, err
+		}
+		args = append(args, v)
+	}
+	fn, k := callee.Object().(callable)
+	if !k {
+		return Nil, &Error{a.Call.Paren, "can only call functions and classes"}
+	}
+	if n := fn.Arity(); n >= 0 && len(args) != n {
+		return Nil, &Error{a.Call.Paren, fmt.Sprintf("expected %d arguments but got %d", n, len(args))}
+	}
+	if i.tasks == nil {
+		return Nil, &Error{a.Keyword, "can't spawn tasks outside of a VM"}
+	}
+	if err := i.alloc(taskSize); err != nil {
+		err.Token.Line = a.Keyword.Line
+		return Nil, err
+	}
+	return ObjectValue(i.tasks.spawn(i.fork(), callee, args)), nil
+}
+
+// choose runs a select statement.
+func (i *interpreter) choose(a *selectStmt) *Error {
+	vals := make([]Value, 0, 2*len(a.Cases))
+	for _, c := range a.Cases {
+		v, err := i.eval(c.Chan)
+		if err != nil {
+			return err
+		}
+		vals = append(vals, v)
+		if c.Value != nil {
+			if v, err = i.eval(c.Value); err != nil {
+				return err
+			}
+		}
+		vals = append(vals, v)
+	}
+	i.pos = a.Keyword
+	cases := make([]selectCase, len(a.Cases))
+	for k, c := range a.Cases {
+		ch, ok := vals[2*k].Object().(*channel)
+		if !ok {
+			return &Error{a.Keyword, "can only select on channels"}
+		}
+		cases[k] = selectCase{ch, c.Value != nil, vals[2*k+1]}
+	}
+	if i.tasks == nil {
+		return &Error{a.Keyword, "can't select outside of a VM"}
+	}
+	k, v, err := i.tasks.selects(cases, a.Default == nil)
+	if err != nil {
+		if err.Token.Line == 0 {
+			err.Token.Line = a.Keyword.Line
+		}
+		return err
+	}
+	if k < 0 {
+		return i.exec(a.Default)
+	}
+	c := a.Cases[k]
+	if len(c.Names) == 0 {
+		return i.executeBlock(c.Body, i.env)
+	}
+	if err := i.allocenv(len(c.Names)); err != nil {
+		return err
+	}
+	env := newLocalEnvironment(i.env, c.Names)
+	if c.Name.Lexeme != nil {
+		env.declare(0, v)
+	}
+	return i.executeBlock(c.Body, env)
+}
+
+func (i *interpreter) executeBlock(stmts []stmt, env *environment) *Error {
 	// i cross my fingers
 	prev := i.env
 	defer func() { i.env = prev }()
@@ -256,52 +657,27 @@ func (i *Interpreter) executeBlock(stmts []Stmt, env *Environment) *Error {
 	return nil
 }
 
-func (i *Interpreter) maybefloat(t Token, v interface{}) (float64, *Error) {
-	var err *Error
-	f, k := v.(float64)
-	if !k {
-		err = &Error{t, "operand must be a number"}
-	}
-	return f, err
-}
-
-func (i *Interpreter) maybefloats(t Token, lv interface{}, rv interface{}) (float64, float64, *Error) {
-	var err *Error
-	l, kl := lv.(float64)
-	r, kr := rv.(float64)
-	if !(kl && kr) {
-		err = &Error{t, "operands must be numbers"}
+// allocenv charges the memory quota for an environment of n slots.
+func (i *interpreter) allocenv(n int) *Error {
+	err := i.alloc(envSize + int64(n)*valueSize)
+	if err != nil {
+		err.Token.Line = i.pos.Line
 	}
-	return l, r, err
-}
-
-func istruthy(v interface{}) bool {
-	if b, k := v.(bool); k {
-		return b
-	} else if v == nil {
-		return false
-	}
-	return true
+	return err
 }
 
-func isequal(a interface{}, b interface{}) bool {
-	if a == nil && b == nil {
-		return true
-	} else if a == nil {
-		return false
+func (i *interpreter) maybefloat(t Token, v Value) (float64, *Error) {
+	if v.kind != KindNumber {
+		return 0, &Error{t, "operand must be a number"}
 	}
-	return a == b
+	return v.num, nil
 }
 
-func stringify(v interface{}) string {
-	if v == nil {
-		return "nil"
-	}
-	// Go doesn't print decimal automatically, but byte slices must be treated
-	if s, k := v.([]byte); k {
-		return string(s)
+func (i *interpreter) maybefloats(t Token, l Value, r Value) (float64, float64, *Error) {
+	if l.kind != KindNumber || r.kind != KindNumber {
+		return 0, 0, &Error{t, "operands must be numbers"}
 	}
-	return fmt.Sprint(v)
+	return l.num, r.num, nil
 }
 
-var _ = Visitor(&Interpreter{})
+var _ = visitor(&interpreter{})
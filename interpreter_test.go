@@ -0,0 +1,100 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// buggy is a callable that panics, like a bug in an engine would.
+type buggy struct{}
+
+func (buggy) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	var m map[string]int
+	m["x"] = 1
+	return Nil, nil
+}
+
+func (buggy) Arity() int { return 0 }
+
+// TestInternalErrors checks that a Go panic in an engine ends the statement
+// with an error, and that the engine goes on with the next one.
+func TestInternalErrors(t *testing.T) {
+	p, diags := Compile([]byte(`
+fun f(n) { return n + 1; }
+fun g() { return bug(); }
+print f(g());
+print f(1);
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	const want = "internal error: assignment to entry in nil map"
+
+	var out bytes.Buffer
+	i := newInterpreter(newEnvironment(nil))
+	i.Stdout = &out
+	i.globals.Define("bug", ObjectValue(buggy{}))
+	for n, s := range p.stmts {
+		err := i.interpret([]stmt{s})
+		if n == 2 && (err == nil || err.Message != want || err.Token.Line != 3) {
+			t.Errorf("tree: got %v, want %q at line 3", err, want)
+		} else if n != 2 && err != nil {
+			t.Errorf("tree: %v", err)
+		}
+	}
+	if i.depth != 0 || i.env != i.globals || out.String() != "2\n" {
+		t.Errorf("tree: depth %d after the panic, printed %q", i.depth, out.String())
+	}
+
+	scripts, cerr := p.compiled()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	out.Reset()
+	vm := newMachine(newEnvironment(nil))
+	vm.Stdout = &out
+	vm.globals.Define("bug", ObjectValue(buggy{}))
+	for n, s := range scripts {
+		err := vm.Run(s)
+		if n == 2 && (err == nil || err.Message != want) {
+			t.Errorf("vm: got %v, want %q", err, want)
+		} else if n != 2 && err != nil {
+			t.Errorf("vm: %v", err)
+		}
+	}
+	if len(vm.frames) != 0 || out.String() != "2\n" {
+		t.Errorf("vm: %d frames after the panic, printed %q", len(vm.frames), out.String())
+	}
+}
+
+// TestStackOverflow checks that recursion going past the default depth is a
+// Lox error rather than the Go stack running out.
+func TestStackOverflow(t *testing.T) {
+	p, diags := Compile([]byte(`
+fun down(n) { return 1 + down(n + 1); }
+down(0);
+`))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	i := newInterpreter(newEnvironment(nil))
+	err := i.interpret(p.stmts)
+	if err == nil || err.Message != "stack overflow" || err.Token.Line != 2 {
+		t.Errorf("tree: got %v, want a stack overflow at line 2", err)
+	}
+	if i.depth != 0 {
+		t.Errorf("tree: depth is %d after the overflow", i.depth)
+	}
+
+	scripts, cerr := p.compiled()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	vm := newMachine(newEnvironment(nil))
+	vm.Run(scripts[0])
+	err = vm.Run(scripts[1])
+	if err == nil || err.Message != "stack overflow" || err.Token.Line != 2 {
+		t.Errorf("vm: got %v, want a stack overflow at line 2", err)
+	}
+}
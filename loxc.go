@@ -0,0 +1,407 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+)
+
+// A .loxc file holds the compiled scripts of a program:
+//
+//	magic    "LOXC"
+//	version  uint16, big endian
+//	crc      uint32 of the rest of the file, big endian
+//	count    uvarint number of scripts, then the scripts as protos
+//
+// A proto is its name, the global it declares, arity, whether it's a
+// generator, upvalues, locals, code, lines, statements and constants.
+// Strings and byte slices are prefixed with their uvarint length, lines are
+// run-length encoded as (line, count) pairs, statements are (offset from the
+// previous one, line) pairs, and every constant starts with one of the loxc*
+// tags.
+const (
+	loxcMagic = "LOXC"
+	// Version 2 added opTailCall, version 3 property access, version 4
+	// statements, version 5 opSpawn and opSelect, version 6 generators,
+	// version 7 declared globals, version 8 names for hooks.
+	loxcVersion = 8
+)
+
+const (
+	loxcNil = iota
+	loxcFalse
+	loxcTrue
+	loxcNumber
+	loxcString
+	loxcProto
+)
+
+// maxProtoDepth bounds nesting of functions in a file, so loading can't blow
+// the stack.
+const maxProtoDepth = 200
+
+// IsBytecode tells if bs looks like a .loxc file.
+func IsBytecode(bs []byte) bool {
+	return bytes.HasPrefix(bs, []byte(loxcMagic))
+}
+
+// encodeScripts serializes compiled scripts into the .loxc format.
+func encodeScripts(scripts []*proto) []byte {
+	var body bytes.Buffer
+	putUvarint(&body, uint64(len(scripts)))
+	for _, s := range scripts {
+		encodeProto(&body, s)
+	}
+	var out bytes.Buffer
+	out.WriteString(loxcMagic)
+	binary.Write(&out, binary.BigEndian, uint16(loxcVersion))
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(body.Bytes()))
+	out.Write(body.Bytes())
+	return out.Bytes()
+}
+
+func putUvarint(b *bytes.Buffer, n uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], n)])
+}
+
+func putBytes(b *bytes.Buffer, bs []byte) {
+	putUvarint(b, uint64(len(bs)))
+	b.Write(bs)
+}
+
+func encodeProto(b *bytes.Buffer, p *proto) {
+	putBytes(b, []byte(p.Name))
+	putBytes(b, []byte(p.Declares))
+	putUvarint(b, uint64(p.Arity))
+	generator := byte(0)
+	if p.Generator {
+		generator = 1
+	}
+	b.WriteByte(generator)
+	putUvarint(b, uint64(len(p.Upvalues)))
+	for _, u := range p.Upvalues {
+		local := byte(0)
+		if u.Local {
+			local = 1
+		}
+		b.WriteByte(local)
+		b.WriteByte(u.Index)
+		putBytes(b, []byte(u.Name))
+	}
+	putUvarint(b, uint64(len(p.Locals)))
+	for _, l := range p.Locals {
+		putBytes(b, []byte(l))
+	}
+	putBytes(b, p.Chunk.Code)
+
+	var runs [][2]int
+	for _, l := range p.Chunk.Lines {
+		if n := len(runs); n > 0 && runs[n-1][0] == l {
+			runs[n-1][1]++
+		} else {
+			runs = append(runs, [2]int{l, 1})
+		}
+	}
+	putUvarint(b, uint64(len(runs)))
+	for _, r := range runs {
+		putUvarint(b, uint64(r[0]))
+		putUvarint(b, uint64(r[1]))
+	}
+
+	putUvarint(b, uint64(len(p.Chunk.stmts)))
+	prev := 0
+	for _, s := range p.Chunk.stmts {
+		putUvarint(b, uint64(s.ip-prev))
+		putUvarint(b, uint64(s.line))
+		b.WriteByte(s.kind)
+		putUvarint(b, uint64(len(s.locals)))
+		for _, l := range s.locals {
+			putBytes(b, []byte(l))
+		}
+		prev = s.ip
+	}
+
+	putUvarint(b, uint64(len(p.Chunk.Consts)))
+	for _, c := range p.Chunk.Consts {
+		switch c.Kind() {
+		case KindNil:
+			b.WriteByte(loxcNil)
+		case KindBool:
+			if c.Bool() {
+				b.WriteByte(loxcTrue)
+			} else {
+				b.WriteByte(loxcFalse)
+			}
+		case KindNumber:
+			b.WriteByte(loxcNumber)
+			binary.Write(b, binary.BigEndian, math.Float64bits(c.Number()))
+		case KindString:
+			b.WriteByte(loxcString)
+			putBytes(b, c.Bytes())
+		default:
+			// The compiler puts nothing else than prototypes in constants.
+			b.WriteByte(loxcProto)
+			encodeProto(b, c.Object().(*proto))
+		}
+	}
+}
+
+// decodeScripts loads and validates scripts written by encodeScripts.
+func decodeScripts(bs []byte) ([]*proto, error) {
+	if !IsBytecode(bs) {
+		return nil, errors.New("not a yalox bytecode file")
+	}
+	if len(bs) < 10 {
+		return nil, errors.New("corrupt bytecode: truncated header")
+	}
+	if v := binary.BigEndian.Uint16(bs[4:]); v != loxcVersion {
+		return nil, fmt.Errorf("bytecode version %d is not supported, want %d; recompile the script", v, loxcVersion)
+	}
+	body := bs[10:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(bs[6:]) {
+		return nil, errors.New("corrupt bytecode: checksum mismatch")
+	}
+	d := &decoder{buf: body}
+	n := d.count()
+	scripts := make([]*proto, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		scripts = append(scripts, d.proto(0, nil))
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("%d trailing bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return scripts, nil
+}
+
+type decoder struct {
+	buf []byte
+	err error
+	// what is decoded, bytecode if empty.
+	what string
+}
+
+func (d *decoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		what := d.what
+		if what == "" {
+			what = "bytecode"
+		}
+		d.err = fmt.Errorf("corrupt "+what+": "+format, args...)
+	}
+	d.buf = nil
+}
+
+func (d *decoder) uvarint() uint64 {
+	n, size := binary.Uvarint(d.buf)
+	if size <= 0 {
+		d.fail("bad number")
+		return 0
+	}
+	d.buf = d.buf[size:]
+	return n
+}
+
+// count reads a length, which can't be more than the bytes left.
+func (d *decoder) count() int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.fail("length %d out of range", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail("unexpected end of file")
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.count()
+	bs := make([]byte, n)
+	copy(bs, d.buf[:n])
+	d.buf = d.buf[n:]
+	return bs
+}
+
+func (d *decoder) proto(depth int, enclosing *proto) *proto {
+	if depth > maxProtoDepth {
+		d.fail("functions nested too deep")
+		return nil
+	}
+	p := &proto{Name: string(d.bytes()), Declares: string(d.bytes())}
+	if p.Arity = int(d.uvarint()); p.Arity > 255 {
+		d.fail("arity %d out of range", p.Arity)
+	}
+	p.Generator = d.byte() == 1
+	nup := d.count()
+	for i := 0; i < nup && d.err == nil; i++ {
+		p.Upvalues = append(p.Upvalues, upvalueRef{d.byte() == 1, d.byte(), string(d.bytes())})
+	}
+	nlocals := d.count()
+	for i := 0; i < nlocals && d.err == nil; i++ {
+		p.Locals = append(p.Locals, string(d.bytes()))
+	}
+	p.Chunk.Code = d.bytes()
+
+	nruns := d.count()
+	for i := 0; i < nruns && d.err == nil; i++ {
+		line, n := int(d.uvarint()), int(d.uvarint())
+		if n > len(p.Chunk.Code)-len(p.Chunk.Lines) {
+			d.fail("too many lines")
+			break
+		}
+		for j := 0; j < n; j++ {
+			p.Chunk.Lines = append(p.Chunk.Lines, line)
+		}
+	}
+
+	nstmts := d.count()
+	ip := 0
+	for i := 0; i < nstmts && d.err == nil; i++ {
+		delta, line, kind := d.uvarint(), int(d.uvarint()), d.byte()
+		if delta >= uint64(len(p.Chunk.Code)-ip) {
+			d.fail("statement out of code")
+			break
+		}
+		if int(kind) >= len(statementKinds) {
+			d.fail("unknown statement kind %d", kind)
+			break
+		}
+		ip += int(delta)
+		s := stmtStart{ip: ip, line: line, kind: kind}
+		nlocals := d.count()
+		for j := 0; j < nlocals && d.err == nil; j++ {
+			s.locals = append(s.locals, string(d.bytes()))
+		}
+		p.Chunk.stmts = append(p.Chunk.stmts, s)
+	}
+
+	nconsts := d.count()
+	for i := 0; i < nconsts && d.err == nil; i++ {
+		switch tag := d.byte(); tag {
+		case loxcNil:
+			p.Chunk.Consts = append(p.Chunk.Consts, Nil)
+		case loxcFalse, loxcTrue:
+			p.Chunk.Consts = append(p.Chunk.Consts, BoolValue(tag == loxcTrue))
+		case loxcNumber:
+			if len(d.buf) < 8 {
+				d.fail("unexpected end of file")
+				break
+			}
+			f := math.Float64frombits(binary.BigEndian.Uint64(d.buf))
+			d.buf = d.buf[8:]
+			p.Chunk.Consts = append(p.Chunk.Consts, NumberValue(f))
+		case loxcString:
+			p.Chunk.Consts = append(p.Chunk.Consts, StringValue(d.bytes()))
+		case loxcProto:
+			p.Chunk.Consts = append(p.Chunk.Consts, ObjectValue(d.proto(depth+1, p)))
+		default:
+			d.fail("unknown constant tag %d", tag)
+		}
+	}
+	p.Chunk.caches = make([]globalCache, len(p.Chunk.Consts))
+	if d.err == nil {
+		if err := verify(p, enclosing); err != nil {
+			d.fail("%s: %s", p, err)
+		}
+	}
+	return p
+}
+
+// verify checks the structure of p: every instruction is complete, operands
+// point at constants of the right kind, jumps land on instructions and the
+// code can't run off its end. Stack slots aren't checked; machine.Run survives bad
+// ones.
+func verify(p *proto, enclosing *proto) error {
+	ch := &p.Chunk
+	if len(ch.Lines) != len(ch.Code) {
+		return fmt.Errorf("%d lines for %d bytes of code", len(ch.Lines), len(ch.Code))
+	}
+	for _, u := range p.Upvalues {
+		if enclosing == nil {
+			return errors.New("script with upvalues")
+		}
+		if !u.Local && int(u.Index) >= len(enclosing.Upvalues) {
+			return fmt.Errorf("upvalue %d out of range", u.Index)
+		}
+	}
+
+	starts := make([]bool, len(ch.Code)+1)
+	var jumps []int
+	last := -1
+	for ip := 0; ip < len(ch.Code); {
+		op := ch.Code[ip]
+		if int(op) >= len(opnames) {
+			return fmt.Errorf("bad opcode %d at %04d", op, ip)
+		}
+		starts[ip] = true
+		last = ip
+		n := operands(op)
+		if ip+1+n > len(ch.Code) {
+			return fmt.Errorf("truncated %s at %04d", opnames[op], ip)
+		}
+		arg := 0
+		if n == 2 {
+			arg = int(ch.Code[ip+1])<<8 | int(ch.Code[ip+2])
+		} else if n == 1 {
+			arg = int(ch.Code[ip+1])
+		}
+		switch op {
+		case opConstant:
+			if arg >= len(ch.Consts) || ch.Consts[arg].Kind() == KindObject {
+				return fmt.Errorf("bad constant %d at %04d", arg, ip)
+			}
+		case opGetGlobal, opDefineGlobal, opSetGlobal, opGetProperty, opSetProperty:
+			if arg >= len(ch.Consts) || ch.Consts[arg].Kind() != KindString {
+				return fmt.Errorf("bad name %d at %04d", arg, ip)
+			}
+		case opClosure:
+			if arg >= len(ch.Consts) {
+				return fmt.Errorf("bad function %d at %04d", arg, ip)
+			}
+			if _, k := ch.Consts[arg].Object().(*proto); !k {
+				return fmt.Errorf("bad function %d at %04d", arg, ip)
+			}
+		case opGetUpvalue, opSetUpvalue:
+			if arg >= len(p.Upvalues) {
+				return fmt.Errorf("bad upvalue %d at %04d", arg, ip)
+			}
+		case opJump, opJumpIfFalse:
+			jumps = append(jumps, ip+3+arg)
+		case opLoop:
+			jumps = append(jumps, ip+3-arg)
+		case opYield:
+			if !p.Generator {
+				return fmt.Errorf("yield outside of a generator at %04d", ip)
+			}
+		}
+		ip += 1 + n
+	}
+	if last < 0 || ch.Code[last] != opReturn {
+		return errors.New("code doesn't end with return")
+	}
+	for _, to := range jumps {
+		if to < 0 || to >= len(ch.Code) || !starts[to] {
+			return fmt.Errorf("jump to %04d is out of code", to)
+		}
+	}
+	for _, s := range ch.stmts {
+		if !starts[s.ip] {
+			return fmt.Errorf("statement at %04d is out of code", s.ip)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+)
+
+const loxcScript = `
+var n = 0;
+fun counter() { var k = 0; fun inc() { k = k + 1; n = n + 1; return k; } return inc; }
+fun evens() { var k = 0; while (true) { yield k; k = k + 2; } }
+fun first(k) { for (var x in evens()) if (x > k) return x; }
+var c = counter();
+c();
+print c() + n + first(3) + 0.5;
+print "done";
+`
+
+func TestLoadBytecodeCorrupt(t *testing.T) {
+	p, diags := Compile([]byte(loxcScript))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	bs, err := p.Bytecode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadBytecode(bs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := NewVM(Stdout(&out)).Run(context.Background(), loaded); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "8.5\ndone\n" {
+		t.Errorf("loaded program printed %q", out.String())
+	}
+
+	// reseal fixes the checksum of a file whose body was changed.
+	reseal := func(bs []byte) []byte {
+		bs = append([]byte{}, bs...)
+		binary.BigEndian.PutUint32(bs[6:], crc32.ChecksumIEEE(bs[10:]))
+		return bs
+	}
+	bad := func(what string, bs []byte, want string) {
+		t.Helper()
+		_, err := LoadBytecode(bs)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got %v, want %q", what, err, want)
+		}
+	}
+
+	bad("magic", append([]byte("LOXD"), bs[4:]...), "not a yalox bytecode file")
+	bad("empty", nil, "not a yalox bytecode file")
+	old := append([]byte{}, bs...)
+	binary.BigEndian.PutUint16(old[4:], loxcVersion-1)
+	bad("version", old, "bytecode version 7 is not supported, want 8")
+	flipped := append([]byte{}, bs...)
+	flipped[len(flipped)/2] ^= 0x40
+	bad("crc", flipped, "checksum mismatch")
+	bad("trailing", reseal(append(bs, 0)), "1 trailing bytes")
+
+	for n := 4; n < 10; n++ {
+		bad("header", bs[:n], "truncated header")
+	}
+	for n := 10; n < len(bs); n++ {
+		bad("body", bs[:n], "checksum mismatch")
+		// With the checksum fixed, the decoder itself has to notice.
+		if _, err := LoadBytecode(reseal(bs[:n])); err == nil {
+			t.Errorf("loaded %d of %d bytes", n, len(bs))
+		}
+	}
+}
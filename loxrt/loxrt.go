@@ -0,0 +1,462 @@
+// Package loxrt is the runtime of Lox programs translated to Go by
+// `yalox build --emit=go`. It mirrors the semantics of the interpreter.
+package loxrt
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type kind uint8
+
+const (
+	kindNil kind = iota
+	kindBool
+	kindNumber
+	kindString
+	kindFunc
+)
+
+// Value is a Lox value.
+type Value struct {
+	kind kind
+	num  float64
+	str  string
+	fn   *Func
+}
+
+var (
+	Nil   = Value{}
+	True  = Value{kind: kindBool, num: 1}
+	False = Value{kind: kindBool}
+)
+
+func Num(f float64) Value {
+	return Value{kind: kindNumber, num: f}
+}
+
+func Str(s string) Value {
+	return Value{kind: kindString, str: s}
+}
+
+func Bool(b bool) Value {
+	if b {
+		return True
+	}
+	return False
+}
+
+// Func is a Lox function or a native.
+type Func struct {
+	Name   string
+	Arity  int
+	Fn     func(args []Value) Value
+	native bool
+}
+
+func NewFunc(name string, arity int, fn func(args []Value) Value) Value {
+	return Value{kind: kindFunc, fn: &Func{Name: name, Arity: arity, Fn: fn}}
+}
+
+// Error is a runtime error. Raise it with Fail.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func Fail(line int, msg string) {
+	panic(&Error{line, msg})
+}
+
+func Truthy(v Value) bool {
+	switch v.kind {
+	case kindNil:
+		return false
+	case kindBool:
+		return v.num != 0
+	}
+	return true
+}
+
+func equal(a, b Value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case kindNil:
+		return true
+	case kindBool, kindNumber:
+		return a.num == b.num
+	case kindString:
+		return a.str == b.str
+	}
+	return a.fn == b.fn
+}
+
+func Equal(l, r Value) Value {
+	return Bool(equal(l, r))
+}
+
+func NotEqual(l, r Value) Value {
+	return Bool(!equal(l, r))
+}
+
+func Not(v Value) Value {
+	return Bool(!Truthy(v))
+}
+
+func Neg(v Value, line int) Value {
+	if v.kind != kindNumber {
+		Fail(line, "operand must be a number")
+	}
+	return Num(-v.num)
+}
+
+func Add(l, r Value, line int) Value {
+	if l.kind == kindNumber && r.kind == kindNumber {
+		return Num(l.num + r.num)
+	}
+	if l.kind == kindString && r.kind == kindString {
+		return Str(l.str + r.str)
+	}
+	Fail(line, "both operands must be either strings or numbers")
+	return Nil
+}
+
+func numbers(l, r Value, line int) (float64, float64) {
+	if l.kind != kindNumber || r.kind != kindNumber {
+		Fail(line, "operands must be numbers")
+	}
+	return l.num, r.num
+}
+
+func Sub(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Num(a - b)
+}
+
+func Mul(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Num(a * b)
+}
+
+func Div(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Num(a / b)
+}
+
+func Greater(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Bool(a > b)
+}
+
+func GreaterEqual(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Bool(a >= b)
+}
+
+func Less(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Bool(a < b)
+}
+
+func LessEqual(l, r Value, line int) Value {
+	a, b := numbers(l, r, line)
+	return Bool(a <= b)
+}
+
+func stringify(v Value) string {
+	switch v.kind {
+	case kindNil:
+		return "nil"
+	case kindBool:
+		return fmt.Sprint(v.num != 0)
+	case kindNumber:
+		return fmt.Sprint(v.num)
+	case kindString:
+		return v.str
+	}
+	if v.fn.native {
+		return "<native fn>"
+	}
+	return "<fn " + v.fn.Name + ">"
+}
+
+func repr(v Value) string {
+	if v.kind == kindString {
+		return fmt.Sprintf("%q", v.str)
+	}
+	return stringify(v)
+}
+
+func Print(v Value) {
+	fmt.Println(stringify(v))
+}
+
+// MaxDepth is the maximum depth of nested calls.
+var MaxDepth = 10000
+
+var depth int
+
+// tail is the call a function returned with TailCall, which the Call it
+// returns to makes.
+var tail struct {
+	fn   *Func
+	args []Value
+}
+
+func Call(callee Value, line int, args ...Value) Value {
+	fn := callable(callee, line, args)
+	if depth >= MaxDepth {
+		Fail(line, "stack overflow")
+	}
+	depth++
+	var v Value
+	if fn.native {
+		v = callNative(fn, line, args)
+	} else {
+		v = fn.Fn(args)
+		for tail.fn != nil {
+			fn, args = tail.fn, tail.args
+			tail.fn, tail.args = nil, nil
+			v = fn.Fn(args)
+		}
+	}
+	depth--
+	return v
+}
+
+// TailCall is Call for a call a function returns. Lox functions are left for
+// the Call the function returns to, so tail recursion doesn't go deeper.
+func TailCall(callee Value, line int, args ...Value) Value {
+	fn := callable(callee, line, args)
+	if fn.native {
+		return Call(callee, line, args...)
+	}
+	tail.fn, tail.args = fn, args
+	return Nil
+}
+
+func callable(callee Value, line int, args []Value) *Func {
+	if callee.kind != kindFunc {
+		Fail(line, "can only call functions and classes")
+	}
+	fn := callee.fn
+	if len(args) != fn.Arity {
+		Fail(line, fmt.Sprintf("expected %d arguments but got %d", fn.Arity, len(args)))
+	}
+	return fn
+}
+
+// callNative puts the line of the call into errors of natives.
+func callNative(fn *Func, line int, args []Value) Value {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, k := r.(*Error); k && e.Line == 0 {
+				e.Line = line
+			}
+			panic(r)
+		}
+	}()
+	return fn.Fn(args)
+}
+
+var globals = map[string]Value{}
+
+func Define(name string, v Value) {
+	globals[name] = v
+}
+
+// Get reads a global. Locals are the names of local variables in scope, for
+// suggestions in the error.
+func Get(name string, line int, locals []string) Value {
+	v, k := globals[name]
+	if !k {
+		undefined(name, line, locals)
+	}
+	return v
+}
+
+func Set(name string, v Value, line int, locals []string) Value {
+	if _, k := globals[name]; !k {
+		undefined(name, line, locals)
+	}
+	globals[name] = v
+	return v
+}
+
+func undefined(name string, line int, locals []string) {
+	names := append([]string{}, locals...)
+	for k := range globals {
+		names = append(names, k)
+	}
+	Fail(line, fmt.Sprintf("undefined variable '%s'", name)+suggest(name, names))
+}
+
+// Run runs top-level statements of a program. An error stops only the
+// statement it happened in, but the program exits with 70 after all of them.
+func Run(stmts ...func()) {
+	failed := false
+	for _, s := range stmts {
+		if !run(s) {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(70)
+	}
+}
+
+func run(s func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			depth = 0
+			tail.fn, tail.args = nil, nil
+			e, k := r.(*Error)
+			if !k {
+				e = &Error{0, fmt.Sprintf("internal error: %v", r)}
+			}
+			fmt.Printf("at line %d: %s\n", e.Line, e.Message)
+			ok = false
+		}
+	}()
+	s()
+	return true
+}
+
+func native(name string, arity int, fn func(args []Value) Value) {
+	globals[name] = Value{kind: kindFunc, fn: &Func{name, arity, fn, true}}
+}
+
+func init() {
+	native("clock", 0, func(args []Value) Value {
+		return Num(float64(time.Now().UnixNano()) / 1e9)
+	})
+	native("assert", 1, func(args []Value) Value {
+		if !Truthy(args[0]) {
+			Fail(0, "assertion failed")
+		}
+		return Nil
+	})
+	native("assertEqual", 2, func(args []Value) Value {
+		if !equal(args[0], args[1]) {
+			Fail(0, "values are not equal\n"+diff(args[1], args[0]))
+		}
+		return Nil
+	})
+	native("assertNotEqual", 2, func(args []Value) Value {
+		if equal(args[0], args[1]) {
+			Fail(0, "values are equal: "+repr(args[0]))
+		}
+		return Nil
+	})
+	native("fail", 1, func(args []Value) Value {
+		Fail(0, stringify(args[0]))
+		return Nil
+	})
+}
+
+func diff(expected, actual Value) string {
+	if expected.kind != kindString || actual.kind != kindString ||
+		!(strings.Contains(expected.str, "\n") || strings.Contains(actual.str, "\n")) {
+		return fmt.Sprintf("expected: %s\n     got: %s", repr(expected), repr(actual))
+	}
+	a := strings.Split(expected.str, "\n")
+	b := strings.Split(actual.str, "\n")
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("--- expected\n+++ got")
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("\n  " + a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			sb.WriteString("\n- " + a[i])
+			i++
+		default:
+			sb.WriteString("\n+ " + b[j])
+			j++
+		}
+	}
+	return sb.String()
+}
+
+func suggest(name string, candidates []string) string {
+	best := len(name)/3 + 1
+	var found []string
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		if c == name || seen[c] {
+			continue
+		}
+		seen[c] = true
+		d := distance(name, c)
+		if d < best {
+			best = d
+			found = found[:0]
+		}
+		if d == best {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	sort.Strings(found)
+	if len(found) > 3 {
+		found = found[:3]
+	}
+	return "; did you mean '" + strings.Join(found, "' or '") + "'?"
+}
+
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			m := d[i-1][j] + 1
+			if d[i][j-1]+1 < m {
+				m = d[i][j-1] + 1
+			}
+			if d[i-1][j-1]+cost < m {
+				m = d[i-1][j-1] + cost
+			}
+			d[i][j] = m
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
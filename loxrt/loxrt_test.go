@@ -0,0 +1,20 @@
+package loxrt
+
+import "testing"
+
+func TestTailCall(t *testing.T) {
+	var loop Value
+	loop = NewFunc("loop", 2, func(args []Value) Value {
+		if args[0].num == 0 {
+			return args[1]
+		}
+		return TailCall(loop, 1, Num(args[0].num-1), Add(args[1], Num(1), 1))
+	})
+	n := MaxDepth * 10
+	if v := Call(loop, 1, Num(float64(n)), Num(0)); v.num != float64(n) {
+		t.Errorf("got %s, want %d", stringify(v), n)
+	}
+	if depth != 0 {
+		t.Errorf("depth is %d after the call", depth)
+	}
+}
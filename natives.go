@@ -0,0 +1,231 @@
+package lox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"time"
+)
+
+// natives are defined in the globals of every new interpreter. Those reaching
+// outside of it are granted by Capabilities instead.
+var natives = map[string]callable{
+	"assert":         &nf_assert{},
+	"assertEqual":    &nf_assertEqual{},
+	"assertNotEqual": &nf_assertNotEqual{},
+	"fail":           &nf_fail{},
+}
+
+type nf_clock struct{}
+
+func (*nf_clock) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	return NumberValue(float64(time.Now().UnixNano()) / 1e9), nil
+}
+
+func (*nf_clock) Arity() int {
+	return 0
+}
+
+func (*nf_clock) String() string {
+	return "<native fn>"
+}
+
+// nf_frozenClock is the clock of time:frozen.
+type nf_frozenClock struct {
+	t float64
+}
+
+func (c *nf_frozenClock) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	return NumberValue(c.t), nil
+}
+
+func (*nf_frozenClock) Arity() int {
+	return 0
+}
+
+func (*nf_frozenClock) String() string {
+	return "<native fn>"
+}
+
+type nf_readFile struct {
+	dirs []string
+	// s has the task reading, whose quota the contents are charged to.
+	s *scheduler
+}
+
+func (f *nf_readFile) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if args[0].Kind() != KindString {
+		return Nil, &Error{Token{}, "path must be a string"}
+	}
+	file, err := openConfined(string(args[0].Bytes()), f.dirs, false)
+	if err != nil {
+		return Nil, err
+	}
+	defer file.Close()
+	// Read no more than the memory left allows, and a byte to tell.
+	q := f.s.engine(f.s.current).budget()
+	n := q.memory
+	if n < math.MaxInt64 {
+		n++
+	}
+	bs, rerr := ioutil.ReadAll(io.LimitReader(file, n))
+	if rerr != nil {
+		return Nil, &Error{Token{}, rerr.Error()}
+	}
+	if err := q.alloc(int64(len(bs))); err != nil {
+		return Nil, err
+	}
+	return StringValue(bs), nil
+}
+
+func (*nf_readFile) Arity() int {
+	return 1
+}
+
+func (*nf_readFile) String() string {
+	return "<native fn>"
+}
+
+type nf_writeFile struct {
+	dirs []string
+}
+
+func (f *nf_writeFile) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if args[0].Kind() != KindString || args[1].Kind() != KindString {
+		return Nil, &Error{Token{}, "path and contents must be strings"}
+	}
+	file, err := openConfined(string(args[0].Bytes()), f.dirs, true)
+	if err != nil {
+		return Nil, err
+	}
+	_, werr := file.Write(args[1].Bytes())
+	if cerr := file.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		return Nil, &Error{Token{}, werr.Error()}
+	}
+	return Nil, nil
+}
+
+func (*nf_writeFile) Arity() int {
+	return 2
+}
+
+func (*nf_writeFile) String() string {
+	return "<native fn>"
+}
+
+type nf_assert struct{}
+
+func (*nf_assert) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if !istruthy(args[0]) {
+		return Nil, &Error{Token{}, "assertion failed"}
+	}
+	return Nil, nil
+}
+
+func (*nf_assert) Arity() int {
+	return 1
+}
+
+func (*nf_assert) String() string {
+	return "<native fn>"
+}
+
+type nf_assertEqual struct{}
+
+func (*nf_assertEqual) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if !isequal(args[0], args[1]) {
+		return Nil, &Error{Token{}, "values are not equal\n" + diff(args[1], args[0])}
+	}
+	return Nil, nil
+}
+
+func (*nf_assertEqual) Arity() int {
+	return 2
+}
+
+func (*nf_assertEqual) String() string {
+	return "<native fn>"
+}
+
+type nf_assertNotEqual struct{}
+
+func (*nf_assertNotEqual) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if isequal(args[0], args[1]) {
+		return Nil, &Error{Token{}, "values are equal: " + repr(args[0])}
+	}
+	return Nil, nil
+}
+
+func (*nf_assertNotEqual) Arity() int {
+	return 2
+}
+
+func (*nf_assertNotEqual) String() string {
+	return "<native fn>"
+}
+
+type nf_fail struct{}
+
+func (*nf_fail) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	return Nil, &Error{Token{}, stringify(args[0])}
+}
+
+func (*nf_fail) Arity() int {
+	return 1
+}
+
+func (*nf_fail) String() string {
+	return "<native fn>"
+}
+
+// diff describes how actual differs from expected. Multiline strings are
+// compared line by line.
+func diff(expected, actual Value) string {
+	se, sa := expected.Bytes(), actual.Bytes()
+	if expected.Kind() != KindString || actual.Kind() != KindString || !(strings.Contains(string(se), "\n") || strings.Contains(string(sa), "\n")) {
+		return fmt.Sprintf("expected: %s\n     got: %s", repr(expected), repr(actual))
+	}
+
+	a := strings.Split(string(se), "\n")
+	b := strings.Split(string(sa), "\n")
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString("--- expected\n+++ got")
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			sb.WriteString("\n  " + a[i])
+			i++
+			j++
+		case j == len(b) || i < len(a) && lcs[i+1][j] >= lcs[i][j+1]:
+			sb.WriteString("\n- " + a[i])
+			i++
+		default:
+			sb.WriteString("\n+ " + b[j])
+			j++
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,252 @@
+package lox
+
+// optimizer folds constant expressions and removes code that can never run.
+// Anything that would fail at runtime is left as is, so errors don't go away.
+type optimizer struct {
+	// depth is how deep the node being optimized is. Those too deep are
+	// left as is, for resolve to fail on.
+	depth int
+}
+
+// optimize returns an optimized version of stmts. It may share nodes with it.
+func optimize(stmts []stmt) []stmt {
+	o := &optimizer{}
+	out := make([]stmt, 0, len(stmts))
+	// Top-level statements all run, even after a return, so none are dropped.
+	for _, s := range stmts {
+		if s = o.stmt(s); s != nil {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (o *optimizer) stmts(stmts []stmt) []stmt {
+	out := make([]stmt, 0, len(stmts))
+	for _, s := range stmts {
+		if s = o.stmt(s); s == nil {
+			continue
+		}
+		out = append(out, s)
+		if returns(s) {
+			break
+		}
+	}
+	return out
+}
+
+// stmt returns nil for statements that do nothing.
+func (o *optimizer) stmt(s stmt) stmt {
+	o.depth++
+	defer func() { o.depth-- }()
+	if o.depth > maxDepth {
+		return s
+	}
+	v, _ := s.Accept(o)
+	if v == nil {
+		return nil
+	}
+	return v.(stmt)
+}
+
+// body is stmt for places where a statement is required.
+func (o *optimizer) body(s stmt) stmt {
+	if s = o.stmt(s); s == nil {
+		return &blockStmt{}
+	}
+	return s
+}
+
+func (o *optimizer) expr(e expr) expr {
+	o.depth++
+	defer func() { o.depth-- }()
+	if o.depth > maxDepth {
+		return e
+	}
+	v, _ := e.Accept(o)
+	return v.(expr)
+}
+
+func (o *optimizer) Visit(v interface{}) (interface{}, *Error) {
+	switch a := v.(type) {
+	case *expressionStmt:
+		return &expressionStmt{o.expr(a.Expr)}, nil
+	case *printStmt:
+		return &printStmt{Keyword: a.Keyword, Expr: o.expr(a.Expr)}, nil
+	case *varStmt:
+		if a.Init == nil {
+			return a, nil
+		}
+		return &varStmt{Name: a.Name, Init: o.expr(a.Init)}, nil
+	case *returnStmt:
+		if a.Value == nil {
+			return a, nil
+		}
+		return &returnStmt{a.Keyword, o.expr(a.Value)}, nil
+	case *blockStmt:
+		return &blockStmt{Stmts: o.stmts(a.Stmts)}, nil
+	case *ifStmt:
+		cond := o.expr(a.Cond)
+		if l, k := cond.(*literalExpr); k {
+			if istruthy(l.Val) {
+				return o.stmt(a.Then), nil
+			}
+			if a.Else == nil {
+				return nil, nil
+			}
+			return o.stmt(a.Else), nil
+		}
+		var els stmt
+		if a.Else != nil {
+			els = o.stmt(a.Else)
+		}
+		return &ifStmt{Keyword: a.Keyword, Cond: cond, Then: o.body(a.Then), Else: els}, nil
+	case *whileStmt:
+		cond := o.expr(a.Cond)
+		if l, k := cond.(*literalExpr); k && !istruthy(l.Val) {
+			return nil, nil
+		}
+		return &whileStmt{Keyword: a.Keyword, Cond: cond, Body: o.body(a.Body)}, nil
+	case *functionStmt:
+		return &functionStmt{Name: a.Name, Params: a.Params, Body: o.stmts(a.Body), Generator: a.Generator}, nil
+	case *testStmt:
+		return &testStmt{Name: a.Name, Body: o.stmts(a.Body)}, nil
+	case *selectStmt:
+		s := &selectStmt{Keyword: a.Keyword}
+		for _, c := range a.Cases {
+			oc := &caseClause{Keyword: c.Keyword, Name: c.Name, Chan: o.expr(c.Chan), Body: o.stmts(c.Body)}
+			if c.Value != nil {
+				oc.Value = o.expr(c.Value)
+			}
+			s.Cases = append(s.Cases, oc)
+		}
+		if a.Default != nil {
+			s.Default = &blockStmt{Stmts: o.stmts(a.Default.Stmts)}
+		}
+		return s, nil
+
+	case *literalExpr:
+		return a, nil
+	case *groupingExpr:
+		e := o.expr(a.Expr)
+		if l, k := e.(*literalExpr); k {
+			return l, nil
+		}
+		return &groupingExpr{e}, nil
+	case *unaryExpr:
+		r := o.expr(a.Right)
+		if l, k := r.(*literalExpr); k {
+			switch a.Op.Type {
+			case tokenBang:
+				return &literalExpr{BoolValue(!istruthy(l.Val))}, nil
+			case tokenMinus:
+				if l.Val.Kind() == KindNumber {
+					return &literalExpr{NumberValue(-l.Val.Number())}, nil
+				}
+			}
+		}
+		return &unaryExpr{a.Op, r}, nil
+	case *binaryExpr:
+		l, r := o.expr(a.Left), o.expr(a.Right)
+		ll, kl := l.(*literalExpr)
+		rl, kr := r.(*literalExpr)
+		if kl && kr {
+			if v, k := fold(a.Op.Type, ll.Val, rl.Val); k {
+				return &literalExpr{v}, nil
+			}
+		}
+		return &binaryExpr{l, a.Op, r}, nil
+	case *logicalExpr:
+		l, r := o.expr(a.Left), o.expr(a.Right)
+		if ll, k := l.(*literalExpr); k {
+			switch a.Op.Type {
+			case tokenOr:
+				if istruthy(ll.Val) {
+					return ll, nil
+				}
+				return r, nil
+			case tokenAnd:
+				if !istruthy(ll.Val) {
+					return ll, nil
+				}
+				return r, nil
+			}
+		}
+		return &logicalExpr{l, a.Op, r}, nil
+	case *variableExpr:
+		return a, nil
+	case *assignExpr:
+		return &assignExpr{Name: a.Name, Val: o.expr(a.Val)}, nil
+	case *callExpr:
+		args := make([]expr, len(a.Args))
+		for i := range a.Args {
+			args[i] = o.expr(a.Args[i])
+		}
+		return &callExpr{Callee: o.expr(a.Callee), Paren: a.Paren, Args: args}, nil
+	case *getExpr:
+		return &getExpr{Object: o.expr(a.Object), Name: a.Name}, nil
+	case *setExpr:
+		return &setExpr{Object: o.expr(a.Object), Name: a.Name, Val: o.expr(a.Val)}, nil
+	case *spawnExpr:
+		return &spawnExpr{Keyword: a.Keyword, Call: o.expr(a.Call).(*callExpr)}, nil
+	case *yieldExpr:
+		return &yieldExpr{Keyword: a.Keyword, Value: o.expr(a.Value)}, nil
+	}
+	// Don't know what it is, so don't touch it.
+	return v, nil
+}
+
+// fold evaluates a binary operator on constants. It reports false if the
+// operation would raise a runtime error.
+func fold(op int, l, r Value) (Value, bool) {
+	switch op {
+	case tokenEqualEqual:
+		return BoolValue(isequal(l, r)), true
+	case tokenBangEqual:
+		return BoolValue(!isequal(l, r)), true
+	case tokenPlus:
+		if l.Kind() == KindString && r.Kind() == KindString {
+			sl, sr := l.Bytes(), r.Bytes()
+			s := make([]byte, 0, len(sl)+len(sr))
+			return StringValue(append(append(s, sl...), sr...)), true
+		}
+	}
+	if l.Kind() != KindNumber || r.Kind() != KindNumber {
+		return Nil, false
+	}
+	fl, fr := l.Number(), r.Number()
+	switch op {
+	case tokenPlus:
+		return NumberValue(fl + fr), true
+	case tokenMinus:
+		return NumberValue(fl - fr), true
+	case tokenStar:
+		return NumberValue(fl * fr), true
+	case tokenSlash:
+		return NumberValue(fl / fr), true
+	case tokenGreater:
+		return BoolValue(fl > fr), true
+	case tokenGreaterEqual:
+		return BoolValue(fl >= fr), true
+	case tokenLess:
+		return BoolValue(fl < fr), true
+	case tokenLessEqual:
+		return BoolValue(fl <= fr), true
+	}
+	return Nil, false
+}
+
+// returns reports if control never gets past s.
+func returns(s stmt) bool {
+	switch a := s.(type) {
+	case *returnStmt:
+		return true
+	case *blockStmt:
+		return len(a.Stmts) > 0 && returns(a.Stmts[len(a.Stmts)-1])
+	case *ifStmt:
+		return a.Else != nil && returns(a.Then) && returns(a.Else)
+	}
+	return false
+}
+
+var _ = visitor(&optimizer{})
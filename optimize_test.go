@@ -0,0 +1,76 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+// TestOptimizeKeepsBehavior runs programs with and without optimizations,
+// which must print and fail the same.
+func TestOptimizeKeepsBehavior(t *testing.T) {
+	const src = `
+print 1 / 0;
+print -1 / 0;
+print 0 / 0 == 0 / 0;
+print "a" - 1;
+print 1 + "a";
+print -"a";
+print 1 < "a";
+print nil + nil;
+print "a" + "b" == "ab";
+print !nil and 1 / 0;
+print nil or -(2 * 3);
+if (1 < 2) print "then"; else print 1 - "else";
+while (false) print 1 - "body";
+fun f() { return 1; print "a" - "b"; }
+print f();
+print "after";
+`
+	want := "+Inf\n-Inf\nfalse\n" +
+		"at line 5: operands must be numbers\n" +
+		"at line 6: both operands must be either strings or numbers\n" +
+		"at line 7: operand must be a number\n" +
+		"at line 8: operands must be numbers\n" +
+		"at line 9: both operands must be either strings or numbers\n" +
+		"true\n+Inf\n-6\nthen\n1\nafter\n"
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		for _, on := range []bool{false, true} {
+			p, diags := Compile([]byte(src), Optimizations(on))
+			if diags != nil {
+				t.Fatal(diags)
+			}
+			var out bytes.Buffer
+			NewVM(Backend(e), Stdout(&out), Stderr(&out)).Run(context.Background(), p)
+			if out.String() != want {
+				t.Errorf("%v, optimized %v: printed\n%s\nwant\n%s", e, on, out.String(), want)
+			}
+		}
+	}
+}
+
+func TestOptimizeFolds(t *testing.T) {
+	for _, c := range []struct{ src, want string }{
+		{`print 1 + 2 * 3;`, "7"},
+		{`print "a" + "b";`, "ab"},
+		{`print !(1 < 2);`, "false"},
+		{`print 1 / 0;`, "+Inf"},
+		{`print nil or "x";`, "x"},
+		// Those fail at runtime, so they stay.
+		{`print "a" - 1;`, ""},
+		{`print -"a";`, ""},
+		{`print 1 + nil;`, ""},
+	} {
+		p, diags := Compile([]byte(c.src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		got := ""
+		if l, k := p.stmts[0].(*printStmt).Expr.(*literalExpr); k {
+			got = stringify(l.Val)
+		}
+		if got != c.want {
+			t.Errorf("%s folded to %q, want %q", c.src, got, c.want)
+		}
+	}
+}
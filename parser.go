@@ -1,20 +1,52 @@
-package main
+package lox
 
-type Parser struct {
-	Tokens  []Token
+type parser struct {
+	Tokens []Token
+	// Errors are the errors parsing could go on after.
+	Errors  []*Error
 	current int
 	raise   chan *Error
+	// fn is the function being parsed, nil at the top level.
+	fn *parsedFunc
+	// depth is how deep the statement or expression being parsed nests.
+	depth int
 }
 
-func NewParser(tokens []Token) *Parser {
-	return &Parser{
+// maxNesting bounds how deep statements and expressions nest, counting the
+// operands of a chain of operators as nested in one another, so that walking
+// them can't overflow the stack.
+const maxNesting = 2000
+
+// nest counts a level of nesting, failing past maxNesting. leave undoes
+// those counted since depth.
+func (p *parser) nest(what string) *Error {
+	if p.depth++; p.depth > maxNesting {
+		return &Error{p.peek(), what + " nested too deeply"}
+	}
+	return nil
+}
+
+func (p *parser) leave(depth int) {
+	p.depth = depth
+}
+
+// parsedFunc is what the parser learns about a function while parsing its
+// body.
+type parsedFunc struct {
+	yields bool
+	// returned is the first return with a value, if any.
+	returned *Token
+}
+
+func newParser(tokens []Token) *parser {
+	return &parser{
 		Tokens: tokens,
 		raise:  make(chan *Error),
 	}
 }
 
-func (p *Parser) Parse() ([]Stmt, *Error) {
-	statements := make([]Stmt, 0, 10)
+func (p *parser) Parse() ([]stmt, *Error) {
+	statements := make([]stmt, 0, 10)
 	for !p.isAtEnd() {
 		decl, err := p.declaration()
 		if err != nil {
@@ -25,14 +57,19 @@ func (p *Parser) Parse() ([]Stmt, *Error) {
 	return statements, nil
 }
 
-func (p *Parser) declaration() (Stmt, *Error) {
-	var stmt Stmt
-	var err *Error
+func (p *parser) declaration() (stmt, *Error) {
+	defer p.leave(p.depth)
+	var stmt stmt
+	err := p.nest("statement")
 	switch {
+	case err != nil:
 	case p.match(tokenFun):
 		stmt, err = p.function("function")
 	case p.match(tokenVar):
 		stmt, err = p.varDeclaration()
+	case p.checkTest():
+		p.advance()
+		stmt, err = p.testDeclaration()
 	default:
 		stmt, err = p.statement()
 	}
@@ -44,8 +81,9 @@ func (p *Parser) declaration() (Stmt, *Error) {
 
 }
 
-func (p *Parser) function(kind string) (Stmt, *Error) {
-	var body []Stmt
+func (p *parser) function(kind string) (stmt, *Error) {
+	var body []stmt
+	var fn *parsedFunc
 	params := make([]Token, 0, 10)
 
 	name, err := p.consume(tokenIdent, "expect "+kind+" name")
@@ -64,7 +102,7 @@ func (p *Parser) function(kind string) (Stmt, *Error) {
 		params = append(params, p2)
 		for p.match(tokenComma) {
 			if len(params) >= 255 {
-				loxerr2(&Error{p.peek(), "can't have more than 255 arguments"})
+				p.Errors = append(p.Errors, &Error{p.peek(), "can't have more than 255 arguments"})
 			}
 			p2, err = p.consume(tokenIdent, "expect parameter name")
 			if err != nil {
@@ -74,65 +112,117 @@ func (p *Parser) function(kind string) (Stmt, *Error) {
 		}
 	}
 
-	if _, err = p.consume(tokenLeftBrace, "expect { before "+kind+" body"); err != nil {
+	if _, err = p.consume(tokenRightParen, "expect ')' after parameters"); err != nil {
 		goto fail
 	}
-	if _, err = p.consume(tokenRightParen, "expect ')' after parameters"); err != nil {
+	if _, err = p.consume(tokenLeftBrace, "expect { before "+kind+" body"); err != nil {
 		goto fail
 	}
-	body, err = p.block()
+	body, fn, err = p.functionBody()
 	if err != nil {
 		return nil, err
 	}
-	return &Function{name, params, body}, nil
+	if fn.yields && fn.returned != nil {
+		p.Errors = append(p.Errors, &Error{*fn.returned, "can't return a value from a generator"})
+	}
+	return &functionStmt{Name: name, Params: params, Body: body, Generator: fn.yields}, nil
 fail:
 	return nil, err
 }
 
-func (p *Parser) synchronize() {
+// functionBody parses the block of a function, and returns what it learned
+// about the function too.
+func (p *parser) functionBody() ([]stmt, *parsedFunc, *Error) {
+	outer := p.fn
+	p.fn = &parsedFunc{}
+	defer func() { p.fn = outer }()
+	body, err := p.block()
+	return body, p.fn, err
+}
+
+// checkTest reports if a test declaration follows. “test” is not a keyword, so
+// it can still be used as a name.
+func (p *parser) checkTest() bool {
+	return p.checkWord("test", tokenString)
+}
+
+// checkWord reports if the name word follows, and then a token of one of the
+// types next. Words that are keywords only where a name can't be, like
+// “test”, are checked this way.
+func (p *parser) checkWord(word string, next ...int) bool {
+	if !p.check(tokenIdent) || string(p.peek().Lexeme) != word {
+		return false
+	}
+	for _, typ := range next {
+		if p.Tokens[p.current+1].Type == typ {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) testDeclaration() (stmt, *Error) {
+	name := p.advance()
+	if _, err := p.consume(tokenLeftBrace, "expect { before test body"); err != nil {
+		return nil, err
+	}
+	body, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	return &testStmt{Name: name, Body: body}, nil
+}
+
+func (p *parser) synchronize() {
 	p.advance()
 	for !p.isAtEnd() {
 		if p.previous().Type == tokenSemicolon {
 			return
 		}
+		switch p.peek().Type {
+		case tokenClass:
+			fallthrough
+		case tokenFun:
+			fallthrough
+		case tokenVar:
+			fallthrough
+		case tokenFor:
+			fallthrough
+		case tokenIf:
+			fallthrough
+		case tokenWhile:
+			fallthrough
+		case tokenPrint:
+			fallthrough
+		case tokenReturn:
+			return
+		}
+		p.advance()
 	}
-	switch p.peek().Type {
-	case tokenClass:
-		fallthrough
-	case tokenFun:
-		fallthrough
-	case tokenVar:
-		fallthrough
-	case tokenFor:
-		fallthrough
-	case tokenIf:
-		fallthrough
-	case tokenWhile:
-		fallthrough
-	case tokenPrint:
-		fallthrough
-	case tokenReturn:
-		return
-	}
-	p.advance()
 }
 
-func (p *Parser) varDeclaration() (Stmt, *Error) {
+func (p *parser) varDeclaration() (stmt, *Error) {
 	name, err := p.consume(tokenIdent, "expect variable name")
 	if err != nil {
 		return nil, err
 	}
-	var init Expr
+	var init expr
 	if p.match(tokenEqual) {
-		init, err = p.expression()
+		if init, err = p.expression(); err != nil {
+			return nil, err
+		}
 	}
 	if _, err := p.consume(tokenSemicolon, "expect ';' after variable declaration"); err != nil {
 		return nil, err
 	}
-	return &Var{name, init}, nil
+	return &varStmt{Name: name, Init: init}, nil
 }
 
-func (p *Parser) statement() (Stmt, *Error) {
+func (p *parser) statement() (stmt, *Error) {
+	defer p.leave(p.depth)
+	if err := p.nest("statement"); err != nil {
+		return nil, err
+	}
 	switch {
 	case p.match(tokenReturn):
 		return p.returnStatement()
@@ -146,29 +236,41 @@ func (p *Parser) statement() (Stmt, *Error) {
 		return p.whileStatement()
 	case p.match(tokenLeftBrace):
 		b, e := p.block()
-		return &Block{b}, e
+		return &blockStmt{Stmts: b}, e
+	case p.checkWord("select", tokenLeftBrace):
+		return p.selectStatement()
 	default:
 		return p.expressionStatement()
 	}
 }
 
-func (p *Parser) returnStatement() (s Stmt, err *Error) {
+func (p *parser) returnStatement() (s stmt, err *Error) {
 	kw := p.previous()
-	val := Expr(nil)
+	val := expr(nil)
 	if !p.check(tokenSemicolon) {
 		val, err = p.expression()
 		if err != nil {
 			return nil, err
 		}
+		if p.fn != nil && p.fn.returned == nil {
+			p.fn.returned = &kw
+		}
 	}
 	_, err = p.consume(tokenSemicolon, "expect ';' after return value")
-	return &Return{kw, val}, err
+	return &returnStmt{kw, val}, err
 }
 
-func (p *Parser) forStatement() (Stmt, *Error) {
-	var err *Error
-	_, err = p.consume(tokenLeftParen, "expect '(' after 'for'")
-	var init Stmt
+func (p *parser) forStatement() (stmt, *Error) {
+	kw := p.previous()
+	_, err := p.consume(tokenLeftParen, "expect '(' after 'for'")
+	if err != nil {
+		return nil, err
+	}
+	if p.checkForIn() {
+		p.advance()
+		return p.forIn(kw)
+	}
+	var init stmt
 	if p.match(tokenSemicolon) {
 		init = nil
 	} else if p.match(tokenVar) {
@@ -179,34 +281,110 @@ func (p *Parser) forStatement() (Stmt, *Error) {
 	if err != nil {
 		return nil, err
 	}
-	var cond Expr
+	var cond expr
 	if !p.check(tokenSemicolon) {
-		cond, err = p.expression()
+		if cond, err = p.expression(); err != nil {
+			return nil, err
+		}
 	}
-	_, err = p.consume(tokenSemicolon, "expect ';' after loop condition")
-	if err != nil {
+	if _, err := p.consume(tokenSemicolon, "expect ';' after loop condition"); err != nil {
 		return nil, err
 	}
-	var incr Expr
+	var incr expr
 	if !p.check(tokenRightParen) {
-		incr, err = p.expression()
+		if incr, err = p.expression(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.consume(tokenRightParen, "expect ')' after loop condition"); err != nil {
+		return nil, err
+	}
+	body, err := p.loopBody()
+	if err != nil {
+		return nil, err
 	}
-	_, err = p.consume(tokenRightParen, "expect ')' after loop condition")
-	body, err := p.statement()
 	if incr != nil {
-		body = &Block{Stmts: []Stmt{body, &Expression{incr}}}
+		body = &blockStmt{Stmts: []stmt{body, &expressionStmt{incr}}}
 	}
 	if cond == nil {
-		cond = &Literal{true}
+		cond = &literalExpr{BoolValue(true)}
 	}
-	body = &While{cond, body}
+	body = &whileStmt{Keyword: kw, Cond: cond, Body: body}
 	if init != nil {
-		body = &Block{[]Stmt{init, body}}
+		body = &blockStmt{Stmts: []stmt{init, body}}
+	}
+	return body, nil
+}
+
+// loopBody parses the body of a for loop, which ends up in a block in a
+// while loop, two levels deeper.
+func (p *parser) loopBody() (stmt, *Error) {
+	defer p.leave(p.depth)
+	if err := p.nest("statement"); err != nil {
+		return nil, err
+	}
+	if err := p.nest("statement"); err != nil {
+		return nil, err
+	}
+	return p.statement()
+}
+
+// checkForIn reports if var, a name and “in” follow.
+func (p *parser) checkForIn() bool {
+	if !p.check(tokenVar) || p.Tokens[p.current+1].Type != tokenIdent {
+		return false
+	}
+	in := p.Tokens[p.current+2]
+	return in.Type == tokenIdent && string(in.Lexeme) == "in"
+}
+
+// forIn parses the rest of for (var name in iterator) body into a loop over
+// what the iterator's next() returns until it's done:
+//
+//	{
+//		var (iterator) = iterator;
+//		var name = (iterator).next();
+//		while (!(iterator).done) {
+//			body
+//			name = (iterator).next();
+//		}
+//	}
+//
+// The parenthesized name is hidden from scripts.
+func (p *parser) forIn(kw Token) (stmt, *Error) {
+	name := p.advance()
+	in := p.advance()
+	iter, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.consume(tokenRightParen, "expect ')' after iterator"); err != nil {
+		return nil, err
+	}
+	body, err := p.loopBody()
+	if err != nil {
+		return nil, err
+	}
+	hidden := Token{Type: tokenIdent, Lexeme: []byte("(iterator)"), Line: in.Line}
+	get := func(prop string) expr {
+		return &getExpr{Object: &variableExpr{Name: hidden}, Name: Token{Type: tokenIdent, Lexeme: []byte(prop), Line: in.Line}}
 	}
-	return body, err
+	next := func() expr {
+		return &callExpr{Callee: get("next"), Paren: in}
+	}
+	return &blockStmt{Stmts: []stmt{
+		&varStmt{Name: hidden, Init: iter},
+		&varStmt{Name: name, Init: next()},
+		&whileStmt{
+			Keyword: kw,
+			Cond:    &unaryExpr{Token{Type: tokenBang, Lexeme: []byte("!"), Line: in.Line}, get("done")},
+			Body:    &blockStmt{Stmts: []stmt{body, &expressionStmt{&assignExpr{Name: name, Val: next()}}}},
+		},
+	}}, nil
 }
 
-func (p *Parser) whileStatement() (Stmt, *Error) {
+func (p *parser) whileStatement() (stmt, *Error) {
+	kw := p.previous()
 	if _, err := p.consume(tokenLeftParen, "expect '(' after 'while'"); err != nil {
 		return nil, err
 	}
@@ -218,10 +396,11 @@ func (p *Parser) whileStatement() (Stmt, *Error) {
 		return nil, err
 	}
 	body, err := p.statement()
-	return &While{cond, body}, err
+	return &whileStmt{Keyword: kw, Cond: cond, Body: body}, err
 }
 
-func (p *Parser) ifStatement() (Stmt, *Error) {
+func (p *parser) ifStatement() (stmt, *Error) {
+	kw := p.previous()
 	if _, err := p.consume(tokenLeftParen, "expect '(' after 'if'"); err != nil {
 		return nil, err
 	}
@@ -236,18 +415,18 @@ func (p *Parser) ifStatement() (Stmt, *Error) {
 	if err != nil {
 		return nil, err
 	}
-	els := Stmt(nil)
+	els := stmt(nil)
 	if p.match(tokenElse) {
 		els, err = p.statement()
 		if err != nil {
 			return nil, err
 		}
 	}
-	return &If{cond, then, els}, nil
+	return &ifStmt{Keyword: kw, Cond: cond, Then: then, Else: els}, nil
 }
 
-func (p *Parser) block() ([]Stmt, *Error) {
-	stmts := make([]Stmt, 0, 10)
+func (p *parser) block() ([]stmt, *Error) {
+	stmts := make([]stmt, 0, 10)
 	for !(p.check(tokenRightBrace) || p.isAtEnd()) {
 		if s, err := p.declaration(); err != nil {
 			return nil, err
@@ -261,122 +440,308 @@ func (p *Parser) block() ([]Stmt, *Error) {
 	return stmts, nil
 }
 
-func (p *Parser) printStatement() (Expr, *Error) {
+func (p *parser) selectStatement() (stmt, *Error) {
+	s := &selectStmt{Keyword: p.advance()}
+	p.advance()
+	for !p.check(tokenRightBrace) && !p.isAtEnd() {
+		switch {
+		case p.check(tokenIdent) && string(p.peek().Lexeme) == "case":
+			c, err := p.selectCase()
+			if err != nil {
+				return nil, err
+			}
+			s.Cases = append(s.Cases, c)
+		case p.checkWord("default", tokenLeftBrace) && s.Default == nil:
+			p.advance()
+			p.advance()
+			body, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			s.Default = &blockStmt{Stmts: body}
+		default:
+			return nil, &Error{p.peek(), "expect 'case' or 'default' in select"}
+		}
+	}
+	_, err := p.consume(tokenRightBrace, "expect '}' after select cases")
+	return s, err
+}
+
+// selectCase parses a case of a select: a channel's recv() or send(value),
+// the receive may be into a new variable.
+func (p *parser) selectCase() (*caseClause, *Error) {
+	c := &caseClause{Keyword: p.advance()}
+	if p.match(tokenVar) {
+		name, err := p.consume(tokenIdent, "expect variable name")
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.consume(tokenEqual, "expect '=' after variable name"); err != nil {
+			return nil, err
+		}
+		c.Name = name
+	}
+	e, err := p.call()
+	if err != nil {
+		return nil, err
+	}
+	var op string
+	if call, k := e.(*callExpr); k {
+		if get, k := call.Callee.(*getExpr); k {
+			op, c.Chan = string(get.Name.Lexeme), get.Object
+			switch {
+			case op == "recv" && len(call.Args) == 0:
+			case op == "send" && len(call.Args) == 1 && c.Name.Lexeme == nil:
+				c.Value = call.Args[0]
+			default:
+				op = ""
+			}
+		}
+	}
+	if op == "" {
+		return nil, &Error{c.Keyword, "expect a channel's recv() or send(value) after 'case'"}
+	}
+	if _, err := p.consume(tokenLeftBrace, "expect '{' after select case"); err != nil {
+		return nil, err
+	}
+	c.Body, err = p.block()
+	return c, err
+}
+
+func (p *parser) printStatement() (expr, *Error) {
+	kw := p.previous()
 	value, err := p.expression()
+	if err != nil {
+		return nil, err
+	}
 	_, err = p.consume(tokenSemicolon, "expect ';' after value")
-	return &Print{Expr: value}, err
+	return &printStmt{Keyword: kw, Expr: value}, err
 }
 
-func (p *Parser) expressionStatement() (Expr, *Error) {
+func (p *parser) expressionStatement() (expr, *Error) {
 	value, err := p.expression()
 	if err != nil {
 		return nil, err
 	}
 	_, err = p.consume(tokenSemicolon, "expect ';' after expression")
-	return &Expression{Expr: value}, err
+	return &expressionStmt{Expr: value}, err
 }
 
-func (p *Parser) expression() (Expr, *Error) {
+func (p *parser) expression() (expr, *Error) {
+	defer p.leave(p.depth)
+	if err := p.nest("expression"); err != nil {
+		return nil, err
+	}
 	return p.assignment()
 }
 
-func (p *Parser) assignment() (Expr, *Error) {
+func (p *parser) assignment() (expr, *Error) {
 	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
 	if p.match(tokenEqual) {
 		equals := p.previous()
+		defer p.leave(p.depth)
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
 		value, err := p.assignment()
 		if err != nil {
 			return nil, err
 		}
-		if e, k := expr.(*Variable); k {
-			name := e.Name
-			return &Assign{name, value}, nil
+		switch e := expr.(type) {
+		case *variableExpr:
+			return &assignExpr{Name: e.Name, Val: value}, nil
+		case *getExpr:
+			return &setExpr{Object: e.Object, Name: e.Name, Val: value}, nil
 		}
-		loxerr2(&Error{equals, "invalid assignment target"})
+		p.Errors = append(p.Errors, &Error{equals, "invalid assignment target"})
 	}
-	return expr, err
+	return expr, nil
 }
 
-func (p *Parser) or() (Expr, *Error) {
+func (p *parser) or() (expr, *Error) {
 	expr, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenOr) {
 		op := p.previous()
-		var r Expr
-		r, err = p.and()
-		expr = &Logical{expr, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		expr = &logicalExpr{expr, op, r}
 	}
-	return expr, err
+	return expr, nil
 }
 
-func (p *Parser) and() (Expr, *Error) {
+func (p *parser) and() (expr, *Error) {
 	expr, err := p.equality()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenAnd) {
 		op := p.previous()
-		var r Expr
-		r, err = p.and()
-		expr = &Logical{expr, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		expr = &logicalExpr{expr, op, r}
 	}
-	return expr, err
+	return expr, nil
 }
 
-func (p *Parser) equality() (Expr, *Error) {
+func (p *parser) equality() (expr, *Error) {
 	e, err := p.comparison()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenBangEqual, tokenEqualEqual) {
 		op := p.previous()
-		var r Expr
-		r, err = p.comparison()
-		e = &Binary{e, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.comparison()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{e, op, r}
 	}
-	return e, err
+	return e, nil
 }
 
-func (p *Parser) comparison() (Expr, *Error) {
+func (p *parser) comparison() (expr, *Error) {
 	e, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenGreater, tokenGreaterEqual, tokenLess, tokenLessEqual) {
 		op := p.previous()
-		var r Expr
-		r, err = p.term()
-		e = &Binary{e, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{e, op, r}
 	}
-	return e, err
+	return e, nil
 }
 
-func (p *Parser) term() (Expr, *Error) {
+func (p *parser) term() (expr, *Error) {
 	e, err := p.factor()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenMinus, tokenPlus) {
 		op := p.previous()
-		var r Expr
-		r, err = p.factor()
-		e = &Binary{e, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.factor()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{e, op, r}
 	}
-	return e, err
+	return e, nil
 }
 
-func (p *Parser) factor() (Expr, *Error) {
+func (p *parser) factor() (expr, *Error) {
 	e, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	defer p.leave(p.depth)
 	for p.match(tokenSlash, tokenStar) {
 		op := p.previous()
-		var r Expr
-		r, err = p.unary()
-		e = &Binary{e, op, r}
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
+		r, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		e = &binaryExpr{e, op, r}
 	}
-	return e, err
+	return e, nil
 }
 
-func (p *Parser) unary() (Expr, *Error) {
+func (p *parser) unary() (expr, *Error) {
 	if p.match(tokenBang, tokenMinus) {
 		op := p.previous()
+		defer p.leave(p.depth)
+		if err := p.nest("expression"); err != nil {
+			return nil, err
+		}
 		r, err := p.unary()
-		return &Unary{op, r}, err
+		if err != nil {
+			return nil, err
+		}
+		return &unaryExpr{op, r}, nil
+	}
+	if p.checkWord("spawn", tokenIdent) {
+		kw := p.advance()
+		e, err := p.call()
+		if err != nil {
+			return nil, err
+		}
+		c, k := e.(*callExpr)
+		if !k {
+			return nil, &Error{kw, "expect a call after 'spawn'"}
+		}
+		return &spawnExpr{Keyword: kw, Call: c}, nil
+	}
+	// Only tokens that can't follow a name make “yield” a keyword, so yield (x)
+	// and yield -x are still a call and a subtraction.
+	if p.checkWord("yield", tokenIdent, tokenNumber, tokenString, tokenNil, tokenTrue, tokenFalse, tokenBang) {
+		kw := p.advance()
+		if p.fn == nil {
+			p.Errors = append(p.Errors, &Error{kw, "can't yield outside of a function"})
+		} else {
+			p.fn.yields = true
+		}
+		v, err := p.expression()
+		if err != nil {
+			return nil, err
+		}
+		return &yieldExpr{Keyword: kw, Value: v}, nil
 	}
 	return p.call()
 }
 
-func (p *Parser) call() (Expr, *Error) {
+func (p *parser) call() (expr, *Error) {
+	defer p.leave(p.depth)
 	e, err := p.primary()
 	for {
+		if err != nil {
+			break
+		}
+		if p.check(tokenLeftParen) || p.check(tokenDot) {
+			if err = p.nest("expression"); err != nil {
+				break
+			}
+		}
 		if p.match(tokenLeftParen) {
 			e, err = p.finishCall(e)
+		} else if p.match(tokenDot) {
+			var name Token
+			name, err = p.consume(tokenIdent, "expect property name after '.'")
+			e = &getExpr{Object: e, Name: name}
 		} else {
 			break
 		}
@@ -384,8 +749,8 @@ func (p *Parser) call() (Expr, *Error) {
 	return e, err
 }
 
-func (p *Parser) finishCall(callee Expr) (Expr, *Error) {
-	args := make([]Expr, 0, 10)
+func (p *parser) finishCall(callee expr) (expr, *Error) {
+	args := make([]expr, 0, 10)
 	if !p.check(tokenRightParen) {
 		e, err := p.expression()
 		if err != nil {
@@ -394,7 +759,7 @@ func (p *Parser) finishCall(callee Expr) (Expr, *Error) {
 		args = append(args, e)
 		for p.match(tokenComma) {
 			if len(args) >= 255 {
-				loxerr2(&Error{p.peek(), "can't have more than 255 arguments"})
+				p.Errors = append(p.Errors, &Error{p.peek(), "can't have more than 255 arguments"})
 			}
 			e, err := p.expression()
 			if err != nil {
@@ -404,24 +769,24 @@ func (p *Parser) finishCall(callee Expr) (Expr, *Error) {
 		}
 	}
 	paren, err := p.consume(tokenRightParen, "expect ')' after arguments.")
-	return &Call{callee, paren, args}, err
+	return &callExpr{Callee: callee, Paren: paren, Args: args}, err
 }
 
-func (p *Parser) primary() (Expr, *Error) {
+func (p *parser) primary() (expr, *Error) {
 	switch {
 	case p.match(tokenFalse):
-		return &Literal{false}, nil
+		return &literalExpr{BoolValue(false)}, nil
 	case p.match(tokenTrue):
-		return &Literal{true}, nil
+		return &literalExpr{BoolValue(true)}, nil
 	case p.match(tokenNil):
-		return &Literal{nil}, nil
+		return &literalExpr{Nil}, nil
 	}
 
 	if p.match(tokenNumber, tokenString) {
-		return &Literal{p.previous().Literal}, nil
+		return &literalExpr{valueOf(p.previous().Literal)}, nil
 	}
 	if p.match(tokenIdent) {
-		return &Variable{p.previous()}, nil
+		return &variableExpr{Name: p.previous()}, nil
 	}
 	if p.match(tokenLeftParen) {
 		e, err := p.expression()
@@ -429,12 +794,12 @@ func (p *Parser) primary() (Expr, *Error) {
 			return nil, err
 		}
 		_, err = p.consume(tokenRightParen, "expect ')' after expression")
-		return &Grouping{e}, err
+		return &groupingExpr{e}, err
 	}
 	return nil, &Error{p.peek(), "expect expression or value"}
 }
 
-func (p *Parser) match(types ...int) bool {
+func (p *parser) match(types ...int) bool {
 	for _, t := range types {
 		if p.check(t) {
 			p.advance()
@@ -444,35 +809,35 @@ func (p *Parser) match(types ...int) bool {
 	return false
 }
 
-func (p *Parser) consume(typ int, message string) (Token, *Error) {
+func (p *parser) consume(typ int, message string) (Token, *Error) {
 	if p.check(typ) {
 		return p.advance(), nil
 	}
 	return Token{}, &Error{p.peek(), message}
 }
 
-func (p *Parser) check(typ int) bool {
+func (p *parser) check(typ int) bool {
 	if p.isAtEnd() {
 		return false
 	}
 	return p.peek().Type == typ
 }
 
-func (p *Parser) advance() Token {
+func (p *parser) advance() Token {
 	if !p.isAtEnd() {
 		p.current++
 	}
 	return p.previous()
 }
 
-func (p *Parser) isAtEnd() bool {
+func (p *parser) isAtEnd() bool {
 	return p.peek().Type == tokenEOF
 }
 
-func (p *Parser) peek() Token {
+func (p *parser) peek() Token {
 	return p.Tokens[p.current]
 }
 
-func (p *Parser) previous() Token {
+func (p *parser) previous() Token {
 	return p.Tokens[p.current-1]
 }
@@ -0,0 +1,104 @@
+package lox
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var parserSeeds = []string{
+	`var a = 1 + 2 * -3 / (4 - 5); print a == 2 and a != 3 or !a;`,
+	`fun f(a, b) { if (a < b) return f(b, a); else { a = b; } return a.x.y = b; }`,
+	`for (var i = 0; i <= 10; i = i + 1) while (i > 2) print i >= 3;`,
+	`fun g() { yield 1; for (var x in g()) print x; } var c = spawn g();`,
+	`select { case var v = ch.recv() { print v; } case ch.send(1) {} default {} }`,
+	`test "t" { assertEqual(1, 1); } { var s = "a" + "b"; s = nil; }`,
+}
+
+// frontEnd compiles tokens like Compile, without its recover.
+func frontEnd(t *testing.T, tokens []Token) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s: panic: %v", lexemes(tokens), r)
+		}
+	}()
+	parser := newParser(tokens)
+	stmts, err := parser.Parse()
+	if err != nil || len(parser.Errors) > 0 {
+		return
+	}
+	if resolve(optimize(stmts)) != nil || resolve(stmts) != nil {
+		return
+	}
+	newCompiler().Compile(stmts)
+}
+
+func lexemes(tokens []Token) string {
+	var words [][]byte
+	for _, tok := range tokens {
+		words = append(words, tok.Lexeme)
+	}
+	return string(bytes.Join(words, []byte(" ")))
+}
+
+// TestParseMalformed checks that the parser reports broken scripts rather
+// than handing on trees with holes.
+func TestParseMalformed(t *testing.T) {
+	for _, src := range []string{
+		"/ 1 ;", "var n = *0;", "1 + ;", "print * 2;", "a = / b;",
+		"x or and y;", "for (;; / 1) print 1;", "for (var i = ; i; ) {}",
+		"-;", "!*;", "f(/);", "a.b = ==;", "return + ;",
+	} {
+		frontEnd(t, newScanner([]byte(src)).ScanTokens())
+		if _, diags := Compile([]byte(src)); diags == nil {
+			t.Errorf("%q compiled", src)
+		}
+	}
+	deep := func(n int) []string {
+		return []string{
+			strings.Repeat("(", n) + "1" + strings.Repeat(")", n) + ";",
+			"1" + strings.Repeat(" + 1", n) + ";",
+			"a" + strings.Repeat(" = a", n) + ";",
+			strings.Repeat("-", n) + "1;",
+			"f" + strings.Repeat("()", n) + ";",
+			strings.Repeat("{", n) + strings.Repeat("}", n),
+			strings.Repeat("if (a) ", n) + "print a;",
+			strings.Repeat("for (;;) ", n) + "print a;",
+			strings.Repeat("fun f() {", n) + strings.Repeat("}", n),
+		}
+	}
+	tooDeep := append(deep(50*maxNesting), deep(3000000)[0])
+	for _, src := range tooDeep {
+		_, diags := Compile([]byte(src))
+		if len(diags) == 0 || !strings.Contains(diags[0].Message, "nested too deeply") {
+			t.Errorf("%.20q...: diagnostics %v", src, diags)
+		}
+	}
+	for _, src := range deep(maxNesting / 4) {
+		if _, diags := Compile([]byte(src)); diags != nil {
+			t.Errorf("%.20q...: diagnostics %v", src, diags)
+		}
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, seed := range parserSeeds {
+		tokens := newScanner([]byte(seed)).ScanTokens()
+		eof, tokens := tokens[len(tokens)-1], tokens[:len(tokens)-1]
+		for n := 0; n < 1000; n++ {
+			mutant := append([]Token{}, tokens...)
+			for k := rnd.Intn(3) + 1; k > 0; k-- {
+				i := rnd.Intn(len(mutant))
+				switch rnd.Intn(3) {
+				case 0:
+					mutant = append(mutant[:i], mutant[i+1:]...)
+				case 1:
+					mutant = append(mutant[:i+1], mutant[i:]...)
+				case 2:
+					j := rnd.Intn(len(mutant))
+					mutant[i], mutant[j] = mutant[j], mutant[i]
+				}
+			}
+			frontEnd(t, append(mutant, eof))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package lox
+
+import (
+	"math"
+	"unsafe"
+)
+
+// Sizes charged to the memory quota, roughly what the Go heap spends on them.
+const (
+	valueSize   = int64(unsafe.Sizeof(Value{}))
+	envSize     = int64(unsafe.Sizeof(environment{}))
+	funcSize    = int64(unsafe.Sizeof(function{}))
+	closureSize = int64(unsafe.Sizeof(closure{}))
+	upvalueSize = int64(unsafe.Sizeof(upvalue{}))
+	ptrSize     = int64(unsafe.Sizeof(&upvalue{}))
+	taskSize    = int64(unsafe.Sizeof(task{}))
+	chanSize    = int64(unsafe.Sizeof(channel{}))
+	genSize     = int64(unsafe.Sizeof(generator{}))
+)
+
+// quota is what a run has left to spend. Engines embed it and reset it for
+// each run.
+type quota struct {
+	steps  int64
+	memory int64
+	output int64
+	// watched is set when hooks watch every statement. steps stays at 0 then,
+	// so each step takes the slow path, and left has the steps left.
+	watched bool
+	left    int64
+}
+
+func newQuota(c config) quota {
+	q := quota{steps: limit(c.maxSteps), memory: limit(c.maxMemory), output: limit(c.maxOutput)}
+	if c.hooks.OnStatement != nil {
+		q.watched, q.left, q.steps = true, q.steps, 0
+	}
+	return q
+}
+
+// unlimited is the quota of an engine not run through a VM.
+var unlimited = quota{steps: math.MaxInt64, memory: math.MaxInt64, output: math.MaxInt64}
+
+func limit(n int64) int64 {
+	if n <= 0 {
+		return math.MaxInt64
+	}
+	return n
+}
+
+// budget returns q, for tasks and generators passing what's left between
+// their engines.
+func (q *quota) budget() *quota {
+	return q
+}
+
+// step is the slow path of counting a step, taken once steps runs out. It
+// tells if the step may be taken.
+func (q *quota) step() bool {
+	if !q.watched {
+		return false
+	}
+	q.steps = 0
+	q.left--
+	return q.left >= 0
+}
+
+// alloc charges n bytes to the memory quota.
+func (q *quota) alloc(n int64) *Error {
+	if q.memory -= n; q.memory < 0 {
+		return exceeded(MemoryLimit, 0)
+	}
+	return nil
+}
+
+// write charges a line of n bytes to the output quota.
+func (q *quota) write(n int) *Error {
+	if q.output -= int64(n) + 1; q.output < 0 {
+		return exceeded(OutputLimit, 0)
+	}
+	return nil
+}
+
+// exceeded returns the error stopping a run that hit limit.
+func exceeded(limit Limit, line int) *Error {
+	return &Error{Token{Type: exhausted, Literal: limit, Line: line}, limit.message()}
+}
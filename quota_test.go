@@ -0,0 +1,106 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// runQuota runs src on a VM made with opts and returns it, what it printed
+// and the quota it exceeded.
+func runQuota(t *testing.T, src string, opts ...Option) (*VM, string, *QuotaExceeded) {
+	t.Helper()
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	var out bytes.Buffer
+	vm := NewVM(append([]Option{Stdout(&out)}, opts...)...)
+	err := vm.Run(context.Background(), p)
+	var q *QuotaExceeded
+	if err != nil && !errors.As(err, &q) {
+		t.Fatalf("got %v, want a quota error", err)
+	}
+	return vm, out.String(), q
+}
+
+func TestQuotas(t *testing.T) {
+	const loop = `
+var n = 0;
+while (true) n = n + 1;
+`
+	const finite = `
+var n = 0;
+while (n < 100) n = n + 1;
+`
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		vm, _, q := runQuota(t, loop, Backend(e), MaxSteps(1000))
+		if q == nil || *q != (QuotaExceeded{3, StepLimit}) {
+			t.Errorf("%v: steps: got %v", e, q)
+		}
+		n := vm.Global("n").Value().Interface().(float64)
+		if e == TreeWalker && n != 998 {
+			// A step is a statement: the var, the while and each n = n + 1.
+			t.Errorf("%v: steps: looped %v times, want 998", e, n)
+		}
+		vm, _, _ = runQuota(t, loop, Backend(e), MaxSteps(2000))
+		more := vm.Global("n").Value().Interface().(float64)
+		// Twice the steps loop about twice as long: only a few go to the var.
+		if n <= 0 || more < 2*n-3 || more > 2*n+3 {
+			t.Errorf("%v: steps: looped %v times, then %v with twice the steps", e, n, more)
+		}
+		// Each run has the steps to itself.
+		vm, _, q = runQuota(t, finite, Backend(e), MaxSteps(1500))
+		if q != nil {
+			t.Errorf("%v: steps: a short loop went over: %v", e, q)
+		}
+		p, _ := Compile([]byte(finite))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Errorf("%v: steps: second run: %v", e, err)
+		}
+
+		vm, _, q = runQuota(t, `
+var s = "x";
+while (true) s = s + s;
+`, Backend(e), MaxMemory(1<<16))
+		if q == nil || *q != (QuotaExceeded{3, MemoryLimit}) {
+			t.Errorf("%v: memory: got %v", e, q)
+		}
+		if s := vm.Global("s").Value().Interface().(string); len(s) >= 1<<16 || len(s) < 1<<13 {
+			t.Errorf("%v: memory: built %d bytes", e, len(s))
+		}
+		if _, _, q = runQuota(t, `var s = "x"; s = s + s;`, Backend(e), MaxMemory(1<<16)); q != nil {
+			t.Errorf("%v: memory: a short string went over: %v", e, q)
+		}
+
+		_, out, q := runQuota(t, `
+while (true) print "spam";
+`, Backend(e), MaxOutput(100))
+		if q == nil || *q != (QuotaExceeded{2, OutputLimit}) {
+			t.Errorf("%v: output: got %v", e, q)
+		}
+		if want := strings.Repeat("spam\n", 20); out != want {
+			t.Errorf("%v: output: printed %q, want %q", e, out, want)
+		}
+
+		// Depth isn't spent: the next statements still run.
+		vm, out, q = runQuota(t, `
+var deepest = 0;
+fun down(n) { deepest = n; return 1 + down(n + 1); }
+down(1);
+print "after";
+down(1);
+`, Backend(e), MaxDepth(64))
+		if q == nil || *q != (QuotaExceeded{3, DepthLimit}) {
+			t.Errorf("%v: depth: got %v", e, q)
+		}
+		if out != "after\n" {
+			t.Errorf("%v: depth: printed %q", e, out)
+		}
+		if d := vm.Global("deepest").Value().Interface(); d != 64.0 {
+			t.Errorf("%v: depth: went %v calls deep, want 64", e, d)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+package lox
+
+// scope is a local scope being resolved. Names are all locals of the scope,
+// visible are those already declared at the point of resolution.
+type scope struct {
+	names   []string
+	visible map[string]int
+}
+
+// resolver binds local variables to environment slots, so interpreter doesn't
+// have to look them up by name. Everything outside of blocks and functions is
+// global and stays looked up by name.
+type resolver struct {
+	scopes []*scope
+	// functions is the number of functions being resolved
+	functions int
+	// depth is how deep the node being resolved is, err is set once one
+	// is too deep.
+	depth int
+	err   *Error
+}
+
+// maxDepth bounds the trees walked, which the parser keeps well below.
+const maxDepth = 2 * maxNesting
+
+// resolve annotates stmts in place. It fails on trees too deep to walk,
+// leaving what's too deep unresolved.
+func resolve(stmts []stmt) *Error {
+	r := &resolver{}
+	r.stmts(stmts)
+	return r.err
+}
+
+func (r *resolver) stmts(stmts []stmt) {
+	for _, s := range stmts {
+		r.stmt(s)
+	}
+}
+
+func (r *resolver) stmt(s stmt) {
+	if r.enter() {
+		s.Accept(r)
+	}
+	r.depth--
+}
+
+func (r *resolver) expr(e expr) {
+	if r.enter() {
+		e.Accept(r)
+	}
+	r.depth--
+}
+
+// enter counts a level of depth, and tells if it's not too deep.
+func (r *resolver) enter() bool {
+	if r.depth++; r.depth <= maxDepth {
+		return true
+	}
+	if r.err == nil {
+		r.err = &Error{Token{}, "program nested too deeply"}
+	}
+	return false
+}
+
+// declared lists names declared directly in stmts, the ones that go to the
+// environment of the block, after params. Every parameter gets a slot, but
+// redeclared variables share one.
+func declared(params []Token, stmts []stmt) []string {
+	var names []string
+	seen := map[string]bool{}
+	for _, p := range params {
+		seen[string(p.Lexeme)] = true
+		names = append(names, string(p.Lexeme))
+	}
+	add := func(name Token) {
+		if n := string(name.Lexeme); !seen[n] {
+			seen[n] = true
+			names = append(names, n)
+		}
+	}
+	for _, s := range stmts {
+		switch a := s.(type) {
+		case *varStmt:
+			add(a.Name)
+		case *functionStmt:
+			add(a.Name)
+		}
+	}
+	return names
+}
+
+// begin opens a scope for names if there are any and reports if it did.
+func (r *resolver) begin(names []string) bool {
+	if len(names) == 0 {
+		return false
+	}
+	r.scopes = append(r.scopes, &scope{names, make(map[string]int, len(names))})
+	return true
+}
+
+func (r *resolver) end(opened bool) {
+	if opened {
+		r.scopes = r.scopes[:len(r.scopes)-1]
+	}
+}
+
+// declare makes name visible in the innermost scope and returns its slot. It
+// reports false at the global scope.
+func (r *resolver) declare(name Token) (int, bool) {
+	if len(r.scopes) == 0 {
+		return 0, false
+	}
+	sc := r.scopes[len(r.scopes)-1]
+	n := string(name.Lexeme)
+	// The last one, to skip repeated parameters
+	for i := len(sc.names) - 1; i >= 0; i-- {
+		if sc.names[i] == n {
+			sc.visible[n] = i
+			return i, true
+		}
+	}
+	panic("undeclared local " + n)
+}
+
+// resolve finds the scope and slot of a local, reporting false for globals.
+func (r *resolver) resolve(name Token) (depth, slot int, local bool) {
+	n := string(name.Lexeme)
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		if slot, k := r.scopes[i].visible[n]; k {
+			return len(r.scopes) - 1 - i, slot, true
+		}
+	}
+	return 0, 0, false
+}
+
+func (r *resolver) Visit(v interface{}) (interface{}, *Error) {
+	switch a := v.(type) {
+	case *expressionStmt:
+		r.expr(a.Expr)
+	case *printStmt:
+		r.expr(a.Expr)
+	case *varStmt:
+		// The initializer sees the outer variable of the same name, if any.
+		if a.Init != nil {
+			r.expr(a.Init)
+		}
+		a.Slot, a.Local = r.declare(a.Name)
+	case *returnStmt:
+		if a.Value != nil {
+			r.expr(a.Value)
+		}
+		if r.functions > 0 {
+			e := a.Value
+			for g, k := e.(*groupingExpr); k; g, k = e.(*groupingExpr) {
+				e = g.Expr
+			}
+			if c, k := e.(*callExpr); k {
+				c.Tail = true
+			}
+		}
+	case *blockStmt:
+		a.Names = declared(nil, a.Stmts)
+		opened := r.begin(a.Names)
+		r.stmts(a.Stmts)
+		r.end(opened)
+	case *ifStmt:
+		r.expr(a.Cond)
+		r.stmt(a.Then)
+		if a.Else != nil {
+			r.stmt(a.Else)
+		}
+	case *whileStmt:
+		r.expr(a.Cond)
+		r.stmt(a.Body)
+	case *functionStmt:
+		a.Slot, a.Local = r.declare(a.Name)
+		a.Names = declared(a.Params, a.Body)
+		opened := r.begin(a.Names)
+		for i, p := range a.Params {
+			r.scopes[len(r.scopes)-1].visible[string(p.Lexeme)] = i
+		}
+		r.functions++
+		r.stmts(a.Body)
+		r.functions--
+		r.end(opened)
+	case *testStmt:
+		a.Names = declared(nil, a.Body)
+		opened := r.begin(a.Names)
+		r.stmts(a.Body)
+		r.end(opened)
+	case *selectStmt:
+		for _, c := range a.Cases {
+			r.expr(c.Chan)
+			if c.Value != nil {
+				r.expr(c.Value)
+			}
+			// The variable of a case is declared like a parameter of its body.
+			var params []Token
+			if c.Name.Lexeme != nil {
+				params = []Token{c.Name}
+			}
+			c.Names = declared(params, c.Body)
+			opened := r.begin(c.Names)
+			if params != nil {
+				r.scopes[len(r.scopes)-1].visible[string(c.Name.Lexeme)] = 0
+			}
+			r.stmts(c.Body)
+			r.end(opened)
+		}
+		if a.Default != nil {
+			r.stmt(a.Default)
+		}
+
+	case *literalExpr:
+	case *groupingExpr:
+		r.expr(a.Expr)
+	case *unaryExpr:
+		r.expr(a.Right)
+	case *binaryExpr:
+		r.expr(a.Left)
+		r.expr(a.Right)
+	case *logicalExpr:
+		r.expr(a.Left)
+		r.expr(a.Right)
+	case *variableExpr:
+		a.Depth, a.Slot, a.Local = r.resolve(a.Name)
+	case *assignExpr:
+		r.expr(a.Val)
+		a.Depth, a.Slot, a.Local = r.resolve(a.Name)
+	case *callExpr:
+		r.expr(a.Callee)
+		for _, ar := range a.Args {
+			r.expr(ar)
+		}
+	case *getExpr:
+		r.expr(a.Object)
+	case *setExpr:
+		r.expr(a.Object)
+		r.expr(a.Val)
+	case *spawnExpr:
+		r.expr(a.Call)
+	case *yieldExpr:
+		r.expr(a.Value)
+	}
+	return nil, nil
+}
+
+var _ = visitor(&resolver{})
@@ -0,0 +1,93 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"testing"
+)
+
+func TestResolveSlots(t *testing.T) {
+	p, diags := Compile([]byte(`
+fun f(x, y) {
+  {
+    var z = y;
+    return x + z;
+  }
+}
+`), Optimizations(false))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	block := p.stmts[0].(*functionStmt).Body[0].(*blockStmt)
+	y := block.Stmts[0].(*varStmt).Init.(*variableExpr)
+	sum := block.Stmts[1].(*returnStmt).Value.(*binaryExpr)
+	x, z := sum.Left.(*variableExpr), sum.Right.(*variableExpr)
+	for _, c := range []struct {
+		v           *variableExpr
+		depth, slot int
+	}{{x, 1, 0}, {y, 1, 1}, {z, 0, 0}} {
+		if !c.v.Local || c.v.Depth != c.depth || c.v.Slot != c.slot {
+			t.Errorf("%s resolved to %v %d.%d, want %d.%d", c.v.Name.Lexeme, c.v.Local, c.v.Depth, c.v.Slot, c.depth, c.slot)
+		}
+	}
+}
+
+func TestResolveShadowing(t *testing.T) {
+	const src = `
+var a = "global";
+{
+  fun show() { print a; }
+  show();
+  var a = "block";
+  show();
+  {
+    var a = a + " inner";
+    print a;
+  }
+  print a;
+}
+print a;
+{
+  var b = 1;
+  var b = b + 1;
+  print b;
+}
+fun counter() {
+  var n = 0;
+  fun inc() { var m = n + 1; n = m; return n; }
+  return inc;
+}
+var c1 = counter();
+var c2 = counter();
+c1();
+print c1();
+print c2();
+fun param(a) {
+  { var a = a * 2; print a; }
+  fun get() { return a; }
+  a = a + 1;
+  return get();
+}
+print param(5);
+{
+  var x = "before";
+  fun captured() { return x; }
+  x = "after";
+  print captured();
+}
+`
+	const want = "global\nglobal\nblock inner\nblock\nglobal\n2\n2\n1\n10\n6\nafter\n"
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		p, diags := Compile([]byte(src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		var out bytes.Buffer
+		if err := NewVM(Backend(e), Stdout(&out)).Run(context.Background(), p); err != nil {
+			t.Fatalf("%v: %v", e, err)
+		}
+		if out.String() != want {
+			t.Errorf("%v: printed %q, want %q", e, out.String(), want)
+		}
+	}
+}
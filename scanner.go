@@ -1,4 +1,4 @@
-package main
+package lox
 
 import (
 	"strconv"
@@ -25,23 +25,25 @@ var keywords = map[string]int{
 	"while":  tokenWhile,
 }
 
-// Scanner is a lexical analyzer class.
-type Scanner struct {
+// scanner is a lexical analyzer class.
+type scanner struct {
 	Source []byte
 	Tokens []Token
+	// Errors are the lexical errors found, scanning goes on after them.
+	Errors []*Error
 
 	start, current, line int
 }
 
-// NewScanner is a constructor for Scanner.
-func NewScanner(source []byte) *Scanner {
-	return &Scanner{
+// newScanner is a constructor for scanner.
+func newScanner(source []byte) *scanner {
+	return &scanner{
 		Source: source,
 		line:   1,
 	}
 }
 
-func (s *Scanner) ScanTokens() []Token {
+func (s *scanner) ScanTokens() []Token {
 	for !s.isAtEnd() {
 		s.start = s.current
 		s.next()
@@ -50,7 +52,11 @@ func (s *Scanner) ScanTokens() []Token {
 	return s.Tokens
 }
 
-func (s *Scanner) isAtEnd() bool {
+func (s *scanner) error(message string) {
+	s.Errors = append(s.Errors, &Error{Token{Line: s.line}, message})
+}
+
+func (s *scanner) isAtEnd() bool {
 	return s.current >= len(s.Source)
 }
 
@@ -72,7 +78,7 @@ var singles = map[rune]int{
 	'*': tokenStar,
 }
 
-func (s *Scanner) next() {
+func (s *scanner) next() {
 	r := s.advance()
 	match1 := func(prim, alt int) {
 		if s.match('=') {
@@ -110,7 +116,7 @@ func (s *Scanner) next() {
 		} else if unicode.IsLetter(r) {
 			s.ident()
 		} else {
-			loxerr(s.line, "unexpected character")
+			s.error("unexpected character")
 		}
 	case ' ':
 	case '\r':
@@ -118,7 +124,7 @@ func (s *Scanner) next() {
 	}
 }
 
-func (s *Scanner) ident() {
+func (s *scanner) ident() {
 	for unicode.IsDigit(s.peek()) || unicode.IsLetter(s.peek()) {
 		s.advance()
 	}
@@ -131,7 +137,7 @@ func (s *Scanner) ident() {
 	s.addToken(tokenIdent, nil)
 }
 
-func (s *Scanner) number() {
+func (s *scanner) number() {
 	for isdigit(s.peek()) {
 		s.advance()
 	}
@@ -146,7 +152,7 @@ func (s *Scanner) number() {
 
 }
 
-func (s *Scanner) string() {
+func (s *scanner) string() {
 	for s.peek() != '"' && !s.isAtEnd() {
 		if s.peek() == '\n' {
 			s.line++
@@ -154,7 +160,7 @@ func (s *Scanner) string() {
 		s.advance()
 	}
 	if s.isAtEnd() {
-		loxerr(s.line, "unterminated string")
+		s.error("unterminated string")
 		return
 	}
 	s.advance()
@@ -163,7 +169,7 @@ func (s *Scanner) string() {
 	s.addToken(tokenString, val)
 }
 
-func (s *Scanner) peekNext() rune {
+func (s *scanner) peekNext() rune {
 	_, sz1 := utf8.DecodeRune(s.Source[s.current:])
 	r, _ := utf8.DecodeRune(s.Source[s.current+sz1:])
 	if s.current+sz1 >= len(s.Source) {
@@ -172,14 +178,14 @@ func (s *Scanner) peekNext() rune {
 	return r
 }
 
-func (s *Scanner) peek() rune {
+func (s *scanner) peek() rune {
 	if s.isAtEnd() {
 		return 0
 	}
 	return s.cur()
 }
 
-func (s *Scanner) match(expected rune) bool {
+func (s *scanner) match(expected rune) bool {
 	if s.isAtEnd() {
 		return false
 	}
@@ -190,23 +196,23 @@ func (s *Scanner) match(expected rune) bool {
 	return true
 }
 
-func (s *Scanner) cur() rune {
+func (s *scanner) cur() rune {
 	r, _ := utf8.DecodeRune(s.Source[s.current:])
 	return r
 }
 
-func (s *Scanner) adv() {
+func (s *scanner) adv() {
 	_, sz := utf8.DecodeRune(s.Source[s.current:])
 	s.current += sz
 }
 
-func (s *Scanner) advance() rune {
+func (s *scanner) advance() rune {
 	r := s.cur()
 	s.adv()
 	return r
 }
 
-func (s *Scanner) addToken(typ int, literal interface{}) {
+func (s *scanner) addToken(typ int, literal interface{}) {
 	text := s.Source[s.start:s.current]
 	s.Tokens = append(s.Tokens, Token{typ, text, literal, s.line})
 }
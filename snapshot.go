@@ -0,0 +1,717 @@
+package lox
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// A snapshot holds the globals of a VM and everything they reach:
+//
+//	magic    "LOXS"
+//	version  uint16, big endian
+//	crc      uint32 of the rest of the file, big endian
+//	engine   byte
+//	programs uvarint count, then each a snapProgram* tag and its source or
+//	         bytecode
+//	objects  uvarint count, then each a snapObject* tag and its fields
+//	globals  uvarint count, then name and value pairs
+//
+// Values are a snap* tag like the constants of .loxc files, objects are
+// referred to by their index plus one, and 0 refers to the globals. Functions
+// are kept as the index of their declaration in their program, so programs
+// are compiled again on restore. Natives and host values are kept by the name
+// of the global the host defined them as.
+const (
+	snapMagic   = "LOXS"
+	snapVersion = 1
+)
+
+const (
+	snapNil = iota
+	snapFalse
+	snapTrue
+	snapNumber
+	snapString
+	snapObject
+)
+
+const (
+	snapProgramSource = iota
+	snapProgramBytecode
+)
+
+const (
+	snapObjectEnv = iota
+	snapObjectFunc
+	snapObjectClosure
+	snapObjectUpvalue
+	snapObjectNative
+)
+
+// Snapshot writes the globals of the engine the VM last ran a program on,
+// and all they reach, so Restore can bring them back in another process.
+func (vm *VM) Snapshot(w io.Writer) error {
+	if vm.running > 0 {
+		return errors.New("lox: Snapshot called while the VM is running")
+	}
+	s := &snapshotter{
+		vm:       vm,
+		programs: make(map[*Program]int),
+		decls:    make(map[interface{}]decl),
+		ids:      make(map[interface{}]int),
+		natives:  make(map[interface{}]string),
+	}
+	for _, p := range vm.programs {
+		for d, k := range p.declarations(vm.ran) {
+			s.decls[d] = decl{p, k}
+		}
+	}
+	s.name(natives)
+	s.name(vm.granted)
+	for name, v := range vm.defs {
+		s.natives[key(v.Object())] = name
+	}
+	delete(s.natives, nil)
+
+	globals := vm.interpreter().globals
+	if vm.ran == Bytecode {
+		globals = vm.bytecode().globals
+	}
+	var body bytes.Buffer
+	names := make([]string, 0, len(globals.values))
+	for name := range globals.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var n int
+	for _, name := range names {
+		g := globals.values[name]
+		if o := key(g.val.Object()); o != nil && s.natives[o] == name {
+			// The VM restoring the snapshot defines its own.
+			continue
+		}
+		putBytes(&body, []byte(name))
+		if err := s.value(&body, g.val); err != nil {
+			return fmt.Errorf("global %s: %w", name, err)
+		}
+		n++
+	}
+	var objects bytes.Buffer
+	for k := 0; k < len(s.objects); k++ {
+		if err := s.object(&objects, s.objects[k]); err != nil {
+			return err
+		}
+	}
+
+	var all bytes.Buffer
+	all.WriteByte(byte(vm.ran))
+	putUvarint(&all, uint64(len(s.order)))
+	for _, p := range s.order {
+		if p.loaded {
+			all.WriteByte(snapProgramBytecode)
+			putBytes(&all, encodeScripts(p.scripts))
+		} else {
+			all.WriteByte(snapProgramSource)
+			all.WriteByte(boolbyte(p.optimize))
+			putBytes(&all, p.src)
+		}
+	}
+	putUvarint(&all, uint64(len(s.objects)))
+	all.Write(objects.Bytes())
+	putUvarint(&all, uint64(n))
+	all.Write(body.Bytes())
+
+	var out bytes.Buffer
+	out.WriteString(snapMagic)
+	binary.Write(&out, binary.BigEndian, uint16(snapVersion))
+	binary.Write(&out, binary.BigEndian, crc32.ChecksumIEEE(all.Bytes()))
+	out.Write(all.Bytes())
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+type snapshotter struct {
+	vm *VM
+	// programs indexes the programs written, in order.
+	programs map[*Program]int
+	order    []*Program
+	// decls are the function declarations and protos of the programs run.
+	decls map[interface{}]decl
+	// objects are the objects to write, ids their index plus one.
+	objects []interface{}
+	ids     map[interface{}]int
+	// natives are the names the host defined natives and host values as.
+	natives map[interface{}]string
+}
+
+func (s *snapshotter) name(m map[string]callable) {
+	for name, fn := range m {
+		s.natives[key(fn)] = name
+	}
+}
+
+// key returns o if it can be a map key, nil if not.
+func key(o interface{}) interface{} {
+	if o == nil || !reflect.TypeOf(o).Comparable() {
+		return nil
+	}
+	return o
+}
+
+func (s *snapshotter) value(b *bytes.Buffer, v Value) error {
+	switch v.Kind() {
+	case KindNil:
+		b.WriteByte(snapNil)
+	case KindBool:
+		if v.Bool() {
+			b.WriteByte(snapTrue)
+		} else {
+			b.WriteByte(snapFalse)
+		}
+	case KindNumber:
+		b.WriteByte(snapNumber)
+		binary.Write(b, binary.BigEndian, math.Float64bits(v.Number()))
+	case KindString:
+		b.WriteByte(snapString)
+		putBytes(b, v.Bytes())
+	default:
+		b.WriteByte(snapObject)
+		return s.ref(b, v.Object())
+	}
+	return nil
+}
+
+// ref writes a reference to o, queuing it to be written if it's new.
+func (s *snapshotter) ref(b *bytes.Buffer, o interface{}) error {
+	if env, k := o.(*environment); k && env.values != nil {
+		putUvarint(b, 0)
+		return nil
+	}
+	k := key(o)
+	if k == nil {
+		return fmt.Errorf("can't snapshot %s", stringify(ObjectValue(o)))
+	}
+	id, seen := s.ids[k]
+	if !seen {
+		switch o.(type) {
+		case *environment, *function, *closure, *upvalue:
+		default:
+			if _, named := s.natives[k]; !named {
+				return fmt.Errorf("can't snapshot %s, the host didn't define it", stringify(ObjectValue(o)))
+			}
+		}
+		s.objects = append(s.objects, o)
+		id = len(s.objects)
+		s.ids[k] = id
+	}
+	putUvarint(b, uint64(id))
+	return nil
+}
+
+func (s *snapshotter) object(b *bytes.Buffer, o interface{}) error {
+	switch o := o.(type) {
+	case *environment:
+		b.WriteByte(snapObjectEnv)
+		if err := s.ref(b, o.enclosing); err != nil {
+			return err
+		}
+		putUvarint(b, uint64(len(o.slots)))
+		for _, v := range o.slots {
+			if err := s.value(b, v); err != nil {
+				return err
+			}
+		}
+		putUvarint(b, uint64(len(o.locals)))
+		for _, l := range o.locals {
+			putBytes(b, []byte(l))
+		}
+	case *function:
+		b.WriteByte(snapObjectFunc)
+		if err := s.declaration(b, o.declaration); err != nil {
+			return err
+		}
+		return s.ref(b, o.closure)
+	case *closure:
+		b.WriteByte(snapObjectClosure)
+		if err := s.declaration(b, o.proto); err != nil {
+			return err
+		}
+		putUvarint(b, uint64(len(o.upvalues)))
+		for _, u := range o.upvalues {
+			if err := s.ref(b, u); err != nil {
+				return err
+			}
+		}
+	case *upvalue:
+		if o.machine != nil {
+			return errors.New("can't snapshot an open upvalue")
+		}
+		b.WriteByte(snapObjectUpvalue)
+		return s.value(b, o.closed)
+	default:
+		b.WriteByte(snapObjectNative)
+		putBytes(b, []byte(s.natives[key(o)]))
+	}
+	return nil
+}
+
+// A decl is where a function is declared.
+type decl struct {
+	p *Program
+	k int
+}
+
+// declaration writes the index of the program declaring a function, and of
+// its declaration or proto d in it.
+func (s *snapshotter) declaration(b *bytes.Buffer, d interface{}) error {
+	where, k := s.decls[d]
+	if !k {
+		return fmt.Errorf("can't snapshot %s, declared by a program the VM didn't run", d)
+	}
+	n, k := s.programs[where.p]
+	if !k {
+		n = len(s.order)
+		s.programs[where.p] = n
+		s.order = append(s.order, where.p)
+	}
+	putUvarint(b, uint64(n))
+	putUvarint(b, uint64(where.k))
+	return nil
+}
+
+// declarations indexes the functions of p on engine e: its declarations in
+// the order they're written, or its protos in the order they're encoded.
+func (p *Program) declarations(e Engine) map[interface{}]int {
+	m := make(map[interface{}]int)
+	if p.loaded || e == Bytecode {
+		scripts, _ := p.compiled()
+		for _, s := range scripts {
+			eachProto(s, func(q *proto) { m[q] = len(m) })
+		}
+		return m
+	}
+	eachFunction(p.stmts, func(f *functionStmt) { m[f] = len(m) })
+	return m
+}
+
+// eachFunction calls fn for the function declarations in stmts, outer ones
+// first.
+func eachFunction(stmts []stmt, fn func(*functionStmt)) {
+	for _, s := range stmts {
+		switch a := s.(type) {
+		case *functionStmt:
+			fn(a)
+			eachFunction(a.Body, fn)
+		case *blockStmt:
+			eachFunction(a.Stmts, fn)
+		case *ifStmt:
+			eachFunction([]stmt{a.Then}, fn)
+			if a.Else != nil {
+				eachFunction([]stmt{a.Else}, fn)
+			}
+		case *whileStmt:
+			eachFunction([]stmt{a.Body}, fn)
+		case *testStmt:
+			eachFunction(a.Body, fn)
+		case *selectStmt:
+			for _, c := range a.Cases {
+				eachFunction(c.Body, fn)
+			}
+			if a.Default != nil {
+				eachFunction(a.Default.Stmts, fn)
+			}
+		}
+	}
+}
+
+// eachProto calls fn for p and the protos in its constants, outer ones
+// first.
+func eachProto(p *proto, fn func(*proto)) {
+	fn(p)
+	for _, c := range p.Chunk.Consts {
+		if q, k := c.Object().(*proto); k {
+			eachProto(q, fn)
+		}
+	}
+}
+
+func boolbyte(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// snapshotBody checks the header of snapshot bs and returns what follows it.
+func snapshotBody(bs []byte) ([]byte, error) {
+	if !bytes.HasPrefix(bs, []byte(snapMagic)) {
+		return nil, errors.New("not a yalox snapshot")
+	}
+	if len(bs) < 11 {
+		return nil, errors.New("corrupt snapshot: truncated header")
+	}
+	if v := binary.BigEndian.Uint16(bs[4:]); v != snapVersion {
+		return nil, fmt.Errorf("snapshot version %d is not supported, want %d", v, snapVersion)
+	}
+	body := bs[10:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(bs[6:]) {
+		return nil, errors.New("corrupt snapshot: checksum mismatch")
+	}
+	return body, nil
+}
+
+// SnapshotEngine tells which engine snapshot bs was made with, and so which
+// one a VM must use to restore it.
+func SnapshotEngine(bs []byte) (Engine, error) {
+	body, err := snapshotBody(bs)
+	if err != nil {
+		return 0, err
+	}
+	return Engine(body[0]), nil
+}
+
+// Restore defines the globals of a snapshot in the VM, which must use the
+// engine the snapshot was made with. Natives and host values are linked
+// again by name, so the VM must define those the snapshot refers to.
+func (vm *VM) Restore(r io.Reader) (err error) {
+	if vm.running > 0 {
+		return errors.New("lox: Restore called while the VM is running")
+	}
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	body, err := snapshotBody(bs)
+	if err != nil {
+		return err
+	}
+	// Snapshots may come from anywhere, and a bad one must not crash the host.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("corrupt snapshot: %v", r)
+		}
+	}()
+	d := &decoder{buf: body, what: "snapshot"}
+	if e := Engine(d.byte()); e != vm.conf.engine {
+		return fmt.Errorf("snapshot of the %s engine can't be restored in a VM using %s", e, vm.conf.engine)
+	}
+	u := &unsnapshotter{d: d, vm: vm}
+	if vm.conf.engine == Bytecode {
+		u.globals = vm.bytecode().globals
+	} else {
+		u.globals = vm.interpreter().globals
+	}
+	if err := u.restore(); err != nil {
+		return err
+	}
+	vm.ran = vm.conf.engine
+	return nil
+}
+
+type unsnapshotter struct {
+	d       *decoder
+	vm      *VM
+	globals *environment
+	// decls are the functions of each program, by index.
+	decls [][]interface{}
+	// objects are made before they're filled in, so they can refer to each
+	// other.
+	objects []interface{}
+	nobjs   int
+	fills   []func() error
+}
+
+func (u *unsnapshotter) restore() error {
+	d := u.d
+	nprogs := d.count()
+	for k := 0; k < nprogs && d.err == nil; k++ {
+		if err := u.program(); err != nil {
+			return err
+		}
+	}
+	u.nobjs = d.count()
+	for k := 0; k < u.nobjs && d.err == nil; k++ {
+		if err := u.object(); err != nil {
+			return err
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	for _, fill := range u.fills {
+		if err := fill(); err != nil {
+			return err
+		}
+	}
+	type def struct {
+		name string
+		v    Value
+	}
+	var defs []def
+	nglobals := d.count()
+	for k := 0; k < nglobals && d.err == nil; k++ {
+		name := string(d.bytes())
+		v, err := u.value()
+		if err != nil {
+			return err
+		}
+		defs = append(defs, def{name, v})
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.fail("%d trailing bytes", len(d.buf))
+	}
+	if d.err != nil {
+		return d.err
+	}
+	for _, g := range defs {
+		u.globals.Define(g.name, g.v)
+	}
+	return nil
+}
+
+func (u *unsnapshotter) program() error {
+	d := u.d
+	var p *Program
+	switch tag := d.byte(); tag {
+	case snapProgramSource:
+		optimize := d.byte() == 1
+		src := d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		var diags []Diagnostic
+		if p, diags = Compile(src, Optimizations(optimize)); diags != nil {
+			return fmt.Errorf("corrupt snapshot: program doesn't compile: %s", diags[0])
+		}
+	case snapProgramBytecode:
+		bs := d.bytes()
+		if d.err != nil {
+			return d.err
+		}
+		var err error
+		if p, err = LoadBytecode(bs); err != nil {
+			return fmt.Errorf("corrupt snapshot: %w", err)
+		}
+	default:
+		d.fail("unknown program tag %d", tag)
+		return d.err
+	}
+	u.vm.remember(p)
+	m := p.declarations(u.vm.conf.engine)
+	decls := make([]interface{}, len(m))
+	for decl, k := range m {
+		decls[k] = decl
+	}
+	u.decls = append(u.decls, decls)
+	return nil
+}
+
+// declaration reads the indexes of a function's program and declaration.
+func (u *unsnapshotter) declaration() interface{} {
+	p, k := u.d.uvarint(), u.d.uvarint()
+	if p >= uint64(len(u.decls)) || k >= uint64(len(u.decls[p])) {
+		u.d.fail("function %d:%d out of range", p, k)
+		return nil
+	}
+	return u.decls[p][k]
+}
+
+// ref reads a reference to an object, which is only valid once every object
+// is made.
+func (u *unsnapshotter) ref() int {
+	n := u.d.uvarint()
+	if n > uint64(u.nobjs) {
+		u.d.fail("object %d out of range", n)
+		return 0
+	}
+	return int(n)
+}
+
+// resolve returns the object a reference refers to.
+func (u *unsnapshotter) resolve(id int) (interface{}, error) {
+	if id == 0 {
+		return u.globals, nil
+	}
+	if id > len(u.objects) {
+		return nil, fmt.Errorf("corrupt snapshot: object %d out of range", id)
+	}
+	return u.objects[id-1], nil
+}
+
+// env resolves a reference to an environment.
+func (u *unsnapshotter) env(id int) (*environment, error) {
+	o, err := u.resolve(id)
+	if env, k := o.(*environment); k || err != nil {
+		return env, err
+	}
+	return nil, fmt.Errorf("corrupt snapshot: object %d isn't an environment", id)
+}
+
+// pending is a value whose object is only known once every object is made.
+type pending struct {
+	v   Value
+	ref int
+}
+
+func (u *unsnapshotter) pending() pending {
+	d := u.d
+	switch tag := d.byte(); tag {
+	case snapNil:
+		return pending{v: Nil}
+	case snapFalse, snapTrue:
+		return pending{v: BoolValue(tag == snapTrue)}
+	case snapNumber:
+		if len(d.buf) < 8 {
+			d.fail("unexpected end of file")
+			return pending{}
+		}
+		f := math.Float64frombits(binary.BigEndian.Uint64(d.buf))
+		d.buf = d.buf[8:]
+		return pending{v: NumberValue(f)}
+	case snapString:
+		return pending{v: StringValue(d.bytes())}
+	case snapObject:
+		return pending{ref: u.ref()}
+	default:
+		d.fail("unknown value tag %d", tag)
+	}
+	return pending{}
+}
+
+func (u *unsnapshotter) value() (Value, error) {
+	p := u.pending()
+	if u.d.err != nil {
+		return Nil, u.d.err
+	}
+	return u.resolved(p)
+}
+
+func (u *unsnapshotter) resolved(p pending) (Value, error) {
+	if p.ref == 0 {
+		return p.v, nil
+	}
+	o, err := u.resolve(p.ref)
+	if err != nil {
+		return Nil, err
+	}
+	if _, k := o.(*environment); k {
+		return Nil, fmt.Errorf("corrupt snapshot: environment %d used as a value", p.ref)
+	}
+	return ObjectValue(o), nil
+}
+
+func (u *unsnapshotter) object() error {
+	d := u.d
+	switch tag := d.byte(); tag {
+	case snapObjectEnv:
+		env := &environment{}
+		enclosing := u.ref()
+		slots := make([]pending, d.count())
+		for k := range slots {
+			slots[k] = u.pending()
+		}
+		nlocals := d.count()
+		for k := 0; k < nlocals && d.err == nil; k++ {
+			env.locals = append(env.locals, string(d.bytes()))
+		}
+		u.objects = append(u.objects, env)
+		u.fills = append(u.fills, func() (err error) {
+			if env.enclosing, err = u.env(enclosing); err != nil {
+				return err
+			}
+			env.slots = make([]Value, len(slots))
+			for k, p := range slots {
+				if env.slots[k], err = u.resolved(p); err != nil {
+					return err
+				}
+			}
+			// Snapshots are taken between runs, with every slot declared.
+			if env.live = len(env.slots); env.live > len(env.locals) {
+				env.live = len(env.locals)
+			}
+			return nil
+		})
+	case snapObjectFunc:
+		decl, k := u.declaration().(*functionStmt)
+		closure := u.ref()
+		if !k && d.err == nil {
+			d.fail("function isn't a declaration")
+		}
+		fn := &function{declaration: decl}
+		u.objects = append(u.objects, fn)
+		u.fills = append(u.fills, func() (err error) {
+			fn.closure, err = u.env(closure)
+			return err
+		})
+	case snapObjectClosure:
+		proto, k := u.declaration().(*proto)
+		if !k && d.err == nil {
+			d.fail("closure isn't a proto")
+		}
+		upvalues := make([]int, d.count())
+		for k := range upvalues {
+			upvalues[k] = u.ref()
+		}
+		if d.err == nil && len(upvalues) != len(proto.Upvalues) {
+			d.fail("%s has %d upvalues, not %d", proto, len(proto.Upvalues), len(upvalues))
+		}
+		cl := &closure{proto, make([]*upvalue, len(upvalues))}
+		u.objects = append(u.objects, cl)
+		u.fills = append(u.fills, func() error {
+			for k, id := range upvalues {
+				o, err := u.resolve(id)
+				if err != nil {
+					return err
+				}
+				var ok bool
+				if cl.upvalues[k], ok = o.(*upvalue); !ok {
+					return fmt.Errorf("corrupt snapshot: object %d isn't an upvalue", id)
+				}
+			}
+			return nil
+		})
+	case snapObjectUpvalue:
+		up := &upvalue{}
+		p := u.pending()
+		u.objects = append(u.objects, up)
+		u.fills = append(u.fills, func() (err error) {
+			up.closed, err = u.resolved(p)
+			return err
+		})
+	case snapObjectNative:
+		name := string(d.bytes())
+		if d.err != nil {
+			return d.err
+		}
+		o := u.native(name)
+		if o == nil {
+			return fmt.Errorf("snapshot refers to %s, which the VM doesn't define", name)
+		}
+		u.objects = append(u.objects, o)
+	default:
+		d.fail("unknown object tag %d", tag)
+	}
+	return d.err
+}
+
+// native returns the native or host value the VM defines as name.
+func (u *unsnapshotter) native(name string) interface{} {
+	if v, k := u.vm.defs[name]; k {
+		return v.Object()
+	}
+	if fn, k := u.vm.granted[name]; k {
+		return fn
+	}
+	if fn, k := natives[name]; k {
+		return fn
+	}
+	return nil
+}
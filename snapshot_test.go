@@ -0,0 +1,71 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"math/rand"
+	"testing"
+)
+
+// seal puts a valid header on the body of a snapshot.
+func seal(body []byte) []byte {
+	bs := make([]byte, 10, 10+len(body))
+	copy(bs, snapMagic)
+	binary.BigEndian.PutUint16(bs[4:], snapVersion)
+	binary.BigEndian.PutUint32(bs[6:], crc32.ChecksumIEEE(body))
+	return append(bs, body...)
+}
+
+const snapshotScript = `
+var count = 41;
+fun counter() { var n = 0; fun inc() { n = n + 1; count = count + 1; return n; } return inc; }
+var c = counter();
+c();
+var s = "str";
+`
+
+func TestRestoreCrafted(t *testing.T) {
+	src := []byte("/ 1 ;")
+	body := []byte{byte(TreeWalker), 1, snapProgramSource, 1, byte(len(src))}
+	body = append(append(body, src...), 0, 0)
+	if err := NewVM().Restore(bytes.NewReader(seal(body))); err == nil {
+		t.Error("restored a program that doesn't compile")
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		p, diags := Compile([]byte(snapshotScript))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		vm := NewVM(Backend(e))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		var snap bytes.Buffer
+		if err := vm.Snapshot(&snap); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := SnapshotEngine(snap.Bytes()); err != nil || got != e {
+			t.Errorf("SnapshotEngine = %v, %v, want %v", got, err, e)
+		}
+		body := snap.Bytes()[10:]
+		for n := 0; n < 2000; n++ {
+			mutant := append([]byte{}, body...)
+			for k := rnd.Intn(4) + 1; k > 0; k-- {
+				// The engine byte is checked before anything else.
+				mutant[1+rnd.Intn(len(mutant)-1)] = byte(rnd.Intn(256))
+			}
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("%v: Restore panicked on %q: %v", e, mutant, r)
+					}
+				}()
+				NewVM(Backend(e)).Restore(bytes.NewReader(seal(mutant)))
+			}()
+		}
+	}
+}
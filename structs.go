@@ -1,96 +1,174 @@
-package main
+package lox
 
-// Binary is a binary expression node
-type Binary struct {
-	Left  Expr
+// binaryExpr is a binary expression node
+type binaryExpr struct {
+	Left  expr
 	Op    Token
-	Right Expr
+	Right expr
 }
 
-// Grouping is an expression inside parentheses
-type Grouping struct {
-	Expr Expr
+// groupingExpr is an expression inside parentheses
+type groupingExpr struct {
+	Expr expr
 }
 
-// Literal is literal value in code
-type Literal struct {
-	Val interface{}
+// literalExpr is literal value in code
+type literalExpr struct {
+	Val Value
 }
 
-// Unary is an unary operation node
-type Unary struct {
+// unaryExpr is an unary operation node
+type unaryExpr struct {
 	Op    Token
-	Right Expr
+	Right expr
 }
 
-// Variable is a variable name in expression
-type Variable struct {
-	Name Token
+// variableExpr is a variable name in expression. Local variables are resolved
+// to a slot of the environment Depth levels up.
+type variableExpr struct {
+	Name  Token
+	Local bool
+	Depth int
+	Slot  int
+	// cache is the inline cache of global lookups
+	cache globalCache
 }
 
-// Expression is autological
-type Expression struct {
-	Expr Expr
+// expressionStmt is an expression used as a statement
+type expressionStmt struct {
+	Expr expr
 }
 
-// Print is a print statement node
-type Print struct {
-	Expr Expr
+// printStmt is a print statement node
+type printStmt struct {
+	Keyword Token
+	Expr    expr
+}
+
+// varStmt is a variable declaration
+type varStmt struct {
+	Name  Token
+	Init  expr
+	Local bool
+	Slot  int
 }
 
-// Var is a variable declaration
-type Var struct {
-	Name Token
-	Init Expr
+// assignExpr is an assignment statement
+type assignExpr struct {
+	Name  Token
+	Val   expr
+	Local bool
+	Depth int
+	Slot  int
+	cache globalCache
+}
+
+// getExpr reads a property of an object
+type getExpr struct {
+	Object expr
+	Name   Token
 }
 
-// Assign is an assignment statement
-type Assign struct {
-	Name Token
-	Val  Expr
+// setExpr writes a property of an object
+type setExpr struct {
+	Object expr
+	Name   Token
+	Val    expr
 }
 
-// Block is a block statement: a statement comprising a list of statements
-type Block struct {
-	Stmts []Stmt
+// blockStmt is a block statement: a statement comprising a list of statements.
+// Names are the locals declared in it, a block without them gets no
+// environment of its own.
+type blockStmt struct {
+	Stmts []stmt
+	Names []string
 }
 
-// If statement
-type If struct {
-	Cond Expr
-	Then Stmt
-	Else Stmt
+// ifStmt is an if statement
+type ifStmt struct {
+	Keyword Token
+	Cond    expr
+	Then    stmt
+	Else    stmt
 }
 
-// Logical operators: “and” and “or”
-type Logical struct {
-	Left  Expr
+// logicalExpr is one of the logical operators “and” and “or”
+type logicalExpr struct {
+	Left  expr
 	Op    Token
-	Right Expr
+	Right expr
 }
 
-// While loop
-type While struct {
-	Cond Expr
-	Body Stmt
+// whileStmt is a while loop
+type whileStmt struct {
+	Keyword Token
+	Cond    expr
+	Body    stmt
 }
 
-// Call inside expression
-type Call struct {
-	Callee Expr
+// callExpr is a call inside an expression
+type callExpr struct {
+	Callee expr
 	Paren  Token
-	Args   []Expr
+	Args   []expr
+	// Tail is set by resolver for calls returned from a function.
+	Tail bool
 }
 
-// Function declaration
-type Function struct {
-	Name   Token
-	Params []Token
-	Body   []Stmt
+// functionStmt is a function declaration. Names are its parameters and locals of the body.
+// Generator is set for functions that yield.
+type functionStmt struct {
+	Name      Token
+	Params    []Token
+	Body      []stmt
+	Names     []string
+	Local     bool
+	Slot      int
+	Generator bool
+}
+
+// returnStmt is a return statement
+type returnStmt struct {
+	Keyword Token
+	Value   expr
+}
+
+// testStmt is a named test declaration, run only by `yalox test`
+type testStmt struct {
+	Name  Token
+	Body  []stmt
+	Names []string
+}
+
+// spawnExpr runs Call as a new task
+type spawnExpr struct {
+	Keyword Token
+	Call    *callExpr
+}
+
+// yieldExpr suspends the generator running it with Value, until its next
+// resumption
+type yieldExpr struct {
+	Keyword Token
+	Value   expr
+}
+
+// selectStmt runs the first case whose channel operation can go on, waiting for
+// one unless there's a Default.
+type selectStmt struct {
+	Keyword Token
+	Cases   []*caseClause
+	Default *blockStmt
 }
 
-// Return statement
-type Return struct {
+// caseClause is a case of a select: a send of Value on Chan, or a receive
+// from it when Value is nil, into the variable Name if it has one. Names are
+// the locals of the body, the variable first.
+type caseClause struct {
 	Keyword Token
-	Value   Expr
+	Name    Token
+	Chan    expr
+	Value   expr
+	Body    []stmt
+	Names   []string
 }
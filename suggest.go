@@ -0,0 +1,75 @@
+package lox
+
+import (
+	"sort"
+	"strings"
+)
+
+// suggest returns a “did you mean” hint with the candidates closest to name,
+// or an empty string if none of them is close enough. It's meant to be
+// appended to errors about unknown names of any kind.
+func suggest(name string, candidates []string) string {
+	// Allow a typo for every three characters, but at least one.
+	best := len(name)/3 + 1
+	var found []string
+	seen := map[string]bool{}
+	for _, c := range candidates {
+		if c == name || seen[c] {
+			continue
+		}
+		seen[c] = true
+		d := distance(name, c)
+		if d < best {
+			best = d
+			found = found[:0]
+		}
+		if d == best {
+			found = append(found, c)
+		}
+	}
+	if len(found) == 0 {
+		return ""
+	}
+	sort.Strings(found)
+	if len(found) > 3 {
+		found = found[:3]
+	}
+	return "; did you mean '" + strings.Join(found, "' or '") + "'?"
+}
+
+// distance is the Damerau–Levenshtein distance between a and b, so a swap of
+// two neighbouring letters counts as one typo.
+func distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	d := make([][]int, len(ra)+1)
+	for i := range d {
+		d[i] = make([]int, len(rb)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			d[i][j] = min3(d[i-1][j]+1, d[i][j-1]+1, d[i-1][j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] && d[i-2][j-2]+1 < d[i][j] {
+				d[i][j] = d[i-2][j-2] + 1
+			}
+		}
+	}
+	return d[len(ra)][len(rb)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
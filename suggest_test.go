@@ -0,0 +1,60 @@
+package lox
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSuggest(t *testing.T) {
+	for _, c := range []struct {
+		name       string
+		candidates []string
+		want       string
+	}{
+		{"cout", []string{"count", "clock", "x"}, "; did you mean 'count'?"},
+		{"totla", []string{"total", "totals"}, "; did you mean 'total'?"},
+		{"ab", []string{"abc", "xb", "b", "ab"}, "; did you mean 'abc' or 'b' or 'xb'?"},
+		{"a", []string{"b", "c", "d", "e"}, "; did you mean 'b' or 'c' or 'd'?"},
+		{"name", []string{"name"}, ""},
+		{"value", []string{"other", "waltz"}, ""},
+		{"value", []string{"vlaeu"}, "; did you mean 'vlaeu'?"},
+		{"", nil, ""},
+	} {
+		if got := suggest(c.name, c.candidates); got != c.want {
+			t.Errorf("suggest(%q, %q) = %q, want %q", c.name, c.candidates, got, c.want)
+		}
+	}
+	for _, c := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "abc", 3}, {"abc", "abc", 0}, {"abc", "acb", 1}, {"kitten", "sitting", 3}, {"héllo", "hello", 1},
+	} {
+		if got := distance(c.a, c.b); got != c.want {
+			t.Errorf("distance(%q, %q) = %d, want %d", c.a, c.b, got, c.want)
+		}
+	}
+}
+
+func TestUndefinedSuggestions(t *testing.T) {
+	for _, c := range []struct{ src, want string }{
+		{"var counter = 1; print countr;", "undefined variable 'countr'; did you mean 'counter'?"},
+		{"asert(true);", "undefined variable 'asert'; did you mean 'assert'?"},
+		{"fun f() { var total = 2; { print totl; } } f();", "undefined variable 'totl'; did you mean 'total'?"},
+		{"fun f(limit) { fun g() { return limt; } return g(); } f(1);", "undefined variable 'limt'; did you mean 'limit'?"},
+		{"print zzzzzz;", "undefined variable 'zzzzzz'"},
+	} {
+		p, diags := Compile([]byte(c.src))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		for _, e := range []Engine{TreeWalker, Bytecode} {
+			err := NewVM(Backend(e)).Run(context.Background(), p)
+			var le *Error
+			if !errors.As(err, &le) || le.Message != c.want {
+				t.Errorf("%v: %s: got %v, want %q", e, c.src, err, c.want)
+			}
+		}
+	}
+}
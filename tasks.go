@@ -0,0 +1,641 @@
+package lox
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+)
+
+// Tasks are the functions scripts run with spawn. Each runs on a goroutine of
+// its own, but they take turns with the run that spawned them: one has the
+// turn at a time, until it waits on a channel or for a task, or ends. So no
+// two of them use environments, upvalues or quotas at once, and scripts run
+// the same way every time. Host functions taking a context are the
+// exception: they may block, so the task calling one lets the others go on
+// meanwhile.
+
+// engine is an interpreter or a machine, as tasks and generators see them.
+type engine interface {
+	SetContext(ctx context.Context)
+	call(fn Value, args []Value) (Value, []Frame, *Error)
+	budget() *quota
+	// start runs the body of the generator function fn.
+	start(fn Value, args []Value) *Error
+	// nesting returns how many calls deep the engine is, and how deep they
+	// may go. limit sets the latter.
+	nesting() (depth, max int)
+	limit(max int)
+}
+
+// scheduler has the tasks of a VM and passes the turn between them. The
+// host, running scripts, has a task of its own, main.
+type scheduler struct {
+	vm  *VM
+	ctx context.Context
+	// current has the turn.
+	current *task
+	main    *task
+	// ready are the tasks to give the turn to, in order.
+	ready []*task
+	// tasks are those spawned and not done yet.
+	tasks []*task
+	// idle is set while main waits for the tasks to be done or blocked, so
+	// it's not deadlocked once they are.
+	idle bool
+	// killing is set while reset ends the tasks.
+	killing bool
+	// err is the first error a task ended with since the run began.
+	err error
+	// out counts the tasks calling host functions without the turn. back
+	// are those of them done and waiting for it, and signal tells when
+	// one is.
+	out    int
+	back   []*task
+	signal chan struct{}
+	// mu guards back, and what calls back into the VM checks: whether a
+	// run is going on, how many tasks are in host functions without the
+	// turn, and how many host functions were called with it.
+	mu      sync.Mutex
+	busy    bool
+	away    int
+	hosting int
+}
+
+// killed is what reset wakes tasks with. It stops them like an interrupt.
+func killed() *Error {
+	return &Error{Token{Type: interrupted}, "task killed"}
+}
+
+func newScheduler(vm *VM) *scheduler {
+	s := &scheduler{vm: vm, ctx: context.Background(), signal: make(chan struct{}, 1)}
+	s.main = &task{s: s, wake: make(chan *Error, 1)}
+	s.current = s.main
+	return s
+}
+
+func (s *scheduler) natives() map[string]callable {
+	return map[string]callable{"channel": &nf_channel{s}}
+}
+
+// begin gets the tasks ready for a run or call of the host with ctx.
+func (s *scheduler) begin(ctx context.Context) {
+	s.ctx, s.err = ctx, nil
+	for _, t := range s.tasks {
+		t.engine.SetContext(ctx)
+	}
+	s.mu.Lock()
+	s.busy = true
+	s.mu.Unlock()
+}
+
+// finish marks the end of what begin began.
+func (s *scheduler) finish() {
+	s.mu.Lock()
+	s.busy = false
+	s.mu.Unlock()
+}
+
+// engine returns the engine of t.
+func (s *scheduler) engine(t *task) engine {
+	if t.engine != nil {
+		return t.engine
+	}
+	return s.vm.engine()
+}
+
+// task is a function running on its own, or the host's turn.
+type task struct {
+	s *scheduler
+	// engine runs the task, nil for main, which runs on those of the VM.
+	engine engine
+	// wake gives the task the turn, with an error to stop what it waits
+	// for if it's not nil.
+	wake   chan *Error
+	done   bool
+	result Value
+	err    *Error
+	// joined are waiting for the task to be done.
+	joined []waiter
+	// out is set while the task calls a host function without the turn,
+	// and lost is the error it was given the turn back with, if any.
+	// cancel cancels the context of the host function.
+	out    bool
+	lost   *Error
+	cancel context.CancelFunc
+}
+
+func (t *task) String() string {
+	return "<task>"
+}
+
+func (t *task) Get(name string) (Value, *Error) {
+	if name == "wait" {
+		return ObjectValue(&builtin{0, func(args []Value) (Value, *Error) {
+			return t.s.join(t)
+		}}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("task has no property '%s'", name)}
+}
+
+func (t *task) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of a task", name)}
+}
+
+// spawn makes a task calling fn with args on e. It runs once the current
+// task gives the turn away.
+func (s *scheduler) spawn(e engine, fn Value, args []Value) *task {
+	t := &task{s: s, engine: e, wake: make(chan *Error, 1)}
+	s.tasks = append(s.tasks, t)
+	s.ready = append(s.ready, t)
+	go func() {
+		if err := <-t.wake; err != nil {
+			s.end(t, Nil, err)
+			return
+		}
+		v, _, err := e.call(fn, args)
+		s.end(t, v, err)
+	}()
+	return t
+}
+
+// pass gives the turn to t, along with the quotas left, without waiting.
+func (s *scheduler) pass(t *task, err *Error) {
+	if t != s.current {
+		*s.engine(t).budget() = *s.engine(s.current).budget()
+		s.current = t
+	}
+	t.wake <- err
+}
+
+// next picks the task to take the turn from the current one, which waits.
+// Main gets it once no task is ready, with an error if it's blocked too.
+// Tasks calling host functions are waited for before that, unless main is
+// idle: it leaves them like blocked ones.
+func (s *scheduler) next() (*task, *Error) {
+	s.collect()
+	for len(s.ready) == 0 && s.out > 0 && !s.idle {
+		s.await()
+	}
+	if len(s.ready) > 0 {
+		t := s.ready[0]
+		s.ready = s.ready[1:]
+		return t, nil
+	}
+	if s.current == s.main {
+		return nil, deadlocked()
+	}
+	if s.idle {
+		return s.main, nil
+	}
+	return s.main, deadlocked()
+}
+
+func deadlocked() *Error {
+	return &Error{Token{}, "deadlock: all tasks are blocked"}
+}
+
+// block gives the turn away until something wakes the current task, and
+// returns the error it's woken with.
+func (s *scheduler) block() *Error {
+	t := s.current
+	next, err := s.next()
+	if next == nil {
+		return err
+	}
+	s.pass(next, err)
+	return <-t.wake
+}
+
+// turnKey is the key of the task in the context of a host function called
+// without the turn.
+type turnKey struct{}
+
+// native calls fn. Host functions that take a context give the turn to a
+// task that's ready meanwhile, as they may block; ctx tells calls back into
+// the VM which task they're for.
+func (s *scheduler) native(fn callable, ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	h, k := fn.(hostFunc)
+	if !k || s == nil {
+		return fn.Call(ctx, i, args)
+	}
+	t := s.current
+	if !h.off {
+		s.mu.Lock()
+		s.hosting++
+		s.mu.Unlock()
+		defer func() {
+			s.mu.Lock()
+			s.hosting--
+			s.mu.Unlock()
+		}()
+		return fn.Call(ctx, i, args)
+	}
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, turnKey{}, t))
+	defer cancel()
+	t.cancel = cancel
+	s.release()
+	v, err := fn.Call(ctx, i, args)
+	if t.out {
+		s.retake(t)
+	}
+	t.cancel = nil
+	if t.lost != nil {
+		v, err, t.lost = Nil, t.lost, nil
+	}
+	return v, err
+}
+
+// release gives the turn to the first task ready, if any, while the current
+// one calls a host function.
+func (s *scheduler) release() {
+	if len(s.ready) == 0 {
+		return
+	}
+	t, next := s.current, s.ready[0]
+	s.ready = s.ready[1:]
+	s.out++
+	s.mu.Lock()
+	t.out = true
+	s.away++
+	s.mu.Unlock()
+	s.pass(next, nil)
+}
+
+// retake waits for the turn to come back to t after release. It returns the
+// error t is given it with, which stops what t runs.
+func (s *scheduler) retake(t *task) *Error {
+	s.mu.Lock()
+	t.out = false
+	s.away--
+	s.back = append(s.back, t)
+	s.mu.Unlock()
+	select {
+	case s.signal <- struct{}{}:
+	default:
+	}
+	t.lost = <-t.wake
+	return t.lost
+}
+
+// await waits for a task to be back from a host function.
+func (s *scheduler) await() {
+	<-s.signal
+	s.collect()
+}
+
+// stray tells if a call back into the VM without the context of a host
+// function may come from one that runs without the turn.
+func (s *scheduler) stray() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.busy && s.away > 0 && s.hosting == 0
+}
+
+// collect makes the tasks back from host functions ready.
+func (s *scheduler) collect() {
+	s.mu.Lock()
+	s.ready = append(s.ready, s.back...)
+	s.out -= len(s.back)
+	s.back = nil
+	s.mu.Unlock()
+}
+
+// end finishes t with the result of its function, and gives the turn away
+// for good.
+func (s *scheduler) end(t *task, v Value, err *Error) {
+	for k, u := range s.tasks {
+		if u == t {
+			s.tasks = append(s.tasks[:k], s.tasks[k+1:]...)
+			break
+		}
+	}
+	t.done, t.result, t.err = true, v, err
+	if s.killing {
+		s.pass(s.main, nil)
+		return
+	}
+	if err != nil && fatal(err) {
+		// The run is over, main stops it.
+		s.pass(s.main, err)
+		return
+	}
+	if err != nil {
+		if e := s.vm.fail(s.ctx, err); s.err == nil {
+			s.err = e
+		}
+	}
+	for _, w := range t.joined {
+		w.fire(v)
+	}
+	t.joined = nil
+	next, derr := s.next()
+	s.pass(next, derr)
+}
+
+// join waits for t to be done and returns its result.
+func (s *scheduler) join(t *task) (Value, *Error) {
+	if !t.done {
+		w := &wait{t: s.current, fired: -1}
+		t.joined = append(t.joined, waiter{w, 0, Nil})
+		err := s.block()
+		t.joined = w.cancel(t.joined)
+		if err != nil {
+			return Nil, err
+		}
+	}
+	if t.err != nil {
+		tok := Token{}
+		if uncatchable(t.err) {
+			tok.Type, tok.Literal = t.err.Token.Type, t.err.Token.Literal
+		}
+		return Nil, &Error{tok, "task failed: " + t.err.Message}
+	}
+	return t.result, nil
+}
+
+// drain lets main wait for the tasks until each of them is done or blocked.
+// It returns the error of a task that stopped the run.
+func (s *scheduler) drain() *Error {
+	s.idle = true
+	defer func() { s.idle = false }()
+	next, _ := s.next()
+	if next == nil {
+		return nil
+	}
+	s.pass(next, nil)
+	return <-s.main.wake
+}
+
+// deadlock fails the tasks that are blocked with nothing left to wake them.
+// It returns the error of a task that stopped the run.
+func (s *scheduler) deadlock() *Error {
+	for {
+		if err := s.drain(); err != nil {
+			return err
+		}
+		if s.out == 0 {
+			break
+		}
+		// What's back from a host function may wake the others.
+		s.await()
+	}
+	blocked := append([]*task(nil), s.tasks...)
+	s.idle = true
+	defer func() { s.idle = false }()
+	for _, t := range blocked {
+		if t.done {
+			continue
+		}
+		s.pass(t, deadlocked())
+		if err := <-s.main.wake; err != nil {
+			return err
+		}
+	}
+	// Those left blocked again after failing, or spawned meanwhile.
+	s.reset()
+	return nil
+}
+
+// reset ends every task, for runs that stopped for good. Host functions
+// called without the turn are cancelled, and waited for.
+func (s *scheduler) reset() {
+	s.mu.Lock()
+	for _, t := range s.tasks {
+		if t.out && t.cancel != nil {
+			t.cancel()
+		}
+	}
+	s.mu.Unlock()
+	s.killing = true
+	for len(s.tasks) > 0 {
+		s.pass(s.tasks[0], killed())
+		<-s.main.wake
+	}
+	s.killing = false
+	s.collect()
+	s.ready, s.out = nil, 0
+}
+
+// wait is a task waiting on channels or for a task, until one of its cases
+// can go on.
+type wait struct {
+	t *task
+	// fired is the case that went on, -1 until one did.
+	fired int
+	// v is the value received.
+	v Value
+	// closed is set when a send waited on a channel that got closed.
+	closed bool
+}
+
+// waiter is a case of a wait, in the queue of a channel or task. v is what
+// the case sends.
+type waiter struct {
+	w     *wait
+	index int
+	v     Value
+}
+
+// fire makes the case of w go on with v received, and the task waiting
+// ready.
+func (w waiter) fire(v Value) {
+	w.w.fired, w.w.v = w.index, v
+	s := w.w.t.s
+	s.ready = append(s.ready, w.w.t)
+}
+
+// cancel returns queue without the cases of w.
+func (w *wait) cancel(queue []waiter) []waiter {
+	out := queue[:0]
+	for _, q := range queue {
+		if q.w != w {
+			out = append(out, q)
+		}
+	}
+	return out
+}
+
+// channel passes values between tasks, holding up to its capacity.
+type channel struct {
+	s      *scheduler
+	cap    int
+	buf    []Value
+	closed bool
+	recvq  []waiter
+	sendq  []waiter
+}
+
+func (c *channel) String() string {
+	return "<channel>"
+}
+
+func (c *channel) Get(name string) (Value, *Error) {
+	switch name {
+	case "send":
+		return ObjectValue(&builtin{1, func(args []Value) (Value, *Error) {
+			_, _, err := c.s.selects([]selectCase{{c, true, args[0]}}, true)
+			return Nil, err
+		}}), nil
+	case "recv":
+		return ObjectValue(&builtin{0, func(args []Value) (Value, *Error) {
+			_, v, err := c.s.selects([]selectCase{{c, false, Nil}}, true)
+			return v, err
+		}}), nil
+	case "close":
+		return ObjectValue(&builtin{0, func(args []Value) (Value, *Error) {
+			return Nil, c.close()
+		}}), nil
+	}
+	return Nil, &Error{Token{}, fmt.Sprintf("channel has no property '%s'", name)}
+}
+
+func (c *channel) Set(name string, v Value) *Error {
+	return &Error{Token{}, fmt.Sprintf("can't set %s of a channel", name)}
+}
+
+// dequeue takes the first case from queue that hasn't gone on yet. A wait
+// leaves the queues once its task has the turn again.
+func dequeue(queue *[]waiter) (waiter, bool) {
+	for len(*queue) > 0 {
+		w := (*queue)[0]
+		*queue = (*queue)[1:]
+		if w.w.fired < 0 {
+			return w, true
+		}
+	}
+	return waiter{}, false
+}
+
+// trySend sends v if it can without waiting, and reports if it did.
+func (c *channel) trySend(v Value) (bool, *Error) {
+	if c.closed {
+		return false, &Error{Token{}, "send on closed channel"}
+	}
+	if r, k := dequeue(&c.recvq); k {
+		r.fire(v)
+		return true, nil
+	}
+	if len(c.buf) < c.cap {
+		c.buf = append(c.buf, v)
+		return true, nil
+	}
+	return false, nil
+}
+
+// tryRecv receives a value if it can without waiting, and reports if it
+// did. Closed channels give nil once empty.
+func (c *channel) tryRecv() (Value, bool) {
+	if len(c.buf) > 0 {
+		v := c.buf[0]
+		c.buf = c.buf[1:]
+		if w, k := dequeue(&c.sendq); k {
+			c.buf = append(c.buf, w.v)
+			w.fire(Nil)
+		}
+		return v, true
+	}
+	if w, k := dequeue(&c.sendq); k {
+		w.fire(Nil)
+		return w.v, true
+	}
+	return Nil, c.closed
+}
+
+func (c *channel) close() *Error {
+	if c.closed {
+		return &Error{Token{}, "close of closed channel"}
+	}
+	c.closed = true
+	for r, k := dequeue(&c.recvq); k; r, k = dequeue(&c.recvq) {
+		r.fire(Nil)
+	}
+	for w, k := dequeue(&c.sendq); k; w, k = dequeue(&c.sendq) {
+		w.w.closed = true
+		w.fire(Nil)
+	}
+	return nil
+}
+
+// selectCase is a case of a select: a send of v on ch, or a receive from it.
+type selectCase struct {
+	ch   *channel
+	send bool
+	v    Value
+}
+
+// selects runs the first of cases that can go on, waiting for one if block
+// is set and none can yet. It returns which one did and what it received,
+// -1 when none did.
+func (s *scheduler) selects(cases []selectCase, block bool) (int, Value, *Error) {
+	for k, c := range cases {
+		if c.send {
+			sent, err := c.ch.trySend(c.v)
+			if err != nil {
+				return 0, Nil, err
+			}
+			if sent {
+				return k, Nil, nil
+			}
+		} else if v, k2 := c.ch.tryRecv(); k2 {
+			return k, v, nil
+		}
+	}
+	if !block {
+		return -1, Nil, nil
+	}
+	w := &wait{t: s.current, fired: -1}
+	for k, c := range cases {
+		if c.send {
+			c.ch.sendq = append(c.ch.sendq, waiter{w, k, c.v})
+		} else {
+			c.ch.recvq = append(c.ch.recvq, waiter{w, k, Nil})
+		}
+	}
+	err := s.block()
+	for _, c := range cases {
+		c.ch.recvq, c.ch.sendq = w.cancel(c.ch.recvq), w.cancel(c.ch.sendq)
+	}
+	if err != nil {
+		return 0, Nil, err
+	}
+	if w.closed {
+		return 0, Nil, &Error{Token{}, "send on closed channel"}
+	}
+	return w.fired, w.v, nil
+}
+
+// nf_channel makes a channel, unbuffered or holding as many values as its
+// argument says.
+type nf_channel struct {
+	s *scheduler
+}
+
+func (f *nf_channel) Call(ctx context.Context, i *interpreter, args []Value) (Value, *Error) {
+	if len(args) > 1 {
+		return Nil, &Error{Token{}, fmt.Sprintf("expected 0 or 1 arguments but got %d", len(args))}
+	}
+	c := &channel{s: f.s}
+	if len(args) == 1 {
+		n := args[0]
+		if n.Kind() != KindNumber || n.Number() < 0 || n.Number() != math.Trunc(n.Number()) {
+			return Nil, &Error{Token{}, "capacity must be a whole number of values"}
+		}
+		if n.Number() > math.MaxInt32 {
+			return Nil, &Error{Token{}, "capacity is too large"}
+		}
+		c.cap = int(n.Number())
+	}
+	if err := f.s.engine(f.s.current).budget().alloc(chanSize); err != nil {
+		return Nil, err
+	}
+	return ObjectValue(c), nil
+}
+
+func (*nf_channel) Arity() int {
+	return -1
+}
+
+func (*nf_channel) String() string {
+	return "<native fn>"
+}
@@ -0,0 +1,227 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHostFunctionsBlocking checks that a task blocked in a host function
+// lets the others go on, and takes the turn back to call into the VM.
+func TestHostFunctionsBlocking(t *testing.T) {
+	const src = `
+fun callback(x) { print "callback " + x; return x + "!"; }
+fun a() { print block(); }
+fun b() { print "b"; unblock(); }
+var ta = spawn a();
+var tb = spawn b();
+ta.wait();
+tb.wait();
+print "done";
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), Stdout(&out), Stderr(&out))
+		ch := make(chan string)
+		vm.Define("block", func(ctx context.Context) (Value, error) {
+			select {
+			case x := <-ch:
+				return vm.Global("callback").Call(ctx, x)
+			case <-time.After(5 * time.Second):
+				return Nil, errors.New("stalled")
+			}
+		})
+		vm.Define("unblock", func() {
+			go func() { ch <- "a" }()
+		})
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatalf("%v: %v\n%s", e, err, out.String())
+		}
+		if want := "b\ncallback a\na!\ndone\n"; out.String() != want {
+			t.Errorf("%v: printed %q, want %q", e, out.String(), want)
+		}
+	}
+}
+
+// TestDiscardedVMEndsTasks checks that tasks left blocked don't outlive
+// their VM.
+func TestDiscardedVMEndsTasks(t *testing.T) {
+	const src = `
+var c = channel();
+fun recv() { c.recv(); }
+for (var i = 0; i < 10; i = i + 1) spawn recv();
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	before := runtime.NumGoroutine()
+	for n := 0; n < 20; n++ {
+		vm := NewVM(Backend([]Engine{TreeWalker, Bytecode}[n%2]))
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for wait := 0; runtime.NumGoroutine() > before; wait++ {
+		if wait == 100 {
+			t.Fatalf("%d goroutines left, want %d", runtime.NumGoroutine(), before)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type counter struct {
+	N int
+}
+
+func (c *counter) Incr() {
+	time.Sleep(time.Millisecond)
+	c.N++
+}
+
+// TestBridgedMethodsKeepTheTurn checks that methods of Go values don't run
+// while tasks use the fields, which is meant to be done with -race.
+func TestBridgedMethodsKeepTheTurn(t *testing.T) {
+	const src = `
+fun bump() { for (var i = 0; i < 20; i = i + 1) c.N = c.N + 1; }
+var tb = spawn bump();
+for (var i = 0; i < 20; i = i + 1) c.Incr();
+tb.wait();
+print c.N;
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), Stdout(&out), Stderr(&out))
+		vm.Define("c", &counter{})
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatalf("%v: %v", e, err)
+		}
+		if out.String() != "40\n" {
+			t.Errorf("%v: printed %q, want 40", e, out.String())
+		}
+	}
+}
+
+// TestStrayCallback checks that a host function calling back into the VM
+// without its context while tasks run gets an error.
+func TestStrayCallback(t *testing.T) {
+	const src = `
+fun f() { return "called"; }
+var c = channel();
+fun a() { print stray(); c.send(1); }
+fun b() { started(); c.recv(); }
+var ta = spawn a();
+var tb = spawn b();
+ta.wait();
+tb.wait();
+`
+	p, diags := Compile([]byte(src))
+	if diags != nil {
+		t.Fatal(diags)
+	}
+	for _, e := range []Engine{TreeWalker, Bytecode} {
+		var out bytes.Buffer
+		vm := NewVM(Backend(e), Stdout(&out), Stderr(&out))
+		ch := make(chan bool, 1)
+		vm.Define("stray", func(ctx context.Context) string {
+			<-ch
+			if _, err := vm.Global("f").Call(context.Background()); err != nil {
+				return err.Error()
+			}
+			return "no error"
+		})
+		vm.Define("started", func() { ch <- true })
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatalf("%v: %v\n%s", e, err, out.String())
+		}
+		if !strings.Contains(out.String(), "without the context of the host function") {
+			t.Errorf("%v: printed %q, want the error", e, out.String())
+		}
+	}
+}
+
+// TestDropWhileInHostFunctions checks that dropping a VM whose tasks are in
+// host functions cancels them without holding up finalizers.
+func TestDropWhileInHostFunctions(t *testing.T) {
+	before := runtime.NumGoroutine()
+	started := make(chan bool, 2)
+	cancelled := make(chan bool, 1)
+	release := make(chan bool)
+	func() {
+		vm := NewVM()
+		// slow ignores its context.
+		vm.Define("slow", func(ctx context.Context) {
+			started <- true
+			<-release
+		})
+		vm.Define("wait", func(ctx context.Context) {
+			started <- true
+			<-ctx.Done()
+			cancelled <- true
+		})
+		p, diags := Compile([]byte(`
+fun p1() { slow(); }
+fun p2() { wait(); }
+fun q() {}
+spawn p1();
+spawn p2();
+spawn q();
+`))
+		if diags != nil {
+			t.Fatal(diags)
+		}
+		if err := vm.Run(context.Background(), p); err != nil {
+			t.Fatal(err)
+		}
+		<-started
+		<-started
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for dropped := false; !dropped; {
+		runtime.GC()
+		select {
+		case <-cancelled:
+			dropped = true
+		case <-deadline:
+			t.Fatal("the host function wasn't cancelled")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// slow still has its task, which mustn't hold up other finalizers.
+	done := make(chan bool)
+	sentinel := new(int)
+	runtime.SetFinalizer(sentinel, func(*int) { close(done) })
+	sentinel = nil
+	for finalized := false; !finalized; {
+		runtime.GC()
+		select {
+		case <-done:
+			finalized = true
+		case <-deadline:
+			t.Fatal("finalizers are held up")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	close(release)
+	for wait := 0; runtime.NumGoroutine() > before; wait++ {
+		if wait == 100 {
+			t.Fatalf("%d goroutines left, want %d", runtime.NumGoroutine(), before)
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -1,8 +1,12 @@
-package main
+package lox
 
 // Enum TokenType in the book.
 const (
 	returnMe = -1
+	// interrupted is the token type of errors stopping a cancelled run.
+	interrupted = -2
+	// exhausted is the token type of errors stopping a run over its quota.
+	exhausted = -3
 	// One character
 	_ = iota
 	tokenLeftParen
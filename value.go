@@ -0,0 +1,136 @@
+package lox
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Kind is the type of a Value.
+type Kind uint8
+
+const (
+	KindNil Kind = iota
+	KindBool
+	KindNumber
+	KindString
+	// KindObject is everything else: functions and natives.
+	KindObject
+)
+
+// Value is a Lox value. Numbers and booleans are stored inline, so they don't
+// allocate like they would in an interface{}.
+type Value struct {
+	kind Kind
+	// num holds numbers, and booleans as 0 or 1
+	num float64
+	// ref holds strings as []byte and objects
+	ref interface{}
+}
+
+// Nil is the nil value, and also the zero Value.
+var Nil = Value{}
+
+func NumberValue(f float64) Value {
+	return Value{kind: KindNumber, num: f}
+}
+
+func BoolValue(b bool) Value {
+	if b {
+		return Value{kind: KindBool, num: 1}
+	}
+	return Value{kind: KindBool}
+}
+
+func StringValue(s []byte) Value {
+	return Value{kind: KindString, ref: s}
+}
+
+func ObjectValue(o interface{}) Value {
+	return Value{kind: KindObject, ref: o}
+}
+
+// valueOf converts a literal from the scanner.
+func valueOf(v interface{}) Value {
+	switch a := v.(type) {
+	case nil:
+		return Nil
+	case bool:
+		return BoolValue(a)
+	case float64:
+		return NumberValue(a)
+	case []byte:
+		return StringValue(a)
+	}
+	return ObjectValue(v)
+}
+
+func (v Value) Kind() Kind {
+	return v.kind
+}
+
+func (v Value) Number() float64 {
+	return v.num
+}
+
+func (v Value) Bool() bool {
+	return v.num != 0
+}
+
+func (v Value) Bytes() []byte {
+	b, _ := v.ref.([]byte)
+	return b
+}
+
+func (v Value) Object() interface{} {
+	if v.kind != KindObject {
+		return nil
+	}
+	return v.ref
+}
+
+func istruthy(v Value) bool {
+	switch v.kind {
+	case KindNil:
+		return false
+	case KindBool:
+		return v.num != 0
+	}
+	return true
+}
+
+func isequal(a Value, b Value) bool {
+	if a.kind != b.kind {
+		return false
+	}
+	switch a.kind {
+	case KindNil:
+		return true
+	case KindBool, KindNumber:
+		return a.num == b.num
+	case KindString:
+		return bytes.Equal(a.Bytes(), b.Bytes())
+	}
+	return a.ref == b.ref
+}
+
+func stringify(v Value) string {
+	switch v.kind {
+	case KindNil:
+		return "nil"
+	case KindBool:
+		return fmt.Sprint(v.num != 0)
+	case KindNumber:
+		return fmt.Sprint(v.num)
+	case KindString:
+		return string(v.Bytes())
+	}
+	return fmt.Sprint(v.ref)
+}
+
+// repr is like stringify, but makes strings distinguishable from other values.
+func repr(v Value) string {
+	if v.kind == KindString {
+		return fmt.Sprintf("%q", v.Bytes())
+	}
+	return stringify(v)
+}
@@ -0,0 +1,48 @@
+package lox
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+)
+
+// loopScript is arithmetic on locals, which allocated a value per operation
+// before Value was tagged.
+const loopScript = `
+{
+  var sum = 0;
+  for (var i = 0; i < 100000; i = i + 1) {
+    sum = sum + i * 2 - 1;
+  }
+}
+`
+
+const fibScript = `
+fun fib(n) {
+  if (n < 2) return n;
+  return fib(n - 1) + fib(n - 2);
+}
+fib(20);
+`
+
+// benchRun runs src on engine e b.N times, compiled once.
+func benchRun(b *testing.B, src string, e Engine) {
+	p, diags := Compile([]byte(src), Backend(e))
+	if diags != nil {
+		b.Fatal(diags)
+	}
+	vm := NewVM(Backend(e), Stdout(ioutil.Discard))
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := vm.Run(ctx, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoopTree(b *testing.B) { benchRun(b, loopScript, TreeWalker) }
+func BenchmarkLoopVM(b *testing.B)   { benchRun(b, loopScript, Bytecode) }
+func BenchmarkFibTree(b *testing.B)  { benchRun(b, fibScript, TreeWalker) }
+func BenchmarkFibVM(b *testing.B)    { benchRun(b, fibScript, Bytecode) }
@@ -1,82 +1,117 @@
 // Generated, DO NOT EDIT. Name is intentional.
-package main
+package lox
 
-// Accept is an auto-generated acceptor method for While
-func (w *While) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for whileStmt
+func (w *whileStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(w)
 }
 
-// Accept is an auto-generated acceptor method for Binary
-func (b *Binary) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for binaryExpr
+func (b *binaryExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(b)
 }
 
-// Accept is an auto-generated acceptor method for Grouping
-func (g *Grouping) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for groupingExpr
+func (g *groupingExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(g)
 }
 
-// Accept is an auto-generated acceptor method for Variable
-func (v *Variable) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for variableExpr
+func (v *variableExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(v)
 }
 
-// Accept is an auto-generated acceptor method for If
-func (i *If) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for ifStmt
+func (i *ifStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(i)
 }
 
-// Accept is an auto-generated acceptor method for Assign
-func (a *Assign) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for assignExpr
+func (a *assignExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(a)
 }
 
-// Accept is an auto-generated acceptor method for Return
-func (r *Return) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for returnStmt
+func (r *returnStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(r)
 }
 
-// Accept is an auto-generated acceptor method for Expression
-func (e *Expression) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for expressionStmt
+func (e *expressionStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(e)
 }
 
-// Accept is an auto-generated acceptor method for Print
-func (p *Print) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for printStmt
+func (p *printStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(p)
 }
 
-// Accept is an auto-generated acceptor method for Block
-func (b *Block) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for blockStmt
+func (b *blockStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(b)
 }
 
-// Accept is an auto-generated acceptor method for Call
-func (c *Call) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for callExpr
+func (c *callExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(c)
 }
 
-// Accept is an auto-generated acceptor method for Function
-func (f *Function) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for functionStmt
+func (f *functionStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(f)
 }
 
-// Accept is an auto-generated acceptor method for Literal
-func (l *Literal) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for literalExpr
+func (l *literalExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(l)
 }
 
-// Accept is an auto-generated acceptor method for Unary
-func (u *Unary) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for unaryExpr
+func (u *unaryExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(u)
 }
 
-// Accept is an auto-generated acceptor method for Var
-func (v *Var) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for varStmt
+func (v *varStmt) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(v)
 }
 
-// Accept is an auto-generated acceptor method for Logical
-func (l *Logical) Accept(vis Visitor) (interface{}, *Error) {
+// Accept is an auto-generated acceptor method for logicalExpr
+func (l *logicalExpr) Accept(vis visitor) (interface{}, *Error) {
 	return vis.Visit(l)
 }
+
+// Accept is an auto-generated acceptor method for testStmt
+func (t *testStmt) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(t)
+}
+
+// Accept is an auto-generated acceptor method for getExpr
+func (g *getExpr) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(g)
+}
+
+// Accept is an auto-generated acceptor method for setExpr
+func (s *setExpr) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(s)
+}
+
+// Accept is an auto-generated acceptor method for spawnExpr
+func (s *spawnExpr) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(s)
+}
+
+// Accept is an auto-generated acceptor method for selectStmt
+func (s *selectStmt) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(s)
+}
+
+// Accept is an auto-generated acceptor method for caseClause
+func (c *caseClause) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(c)
+}
+
+// Accept is an auto-generated acceptor method for yieldExpr
+func (y *yieldExpr) Accept(vis visitor) (interface{}, *Error) {
+	return vis.Visit(y)
+}
@@ -0,0 +1,635 @@
+package lox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+type frame struct {
+	closure *closure
+	ip      int
+	// base is the stack slot of the called closure, its locals follow it.
+	base int
+	// elided counts the tail calls that reused the frame.
+	elided int
+}
+
+// machine is a stack machine running the compiler's bytecode. It's an alternative
+// to interpreter and must behave the same way.
+type machine struct {
+	globals  *environment
+	stack    []Value
+	frames   []frame
+	upvalues []*upvalue // open ones, ordered by slot
+
+	// MaxDepth is the maximum depth of nested calls.
+	MaxDepth int
+	// Stdout is where print writes.
+	Stdout io.Writer
+	ctx    context.Context
+	// done is the Done channel of ctx, nil if it can't be cancelled.
+	done <-chan struct{}
+	quota
+	hooks Hooks
+	// tasks are those of the VM, nil when not running on one.
+	tasks *scheduler
+	// co is the coroutine of the generator the machine runs, if any.
+	co *coroutine
+}
+
+func newMachine(globals *environment) *machine {
+	vm := &machine{
+		globals:  globals,
+		stack:    make([]Value, 0, 256),
+		MaxDepth: DefaultMaxDepth,
+		Stdout:   os.Stdout,
+		ctx:      context.Background(),
+		quota:    unlimited,
+	}
+	for name, fn := range natives {
+		vm.globals.Define(name, ObjectValue(fn))
+	}
+	return vm
+}
+
+// fork returns a machine sharing the globals and settings of vm, for a task
+// or a generator.
+func (vm *machine) fork() *machine {
+	return &machine{
+		globals:  vm.globals,
+		stack:    make([]Value, 0, 16),
+		MaxDepth: vm.MaxDepth,
+		Stdout:   vm.Stdout,
+		ctx:      vm.ctx,
+		done:     vm.done,
+		quota:    vm.quota,
+		hooks:    vm.hooks,
+		tasks:    vm.tasks,
+	}
+}
+
+// SetContext makes the machine stop when ctx is done, and passes ctx to
+// natives.
+func (vm *machine) SetContext(ctx context.Context) {
+	vm.ctx, vm.done = ctx, ctx.Done()
+}
+
+// Run runs a compiled script.
+func (vm *machine) Run(script *proto) *Error {
+	vm.clear()
+	cl := &closure{proto: script}
+	vm.push(ObjectValue(cl))
+	vm.frames = append(vm.frames, frame{cl, 0, 0, 0})
+	err := vm.guarded(0)
+	vm.clear()
+	if err != nil && script.Declares != "" {
+		vm.globals.Define(script.Declares, Nil)
+	}
+	return err
+}
+
+// guarded runs the frames above stop, turning a Go panic into an error like
+// interpreter.guarded does.
+func (vm *machine) guarded(stop int) (err *Error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &Error{Token{}, fmt.Sprintf("internal error: %v", r)}
+		}
+	}()
+	return vm.run(stop)
+}
+
+// call calls fn for the host, which may be running a script already. It
+// returns the trace of the error, if any.
+func (vm *machine) call(fn Value, args []Value) (Value, []Frame, *Error) {
+	switch c := fn.Object().(type) {
+	case *closure:
+		if len(args) != c.proto.Arity {
+			return Nil, nil, &Error{Token{}, fmt.Sprintf("expected %d arguments but got %d", c.proto.Arity, len(args))}
+		}
+		if len(vm.frames) >= vm.MaxDepth {
+			return Nil, nil, exceeded(DepthLimit, 0)
+		}
+		if c.proto.Generator {
+			vm.hooks.call(fn, args)
+			g, err := vm.generate(c, args)
+			if err == nil {
+				vm.hooks.ret(fn, g)
+			}
+			return g, nil, err
+		}
+		return vm.enter(c, args)
+	case callable:
+		if n := c.Arity(); n >= 0 && len(args) != n {
+			return Nil, nil, &Error{Token{}, fmt.Sprintf("expected %d arguments but got %d", n, len(args))}
+		}
+		vm.hooks.call(fn, args)
+		v, err := vm.tasks.native(c, vm.ctx, nil, args)
+		if err == nil {
+			vm.hooks.ret(fn, v)
+		}
+		return v, nil, err
+	}
+	return Nil, nil, &Error{Token{}, "can only call functions and classes"}
+}
+
+// enter runs c with args in a frame of its own.
+func (vm *machine) enter(c *closure, args []Value) (Value, []Frame, *Error) {
+	base, frames := len(vm.stack), len(vm.frames)
+	vm.hooks.call(ObjectValue(c), args)
+	vm.push(ObjectValue(c))
+	vm.stack = append(vm.stack, args...)
+	vm.frames = append(vm.frames, frame{c, 0, base, 0})
+	if err := vm.guarded(frames); err != nil {
+		trace := vm.traceback(frames)
+		vm.close(base)
+		vm.stack, vm.frames = vm.stack[:base], vm.frames[:frames]
+		return Nil, trace, err
+	}
+	return vm.pop(), nil, nil
+}
+
+// generate makes a generator calling c with args.
+func (vm *machine) generate(c *closure, args []Value) (Value, *Error) {
+	if vm.tasks == nil {
+		return Nil, &Error{Token{}, "can't make generators outside of a VM"}
+	}
+	if err := vm.alloc(genSize); err != nil {
+		return Nil, err
+	}
+	e := vm.fork()
+	e.co = newCoroutine()
+	args = append([]Value(nil), args...)
+	return ObjectValue(vm.tasks.generate(e, e.co, ObjectValue(c), args)), nil
+}
+
+// start runs the body of the generator function fn, as the first call of
+// the machine.
+func (vm *machine) start(fn Value, args []Value) *Error {
+	if len(vm.frames) >= vm.MaxDepth {
+		return exceeded(DepthLimit, 0)
+	}
+	_, _, err := vm.enter(fn.Object().(*closure), args)
+	return err
+}
+
+func (vm *machine) nesting() (int, int) {
+	return len(vm.frames), vm.MaxDepth
+}
+
+func (vm *machine) limit(max int) {
+	vm.MaxDepth = max
+}
+
+// traceback lists the frames above stop, innermost first.
+func (vm *machine) traceback(stop int) []Frame {
+	var trace []Frame
+	for k := len(vm.frames) - 1; k >= stop; k-- {
+		f := vm.frames[k]
+		ip := f.ip
+		if ip > 0 {
+			// Callers are past their call already.
+			ip--
+		}
+		trace = append(trace, Frame{f.closure.proto.Name, f.closure.proto.Chunk.Lines[ip], f.elided})
+	}
+	return trace
+}
+
+func (vm *machine) run(stop int) *Error {
+	f := &vm.frames[len(vm.frames)-1]
+	ch := &f.closure.proto.Chunk
+	// start is the position of the current instruction, for errors.
+	var start int
+	fail := func(msg string) *Error {
+		return &Error{Token{Line: ch.Lines[start]}, msg}
+	}
+	// charged sets the line of a quota error.
+	charged := func(err *Error) *Error {
+		err.Token.Line = ch.Lines[start]
+		return err
+	}
+	read := func() byte {
+		f.ip++
+		return ch.Code[f.ip-1]
+	}
+	read2 := func() int {
+		f.ip += 2
+		return int(ch.Code[f.ip-2])<<8 | int(ch.Code[f.ip-1])
+	}
+	name := func(idx int) Token {
+		return Token{Type: tokenIdent, Lexeme: ch.Consts[idx].Bytes(), Line: ch.Lines[start]}
+	}
+
+	for {
+		start = f.ip
+		if vm.steps--; vm.steps < 0 {
+			if err := vm.tick(f, start); err != nil {
+				return err
+			}
+		}
+		switch read() {
+		case opConstant:
+			vm.push(ch.Consts[read2()])
+		case opNil:
+			vm.push(Nil)
+		case opTrue:
+			vm.push(BoolValue(true))
+		case opFalse:
+			vm.push(BoolValue(false))
+		case opPop:
+			vm.pop()
+		case opGetLocal:
+			vm.push(vm.stack[f.base+int(read())])
+		case opSetLocal:
+			vm.stack[f.base+int(read())] = vm.peek(0)
+		case opGetGlobal:
+			idx := read2()
+			g := ch.caches[idx].lookup(vm.globals, ch.Consts[idx].Bytes())
+			if g == nil {
+				return vm.globals.undefined(name(idx), f.closure.proto.Locals...)
+			}
+			vm.push(g.val)
+		case opDefineGlobal:
+			vm.globals.Define(string(ch.Consts[read2()].Bytes()), vm.pop())
+		case opSetGlobal:
+			idx := read2()
+			g := ch.caches[idx].lookup(vm.globals, ch.Consts[idx].Bytes())
+			if g == nil {
+				return vm.globals.undefined(name(idx), f.closure.proto.Locals...)
+			}
+			g.val = vm.peek(0)
+		case opGetProperty:
+			idx := read2()
+			inst, k := vm.pop().Object().(instance)
+			if !k {
+				return fail("only objects have properties")
+			}
+			v, err := inst.Get(string(ch.Consts[idx].Bytes()))
+			if err != nil {
+				if err.Token.Line == 0 {
+					err.Token.Line = ch.Lines[start]
+				}
+				return err
+			}
+			vm.push(v)
+		case opSetProperty:
+			idx := read2()
+			v := vm.pop()
+			inst, k := vm.pop().Object().(instance)
+			if !k {
+				return fail("only objects have properties")
+			}
+			if err := inst.Set(string(ch.Consts[idx].Bytes()), v); err != nil {
+				if err.Token.Line == 0 {
+					err.Token.Line = ch.Lines[start]
+				}
+				return err
+			}
+			vm.push(v)
+		case opGetUpvalue:
+			vm.push(vm.upvalue(f.closure.upvalues[read()]))
+		case opSetUpvalue:
+			u := f.closure.upvalues[read()]
+			if u.machine != nil {
+				u.machine.stack[u.slot] = vm.peek(0)
+			} else {
+				u.closed = vm.peek(0)
+			}
+		case opEqual:
+			r, l := vm.pop(), vm.pop()
+			vm.push(BoolValue(isequal(l, r)))
+		case opNotEqual:
+			r, l := vm.pop(), vm.pop()
+			vm.push(BoolValue(!isequal(l, r)))
+		case opGreater, opGreaterEqual, opLess, opLessEqual, opSubtract, opMultiply, opDivide:
+			rv, lv := vm.pop(), vm.pop()
+			if lv.kind != KindNumber || rv.kind != KindNumber {
+				return fail("operands must be numbers")
+			}
+			l, r := lv.num, rv.num
+			switch ch.Code[start] {
+			case opGreater:
+				vm.push(BoolValue(l > r))
+			case opGreaterEqual:
+				vm.push(BoolValue(l >= r))
+			case opLess:
+				vm.push(BoolValue(l < r))
+			case opLessEqual:
+				vm.push(BoolValue(l <= r))
+			case opSubtract:
+				vm.push(NumberValue(l - r))
+			case opMultiply:
+				vm.push(NumberValue(l * r))
+			case opDivide:
+				vm.push(NumberValue(l / r))
+			}
+		case opAdd:
+			r, l := vm.pop(), vm.pop()
+			if l.kind == KindNumber && r.kind == KindNumber {
+				vm.push(NumberValue(l.num + r.num))
+			} else if l.kind == KindString && r.kind == KindString {
+				le, re := l.Bytes(), r.Bytes()
+				if err := vm.alloc(int64(len(le) + len(re))); err != nil {
+					return charged(err)
+				}
+				s := make([]byte, 0, len(le)+len(re))
+				vm.push(StringValue(append(append(s, le...), re...)))
+			} else {
+				return fail("both operands must be either strings or numbers")
+			}
+		case opNot:
+			vm.push(BoolValue(!istruthy(vm.pop())))
+		case opNegate:
+			v := vm.pop()
+			if v.kind != KindNumber {
+				return fail("operand must be a number")
+			}
+			vm.push(NumberValue(-v.num))
+		case opPrint:
+			s := stringify(vm.pop())
+			if err := vm.write(len(s)); err != nil {
+				return charged(err)
+			}
+			fmt.Fprintln(vm.Stdout, s)
+		case opJump:
+			off := read2()
+			f.ip += off
+		case opJumpIfFalse:
+			off := read2()
+			if !istruthy(vm.peek(0)) {
+				f.ip += off
+			}
+		case opLoop:
+			off := read2()
+			f.ip -= off
+			if vm.done != nil {
+				if err := stopped(vm.ctx, vm.done, ch.Lines[start]); err != nil {
+					return err
+				}
+			}
+		case opCall, opTailCall:
+			argc := int(read())
+			if vm.done != nil {
+				if err := stopped(vm.ctx, vm.done, ch.Lines[start]); err != nil {
+					return err
+				}
+			}
+			callee := vm.peek(argc)
+			switch fn := callee.Object().(type) {
+			case *closure:
+				if argc != fn.proto.Arity {
+					return fail(fmt.Sprintf("expected %d arguments but got %d", fn.proto.Arity, argc))
+				}
+				if fn.proto.Generator {
+					// Making a generator is no tail call, the return after it
+					// returns the generator.
+					if len(vm.frames)-1 >= vm.MaxDepth {
+						return exceeded(DepthLimit, ch.Lines[start])
+					}
+					args := make([]Value, argc)
+					copy(args, vm.stack[len(vm.stack)-argc:])
+					vm.hooks.call(callee, args)
+					g, err := vm.generate(fn, args)
+					if err != nil {
+						return charged(err)
+					}
+					vm.hooks.ret(callee, g)
+					vm.drop(len(vm.stack) - argc - 1)
+					vm.push(g)
+					break
+				}
+				if ch.Code[start] == opTailCall {
+					// The callee takes over the frame of the caller, whose
+					// locals are dead but may be captured.
+					vm.hooks.ret(ObjectValue(f.closure), Nil)
+					vm.hooks.call(callee, vm.stack[len(vm.stack)-argc:])
+					vm.close(f.base)
+					n := copy(vm.stack[f.base:], vm.stack[len(vm.stack)-argc-1:])
+					vm.drop(f.base + n)
+					f.closure, f.ip = fn, 0
+					f.elided++
+					ch = &fn.proto.Chunk
+					break
+				}
+				if len(vm.frames)-1 >= vm.MaxDepth {
+					return exceeded(DepthLimit, ch.Lines[start])
+				}
+				vm.hooks.call(callee, vm.stack[len(vm.stack)-argc:])
+				vm.frames = append(vm.frames, frame{fn, 0, len(vm.stack) - argc - 1, 0})
+				f = &vm.frames[len(vm.frames)-1]
+				ch = &fn.proto.Chunk
+			case callable:
+				if n := fn.Arity(); n >= 0 && argc != n {
+					return fail(fmt.Sprintf("expected %d arguments but got %d", fn.Arity(), argc))
+				}
+				if len(vm.frames)-1 >= vm.MaxDepth {
+					return exceeded(DepthLimit, ch.Lines[start])
+				}
+				args := make([]Value, argc)
+				copy(args, vm.stack[len(vm.stack)-argc:])
+				vm.hooks.call(callee, args)
+				// Natives get no interpreter when running on the VM.
+				v, err := vm.tasks.native(fn, vm.ctx, nil, args)
+				// The native may have called back into the machine, which
+				// may have moved the frames.
+				f = &vm.frames[len(vm.frames)-1]
+				if err != nil {
+					if err.Token.Line == 0 {
+						err.Token.Line = ch.Lines[start]
+					}
+					return err
+				}
+				vm.hooks.ret(callee, v)
+				vm.drop(len(vm.stack) - argc - 1)
+				vm.push(v)
+			default:
+				return fail("can only call functions and classes")
+			}
+		case opSpawn:
+			argc := int(read())
+			callee := vm.peek(argc)
+			switch fn := callee.Object().(type) {
+			case *closure:
+				if argc != fn.proto.Arity {
+					return fail(fmt.Sprintf("expected %d arguments but got %d", fn.proto.Arity, argc))
+				}
+			case callable:
+				if n := fn.Arity(); n >= 0 && argc != n {
+					return fail(fmt.Sprintf("expected %d arguments but got %d", n, argc))
+				}
+			default:
+				return fail("can only call functions and classes")
+			}
+			if vm.tasks == nil {
+				return fail("can't spawn tasks outside of a VM")
+			}
+			if err := vm.alloc(taskSize); err != nil {
+				return charged(err)
+			}
+			args := make([]Value, argc)
+			copy(args, vm.stack[len(vm.stack)-argc:])
+			vm.drop(len(vm.stack) - argc - 1)
+			vm.push(ObjectValue(vm.tasks.spawn(vm.fork(), callee, args)))
+		case opYield:
+			if vm.co == nil {
+				return fail("can't yield outside of a generator")
+			}
+			vm.push(vm.co.yield(vm.pop()))
+		case opSelect:
+			// Each case pushed its channel, the value it sends or nil, and
+			// whether it sends. Whether there's a default comes last.
+			n := int(read())
+			block := !istruthy(vm.pop())
+			base := len(vm.stack) - 3*n
+			cases := make([]selectCase, n)
+			for k := range cases {
+				ch, ok := vm.stack[base+3*k].Object().(*channel)
+				if !ok {
+					return fail("can only select on channels")
+				}
+				cases[k] = selectCase{ch, istruthy(vm.stack[base+3*k+2]), vm.stack[base+3*k+1]}
+			}
+			vm.drop(base)
+			if vm.tasks == nil {
+				return fail("can't select outside of a VM")
+			}
+			k, v, err := vm.tasks.selects(cases, block)
+			if err != nil {
+				if err.Token.Line == 0 {
+					err.Token.Line = ch.Lines[start]
+				}
+				return err
+			}
+			vm.push(v)
+			vm.push(NumberValue(float64(k)))
+		case opClosure:
+			proto := ch.Consts[read2()].Object().(*proto)
+			if err := vm.alloc(closureSize + int64(len(proto.Upvalues))*(ptrSize+upvalueSize)); err != nil {
+				return charged(err)
+			}
+			cl := &closure{proto, make([]*upvalue, len(proto.Upvalues))}
+			for i, u := range proto.Upvalues {
+				if u.Local {
+					cl.upvalues[i] = vm.capture(f.base + int(u.Index))
+				} else {
+					cl.upvalues[i] = f.closure.upvalues[u.Index]
+				}
+			}
+			vm.push(ObjectValue(cl))
+		case opCloseUpvalue:
+			vm.close(len(vm.stack) - 1)
+			vm.pop()
+		case opReturn:
+			v := vm.pop()
+			if vm.hooks.OnReturn != nil && f.closure.proto.Name != "" {
+				// Scripts have no name, and aren't called.
+				vm.hooks.OnReturn(ObjectValue(f.closure), v)
+			}
+			vm.close(f.base)
+			vm.drop(f.base)
+			vm.frames = vm.frames[:len(vm.frames)-1]
+			vm.push(v)
+			if len(vm.frames) == stop {
+				return nil
+			}
+			f = &vm.frames[len(vm.frames)-1]
+			ch = &f.closure.proto.Chunk
+		default:
+			return fail(fmt.Sprintf("bad opcode %d", ch.Code[start]))
+		}
+	}
+}
+
+// tick is the slow path of counting the step of running the instruction at
+// ip of f.
+func (vm *machine) tick(f *frame, ip int) *Error {
+	ch := &f.closure.proto.Chunk
+	if !vm.step() {
+		return exceeded(StepLimit, ch.Lines[ip])
+	}
+	for _, s := range ch.statements(ip) {
+		vm.hooks.OnStatement(Statement{s.line, statementKinds[s.kind]}, Env{vm: vm, frame: f, locals: s.locals})
+	}
+	return nil
+}
+
+func (vm *machine) push(v Value) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *machine) pop() Value {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+// drop pops what's above n, clearing the slots.
+func (vm *machine) drop(n int) {
+	for k := n; k < len(vm.stack); k++ {
+		vm.stack[k] = Nil
+	}
+	vm.stack = vm.stack[:n]
+}
+
+// clear empties the machine. What its stacks held past their tops is cleared
+// too, so that it isn't kept alive: a generator left suspended refers to
+// the machine.
+func (vm *machine) clear() {
+	s := vm.stack[:cap(vm.stack)]
+	for k := range s {
+		s[k] = Nil
+	}
+	f := vm.frames[:cap(vm.frames)]
+	for k := range f {
+		f[k] = frame{}
+	}
+	u := vm.upvalues[:cap(vm.upvalues)]
+	for k := range u {
+		u[k] = nil
+	}
+	vm.stack, vm.frames, vm.upvalues = s[:0], f[:0], u[:0]
+}
+
+func (vm *machine) peek(dist int) Value {
+	return vm.stack[len(vm.stack)-1-dist]
+}
+
+func (vm *machine) upvalue(u *upvalue) Value {
+	if u.machine != nil {
+		return u.machine.stack[u.slot]
+	}
+	return u.closed
+}
+
+// capture returns the open upvalue for slot, so closures share variables.
+func (vm *machine) capture(slot int) *upvalue {
+	for _, u := range vm.upvalues {
+		if u.slot == slot {
+			return u
+		}
+	}
+	u := &upvalue{slot: slot, machine: vm}
+	i := len(vm.upvalues)
+	for i > 0 && vm.upvalues[i-1].slot > slot {
+		i--
+	}
+	vm.upvalues = append(vm.upvalues, nil)
+	copy(vm.upvalues[i+1:], vm.upvalues[i:])
+	vm.upvalues[i] = u
+	return u
+}
+
+// close closes the upvalues of the slots starting from last.
+func (vm *machine) close(last int) {
+	i := len(vm.upvalues)
+	for i > 0 && vm.upvalues[i-1].slot >= last {
+		i--
+		u := vm.upvalues[i]
+		u.closed = vm.stack[u.slot]
+		u.machine = nil
+	}
+	vm.upvalues = vm.upvalues[:i]
+}
@@ -0,0 +1,127 @@
+package lox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+type diffPoint struct{ X, Y float64 }
+
+func (p *diffPoint) Scale(k float64) *diffPoint {
+	return &diffPoint{p.X * k, p.Y * k}
+}
+
+// TestEnginesAgree runs scripts on both engines, which must print and fail
+// the same way.
+func TestEnginesAgree(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		src  string
+		opts []Option
+	}{
+		{"closures", `
+fun counter() {
+  var n = 0;
+  fun inc() { n = n + 1; return n; }
+  return inc;
+}
+var a = counter();
+var b = counter();
+a(); a();
+print a();
+print b();
+var first;
+var last;
+for (var i = 0; i < 3; i = i + 1) {
+  var j = i;
+  fun get() { return j; }
+  if (i == 0) first = get;
+  last = get;
+}
+print first() + last();
+fun outer() {
+  var x = "outer";
+  fun middle() {
+    fun inner() { return x; }
+    x = "changed";
+    return inner;
+  }
+  return middle();
+}
+print outer()();
+`, nil},
+		{"objects", `
+var p = point.Scale(2);
+print p.X + p.Y;
+p.X = 10;
+print p.X;
+var scale = p.Scale;
+print scale(0.5).X;
+print p.Z;
+p.Z = 1;
+print "after";
+var ch = channel();
+fun send() { ch.send("sent"); }
+spawn send();
+print ch.recv();
+fun gen(n) { for (var i = 0; i < n; i = i + 1) yield i; }
+var sum = 0;
+for (var v in gen(4)) sum = sum + v;
+print sum;
+`, nil},
+		{"errors", `
+fun f(x) { return x + 1; }
+print f("a");
+print f(1, 2);
+print nil.x;
+var v = 1;
+v();
+var w = v();
+print w;
+print "after";
+print undefined;
+fun thrower(res, rej) { fail("thrown"); }
+fun caught(e) { print "caught: " + e; }
+promise(thrower).catch(caught);
+`, nil},
+		{"steps", `
+var n = 0;
+while (true) n = n + 1;
+`, []Option{MaxSteps(1000)}},
+		{"depth", `
+fun down(n) { return 1 + down(n + 1); }
+down(0);
+print "after";
+`, []Option{MaxDepth(64)}},
+		{"memory", `
+var s = "x";
+while (true) s = s + s;
+`, []Option{MaxMemory(1 << 16)}},
+		{"output", `
+while (true) print "spam";
+`, []Option{MaxOutput(100)}},
+	} {
+		var outs [2]string
+		for k, e := range []Engine{TreeWalker, Bytecode} {
+			p, diags := Compile([]byte(c.src))
+			if diags != nil {
+				t.Fatalf("%s: %v", c.name, diags)
+			}
+			var out bytes.Buffer
+			vm := NewVM(append([]Option{Backend(e), Stdout(&out), Stderr(&out)}, c.opts...)...)
+			if err := vm.Define("point", &diffPoint{1, 2}); err != nil {
+				t.Fatal(err)
+			}
+			err := vm.Run(context.Background(), p)
+			if err == nil {
+				err = vm.RunLoop(context.Background())
+			}
+			outs[k] = fmt.Sprintf("%s\nerror: %v", out.String(), err)
+		}
+		if outs[0] != outs[1] {
+			t.Errorf("%s: tree:\n%s\nvm:\n%s", c.name, outs[0], outs[1])
+		}
+	}
+}